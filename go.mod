@@ -1,3 +1,10 @@
 module dufs-mcp-server
 
 go 1.25.4
+
+require (
+	github.com/klauspost/compress v1.20.1
+	golang.org/x/net v0.47.0
+)
+
+require golang.org/x/text v0.31.0 // indirect
@@ -1,17 +1,52 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/http/httpproxy"
 )
 
 // MCP 协议消息结构
@@ -29,11 +64,37 @@ type MCPError struct {
 	Message string `json:"message"`
 }
 
+// JSON-RPC 错误码
+const (
+	errCodeParse          = -32700
+	errCodeInvalidRequest = -32600
+	errCodeInternal       = -32603
+	errCodeServer         = -32000
+	// errCodeNotFound 操作的远程路径不存在
+	errCodeNotFound = -32001
+	// errCodeTooFewEntries dufs_list 返回的条目数少于 min_entries
+	errCodeTooFewEntries = -32002
+	// errCodeFileTypeNotPermitted 上传的文件扩展名不在 DUFS_ALLOWED_EXTENSIONS 白名单中
+	errCodeFileTypeNotPermitted = -32003
+)
+
+// rpcError 携带 JSON-RPC 错误码的错误，handleMessage 会原样使用其中的错误码
+type rpcError struct {
+	Code    int
+	Message string
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
 // MCP 工具定义
 type MCPTool struct {
 	Name        string                 `json:"name"`
 	Description string                 `json:"description"`
 	InputSchema map[string]interface{} `json:"inputSchema"`
+	// OutputSchema 描述 tools/call 返回的 JSON 结果，可选
+	OutputSchema map[string]interface{} `json:"outputSchema,omitempty"`
 }
 
 // 配置结构
@@ -43,17 +104,129 @@ type Config struct {
 	Password      string `json:"password,omitempty"`
 	UploadDir     string `json:"upload_dir,omitempty"`
 	AllowInsecure bool   `json:"allow_insecure,omitempty"`
+	// UploadDirRoot dufs_set_upload_dir 允许设置的上传目录范围，为空时不限制
+	UploadDirRoot string `json:"upload_dir_root,omitempty"`
+	// MaxReadSize 需要把远程文件完整读入内存的操作允许的最大字节数
+	MaxReadSize int64 `json:"max_read_size,omitempty"`
+	// 双向 TLS：客户端证书、私钥以及自定义 CA（均为 PEM 文件路径）
+	ClientCertFile string `json:"client_cert,omitempty"`
+	ClientKeyFile  string `json:"client_key,omitempty"`
+	CACertFile     string `json:"ca_cert,omitempty"`
+	// TLSConfig 由 loadConfig 根据以上配置和 AllowInsecure 构建
+	TLSConfig *tls.Config `json:"-"`
+	// MaxRetries 失败操作（如上传大小校验不一致）允许的最大重试次数
+	MaxRetries int `json:"max_retries,omitempty"`
+	// DNSRetries 连接 dufs 时域名解析失败后的最大重试次数
+	DNSRetries int `json:"dns_retries,omitempty"`
+	// ProxyURL 访问 dufs 使用的代理地址，同样遵循 NO_PROXY；为空时遵循 HTTP_PROXY/HTTPS_PROXY/NO_PROXY，"direct" 表示不使用代理
+	ProxyURL string `json:"proxy_url,omitempty"`
+	// HTTP2 访问 dufs 的 HTTP/2 模式：为空时通过 TLS ALPN 自动协商，force 只使用 HTTP/2（http:// 使用 h2c），off 只使用 HTTP/1.1
+	HTTP2 string `json:"http2,omitempty"`
+	// 连接阶段的超时设置。请求体/响应体的传输不受全局超时限制，由每个请求的 context 控制
+	DialTimeout           time.Duration `json:"dial_timeout,omitempty"`
+	TLSHandshakeTimeout   time.Duration `json:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout time.Duration `json:"response_header_timeout,omitempty"`
+	IdleConnTimeout       time.Duration `json:"idle_conn_timeout,omitempty"`
+	// ToolTimeouts 按工具覆盖的超时时间，键为去掉 dufs_ 前缀的工具名
+	ToolTimeouts map[string]time.Duration `json:"tool_timeouts,omitempty"`
+	// ReconnectDelay stdio 模式下 stdin 关闭后重新打开的等待时间，0 表示直接退出
+	ReconnectDelay time.Duration `json:"reconnect_delay,omitempty"`
+	// SSEHeartbeatInterval SSE 心跳间隔，0 表示不发送心跳
+	SSEHeartbeatInterval time.Duration `json:"sse_heartbeat_interval,omitempty"`
+	// HTTPAuthToken HTTP 模式下要求客户端携带的 Bearer Token，为空表示不校验
+	HTTPAuthToken string `json:"http_auth_token,omitempty"`
+	// HTTP 模式的 TLS：服务端证书、私钥以及校验客户端证书使用的 CA（均为 PEM 文件路径）
+	HTTPTLSCertFile     string `json:"http_tls_cert,omitempty"`
+	HTTPTLSKeyFile      string `json:"http_tls_key,omitempty"`
+	HTTPTLSClientCAFile string `json:"http_tls_client_ca,omitempty"`
+	// HTTPTLSConfig 由 loadConfig 根据以上配置构建，未配置证书时为 nil，HTTP 模式使用明文 HTTP
+	HTTPTLSConfig *tls.Config `json:"-"`
+	// CORS HTTP 模式下的跨域配置
+	CORS CORSConfig `json:"cors"`
+	// AllowedExtensions 允许上传的文件扩展名（小写，带点），为空表示不限制
+	AllowedExtensions []string `json:"allowed_extensions,omitempty"`
+	// TrashDir 回收站目录，设置后 dufs_delete 默认移动到回收站而不是直接删除
+	TrashDir string `json:"trash_dir,omitempty"`
+	// DebugHTTPLogRequests HTTP 模式下记录 /message 的请求和响应，用于调试
+	DebugHTTPLogRequests bool `json:"debug_http_log_requests,omitempty"`
+	// Debug 输出 [debug] 级别的日志，例如递归删除时删除的每个路径
+	Debug bool `json:"debug,omitempty"`
+	// AllowSourceCommand 允许 dufs_upload 通过 source_command 执行本地命令并上传其输出
+	AllowSourceCommand bool `json:"allow_source_command,omitempty"`
+	// HTTPDisableGzip HTTP 模式下不对 /message 的响应做 gzip 压缩
+	HTTPDisableGzip bool `json:"http_disable_gzip,omitempty"`
+	// MaxJobs 同时存在的未结束后台任务数上限，0 表示不限制
+	MaxJobs int `json:"max_jobs,omitempty"`
+	// NotifyJobCompletion 后台任务完成或失败时发送 notifications/message 通知
+	NotifyJobCompletion bool `json:"notify_job_completion,omitempty"`
+	// MaxUploadBytes 单个上传文件（分片上传时为单个分片）的大小上限，0 表示不限制
+	MaxUploadBytes int64 `json:"max_upload_bytes,omitempty"`
+	// UploadConcurrency 并发请求 dufs 的数量上限，例如 dufs_list 的 with_hashes 并发获取哈希
+	UploadConcurrency int `json:"upload_concurrency,omitempty"`
+	// JobIDFormat 任务 ID 格式：nano、uuid、sequential、label-nano，为空时使用序号加随机部分的默认格式
+	JobIDFormat string `json:"job_id_format,omitempty"`
+	// CopyBufferSize 上传下载时读写数据使用的缓冲区大小（字节）
+	CopyBufferSize int `json:"copy_buffer_size,omitempty"`
+	// MaxMessageBytes 单条 JSON-RPC 消息（stdio 的一行或 HTTP 请求体）的大小上限
+	MaxMessageBytes int64 `json:"max_message_bytes,omitempty"`
+	// AcceptLanguage 每个 dufs 请求携带的 Accept-Language，可被工具调用的 language 参数覆盖
+	AcceptLanguage string `json:"accept_language,omitempty"`
+	// SnapshotDir dufs_diff_snapshot 保存目录列表快照的本地目录
+	SnapshotDir string `json:"snapshot_dir,omitempty"`
+	// Servers 额外的命名 dufs 服务器，工具调用通过 server 参数选择；未指定时使用 DufsURL 对应的主服务器
+	Servers map[string]ServerConfig `json:"servers,omitempty"`
+}
+
+// CORSConfig HTTP 模式下的跨域配置
+type CORSConfig struct {
+	// Origins 允许的跨域来源，包含 "*" 表示允许任意来源
+	Origins []string `json:"origins,omitempty"`
+	// Methods 返回的 Access-Control-Allow-Methods
+	Methods string `json:"methods,omitempty"`
+	// Headers 返回的 Access-Control-Allow-Headers
+	Headers string `json:"headers,omitempty"`
+}
+
+// ServerConfig 一个命名 dufs 服务器的地址和认证信息
+type ServerConfig struct {
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
 }
 
+// defaultServerName 主服务器（DUFS_URL）在 server 参数中的名称
+const defaultServerName = "default"
+
+// defaultMaxReadSize 默认允许读入内存的远程文件大小（10 MiB）
+const defaultMaxReadSize = 10 << 20
+
+// defaultMaxMessageBytes 默认的单条 JSON-RPC 消息大小上限（16 MiB）
+const defaultMaxMessageBytes = 16 << 20
+
+// defaultCopyBufferSize 默认的传输缓冲区大小（256 KiB）。每个进行中的传输各占一份，不宜过大
+const defaultCopyBufferSize = 256 << 10
+
 // DufsClient 封装 dufs API 调用
 type DufsClient struct {
-	BaseURL  string
-	Username string
-	Password string
-	Client   *http.Client
+	BaseURL        string
+	Username       string
+	Password       string
+	AcceptLanguage string
+	Client         *http.Client
+	// mkcolState 服务器是否支持 MKCOL 的探测结果：mkcolUnknown、mkcolSupported 或 mkcolDisabled
+	mkcolState atomic.Int32
 }
 
-type UploadTaskResult struct {
+// MKCOL 支持情况的探测结果
+const (
+	mkcolUnknown int32 = iota
+	mkcolSupported
+	mkcolDisabled
+)
+
+// JobTask 后台任务中的一项操作（上传或下载）及其执行结果
+type JobTask struct {
+	Operation           string    `json:"operation"`
 	LocalPath           string    `json:"local_path"`
 	RequestedRemotePath string    `json:"requested_remote_path,omitempty"`
 	ResolvedRemotePath  string    `json:"resolved_remote_path,omitempty"`
@@ -63,70 +236,1152 @@ type UploadTaskResult struct {
 	HTTPStatus          int       `json:"http_status,omitempty"`
 	StartedAt           time.Time `json:"started_at,omitempty"`
 	CompletedAt         time.Time `json:"completed_at,omitempty"`
+	// ResponseHeaders 上传成功后 PUT 响应返回的 headers，例如 CDN 返回的 X-CDN-URL
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	// UploadOptions 上传任务的可选行为
+	UploadOptions uploadOptions `json:"-"`
+	// MaxRetries 失败后最多重试的次数，大于 0 时失败不会终止任务，而是在其余任务项执行完后重试
+	MaxRetries int `json:"-"`
+	// RetryCount 已经重试的次数
+	RetryCount int `json:"retry_count,omitempty"`
+	// Manifest 分片上传时的分片清单
+	Manifest *SplitManifest `json:"manifest,omitempty"`
+	// 以下字段仅用于下载任务
+	SizeBytes       int64           `json:"size_bytes,omitempty"`
+	SHA256          string          `json:"sha256,omitempty"`
+	DownloadOptions downloadOptions `json:"-"`
+	// 以下字段仅用于 dufs_exec_plan 的步骤：步骤类型、步骤参数和对应工具的返回
+	StepType   string                 `json:"step_type,omitempty"`
+	StepArgs   map[string]interface{} `json:"-"`
+	StepResult interface{}            `json:"step_result,omitempty"`
+	// ContinueOnError 失败后继续执行后面的任务项，不重试
+	ContinueOnError bool `json:"-"`
+	// 传输进度，查询任务状态时从 progress 中取快照
+	BytesTransferred int64   `json:"bytes_transferred,omitempty"`
+	TotalBytes       int64   `json:"total_bytes,omitempty"`
+	ProgressPercent  float64 `json:"progress_percent,omitempty"`
+	// BytesPerSecond 平均传输速度，ETASeconds 运行中任务按当前速度估算的剩余时间
+	BytesPerSecond float64 `json:"bytes_per_second,omitempty"`
+	ETASeconds     float64 `json:"eta_seconds,omitempty"`
+
+	progress *transferProgress
+}
+
+// transferRate 计算平均速度（字节/秒），耗时为 0 时返回 0，避免除零
+func transferRate(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / elapsed.Seconds()
+}
+
+// bytesPerSecondToMbps 把字节/秒换算为 Mbps（兆比特每秒）
+func bytesPerSecondToMbps(rate float64) float64 {
+	return math.Round(rate*8/1e6*100) / 100
+}
+
+// transferProgress 记录一次传输的进度，由传输所在的 goroutine 原子更新
+type transferProgress struct {
+	transferred atomic.Int64
+	total       atomic.Int64
+}
+
+// progressReader 包装响应体，每次读取时累加已传输字节数
+type progressReader struct {
+	reader   io.Reader
+	progress *transferProgress
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.reader.Read(buf)
+	p.progress.transferred.Add(int64(n))
+	return n, err
+}
+
+// trackProgress 在 progress 不为空时包装 reader
+func trackProgress(reader io.Reader, progress *transferProgress) io.Reader {
+	if progress == nil {
+		return reader
+	}
+	return &progressReader{reader: reader, progress: progress}
+}
+
+// 任务类型，同时也是任务项的操作类型
+const (
+	jobTypeUpload   = "upload"
+	jobTypeDownload = "download"
+	// jobOpDownloadFolder 以 zip 形式下载整个文件夹，属于 download 类型的任务
+	jobOpDownloadFolder = "download_folder"
+	// jobTypePlan dufs_exec_plan 的异步任务，每个任务项为一个步骤（操作类型为 jobOpPlanStep）
+	jobTypePlan   = "plan"
+	jobOpPlanStep = "plan_step"
+)
+
+// Job 后台任务，Type 表示任务类型，Tasks 中的每一项描述一个具体操作
+type Job struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Label       string    `json:"label,omitempty"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+	Tasks       []JobTask `json:"tasks"`
+	// IdempotencyKey 创建任务时传入的 idempotency_key，重复调用时返回同一个任务
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// ManifestPath 任务结束后写入上传清单的本地路径，ManifestWritten 表示已写入，ManifestError 为写入失败的原因
+	ManifestPath    string `json:"manifest_path,omitempty"`
+	ManifestWritten bool   `json:"manifest_written,omitempty"`
+	ManifestError   string `json:"manifest_error,omitempty"`
+	// Events 任务及任务项的状态变化记录，通过 dufs_job_events 查询
+	Events []UploadJobEvent `json:"-"`
+
+	cancel context.CancelFunc
+}
+
+// UploadJobEvent 一次状态变化。TaskIndex 为 -1 时表示任务整体的状态变化
+type UploadJobEvent struct {
+	JobID      string    `json:"job_id"`
+	Timestamp  time.Time `json:"timestamp"`
+	TaskIndex  int       `json:"task_index"`
+	FromStatus string    `json:"from_status,omitempty"`
+	ToStatus   string    `json:"to_status"`
+	Message    string    `json:"message,omitempty"`
+}
+
+// isTerminal 任务是否已经结束
+func (j *Job) isTerminal() bool {
+	return j.Status == "completed" || j.Status == "failed" || j.Status == "cancelled"
+}
+
+// setStatus 修改任务整体状态并记录事件，调用方需持有 jobsMutex
+func (j *Job) setStatus(status, message string) {
+	j.Events = append(j.Events, UploadJobEvent{
+		JobID:      j.ID,
+		Timestamp:  time.Now(),
+		TaskIndex:  -1,
+		FromStatus: j.Status,
+		ToStatus:   status,
+		Message:    message,
+	})
+	j.Status = status
+}
+
+// setTaskStatus 修改任务项状态并记录事件，调用方需持有 jobsMutex
+func (j *Job) setTaskStatus(index int, status, message string) {
+	j.Events = append(j.Events, UploadJobEvent{
+		JobID:      j.ID,
+		Timestamp:  time.Now(),
+		TaskIndex:  index,
+		FromStatus: j.Tasks[index].Status,
+		ToStatus:   status,
+		Message:    message,
+	})
+	j.Tasks[index].Status = status
+}
+
+// 工具返回结果。各结构体序列化后作为 tools/call 返回的 text 内容，
+// 其中 status 字段统一表示 dufs 返回的 HTTP 状态码
+
+// JobStartedResult 异步工具创建后台任务后的返回
+type JobStartedResult struct {
+	Success   bool   `json:"success"`
+	JobID     string `json:"job_id"`
+	Status    string `json:"status"`
+	TaskCount int    `json:"task_count,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Label     string `json:"label,omitempty"`
+	// LabelCollision 已存在使用相同 label 的任务，新任务仍以唯一 ID 创建
+	LabelCollision bool `json:"label_collision,omitempty"`
+	// Replayed 已有使用相同 idempotency_key 的任务，返回的是该任务而不是新任务
+	Replayed bool `json:"replayed,omitempty"`
+}
+
+// UploadBatchStartedResult dufs_upload_batch 异步模式的返回
+type UploadBatchStartedResult struct {
+	JobStartedResult
+	// DuplicatesRemoved 因 local_path 重复被合并的条目数
+	DuplicatesRemoved int `json:"duplicates_removed"`
+	// DiscoveredCount 使用 source_dir 时在目录中找到的文件数（排除之后）
+	DiscoveredCount int `json:"discovered_count,omitempty"`
+}
+
+// FolderDownloadStartedResult dufs_download_folder 在 show_progress 模式下的返回
+type FolderDownloadStartedResult struct {
+	JobStartedResult
+	// TotalBytes 预估的 zip 大小，未知时为 -1；使用 include/exclude 时为所选文件的大小之和
+	TotalBytes int64 `json:"total_bytes"`
+	// Files 和 ExcludedCount 仅在使用 include/exclude 时返回：选中的文件（相对路径）和被排除的条目数
+	Files         []string `json:"files,omitempty"`
+	ExcludedCount int      `json:"excluded_count,omitempty"`
+}
+
+// ClientZipResult dufs_download_folder 使用 client_zip 时的返回
+type ClientZipResult struct {
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	LocalPath string `json:"local_path"`
+	// Files 写入 zip 的文件（相对路径）
+	Files []string `json:"files"`
+	Count int      `json:"count"`
+	// SizeBytes 生成的 zip 文件大小，UncompressedBytes 为写入文件的原始大小之和
+	SizeBytes         int64 `json:"size_bytes"`
+	UncompressedBytes int64 `json:"uncompressed_bytes"`
+	ExcludedCount     int   `json:"excluded_count"`
+}
+
+// FilteredFolderDownloadResult dufs_download_folder 使用 include/exclude 同步下载时的返回，
+// 选中的文件逐个下载到 LocalPath 目录下，单个文件失败不影响其他文件
+type FilteredFolderDownloadResult struct {
+	Success   bool                 `json:"success"`
+	LocalPath string               `json:"local_path"`
+	Results   []DownloadFileResult `json:"results"`
+	Count     int                  `json:"count"`
+	SizeBytes int64                `json:"size_bytes"`
+	// ExcludedCount 被 exclude 排除或不匹配 include 的条目数，被排除目录下的内容不再列出也不计入
+	ExcludedCount int `json:"excluded_count"`
+}
+
+// UploadResult dufs_upload 同步上传的结果
+type UploadResult struct {
+	Success    bool   `json:"success"`
+	Message    string `json:"message"`
+	RemotePath string `json:"remote_path"`
+	Status     int    `json:"status"`
+	// ResponseHeaders PUT 响应返回的 headers
+	ResponseHeaders map[string]string `json:"response_headers"`
+	// SizeVerified 和 Attempts 仅在 verify_size=true 时返回
+	SizeVerified   *bool   `json:"size_verified,omitempty"`
+	Attempts       int     `json:"attempts,omitempty"`
+	DurationMs     int64   `json:"duration_ms"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	Mbps           float64 `json:"mbps"`
+	// 以下字段仅在使用 pre_process 压缩时返回
+	OriginalSize     int64   `json:"original_size,omitempty"`
+	CompressedSize   int64   `json:"compressed_size,omitempty"`
+	CompressionRatio float64 `json:"compression_ratio,omitempty"`
+	// Manifest 和 ManifestPath 仅在按 split_threshold_bytes 分片上传时返回
+	Manifest     *SplitManifest `json:"manifest,omitempty"`
+	ManifestPath string         `json:"manifest_path,omitempty"`
+	// 以下字段仅在 preserve_mtime=true 时返回：本地修改时间、上传后服务器报告的修改时间以及两者是否一致
+	PreservedMtime string `json:"preserved_mtime,omitempty"`
+	RemoteMtime    string `json:"remote_mtime,omitempty"`
+	MtimePreserved *bool  `json:"mtime_preserved,omitempty"`
+	// Atomic 仅在 atomic=true 时返回：文件先上传到临时路径，确认完整后移动到了 remote_path
+	Atomic bool `json:"atomic,omitempty"`
+	// IsSymlink 和 SymlinkTarget 仅在 local_path 是符号链接时返回，上传的是链接指向的文件内容
+	IsSymlink     bool   `json:"is_symlink,omitempty"`
+	SymlinkTarget string `json:"symlink_target,omitempty"`
+	// SourceCommand 和 UploadedBytes 仅在通过 source_command 上传时返回：执行的命令和上传的输出字节数
+	SourceCommand string `json:"source_command,omitempty"`
+	UploadedBytes int64  `json:"uploaded_bytes,omitempty"`
+}
+
+// UploadFileResult 批量同步上传中单个文件的结果
+type UploadFileResult struct {
+	LocalPath  string `json:"local_path"`
+	RemotePath string `json:"remote_path"`
+	Success    bool   `json:"success"`
+	Error      string `json:"error,omitempty"`
+	Status     int    `json:"status"`
+	RetryCount int    `json:"retry_count,omitempty"`
+}
+
+// UploadBatchResult dufs_upload_batch 同步模式的返回
+type UploadBatchResult struct {
+	Success           bool               `json:"success"`
+	Results           []UploadFileResult `json:"results"`
+	Count             int                `json:"count"`
+	DuplicatesRemoved int                `json:"duplicates_removed"`
+	DiscoveredCount   int                `json:"discovered_count,omitempty"`
+}
+
+// DownloadResult dufs_download 和 dufs_download_folder 的返回
+type DownloadResult struct {
+	Success    bool   `json:"success"`
+	Message    string `json:"message"`
+	RemotePath string `json:"remote_path"`
+	LocalPath  string `json:"local_path"`
+	SizeBytes  int64  `json:"size_bytes"`
+	Status     int    `json:"status"`
+	// 以下字段仅在下载时解压才返回
+	Decompressed      string `json:"decompressed,omitempty"`
+	CompressedBytes   int64  `json:"compressed_bytes,omitempty"`
+	DecompressedBytes int64  `json:"decompressed_bytes,omitempty"`
+	// SHA256 写入本地文件内容的哈希，仅在指定 expected_sha256 并校验通过时返回
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// JoinPartsResult dufs_join_parts 的返回
+type JoinPartsResult struct {
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	LocalPath string `json:"local_path"`
+	SizeBytes int64  `json:"size_bytes"`
+	PartCount int    `json:"part_count"`
+	SHA256    string `json:"sha256"`
+}
+
+// DownloadFileResult 批量同步下载中单个文件的结果
+type DownloadFileResult struct {
+	RemotePath string `json:"remote_path"`
+	LocalPath  string `json:"local_path"`
+	Success    bool   `json:"success"`
+	Error      string `json:"error,omitempty"`
+	Skipped    bool   `json:"skipped"`
+	SizeBytes  int64  `json:"size_bytes"`
+	SHA256     string `json:"sha256,omitempty"`
+	Status     int    `json:"status"`
+}
+
+// DownloadBatchResult dufs_download_batch 同步模式的返回
+type DownloadBatchResult struct {
+	Success bool                 `json:"success"`
+	Results []DownloadFileResult `json:"results"`
+	Count   int                  `json:"count"`
+}
+
+// JobStatusResult dufs_upload_status 的返回
+type JobStatusResult struct {
+	Success bool `json:"success"`
+	Job     Job  `json:"job"`
+}
+
+// DownloadStatusResult dufs_download_status 的返回，TotalBytes 和 ProgressPercent 仅在总大小已知时返回
+type DownloadStatusResult struct {
+	Success          bool    `json:"success"`
+	Job              Job     `json:"job"`
+	BytesTransferred int64   `json:"bytes_transferred"`
+	TotalBytes       int64   `json:"total_bytes,omitempty"`
+	ProgressPercent  float64 `json:"progress_percent,omitempty"`
+}
+
+// JobSummary dufs_list_jobs 中单个任务的概要
+type JobSummary struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type"`
+	Label       string     `json:"label,omitempty"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	TaskCount   int        `json:"task_count"`
+}
+
+// ListJobsResult dufs_list_jobs 的返回
+type ListJobsResult struct {
+	Success bool         `json:"success"`
+	Jobs    []JobSummary `json:"jobs"`
+	Count   int          `json:"count"`
+}
+
+// JobEventsResult dufs_job_events 的返回
+type JobEventsResult struct {
+	Success bool             `json:"success"`
+	Events  []UploadJobEvent `json:"events"`
+	Count   int              `json:"count"`
+}
+
+// CancelJobResult dufs_cancel_job 的返回
+type CancelJobResult struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Job     Job    `json:"job"`
+}
+
+// DeleteResult dufs_delete 的返回，移动到回收站时 TrashPath 为回收站中的路径
+type DeleteResult struct {
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	TrashPath string `json:"trash_path,omitempty"`
+	Status    int    `json:"status"`
+	// DeletedCount 逐个删除目录树时删除的文件和目录数
+	DeletedCount int `json:"deleted_count,omitempty"`
+}
+
+// RestoreResult dufs_restore 的返回
+type RestoreResult struct {
+	Success      bool   `json:"success"`
+	Message      string `json:"message"`
+	RestoredPath string `json:"restored_path"`
+	Status       int    `json:"status"`
+}
+
+// ListResult dufs_list 的返回，Data 为 format=json 时解析后的列表，否则为原始文本
+type ListResult struct {
+	Success bool        `json:"success"`
+	Data    interface{} `json:"data"`
+	Status  int         `json:"status"`
+	// 以下字段仅在指定 modified_after / modified_before / name_regex 时返回：通过过滤的条目数和过滤前的条目数
+	FilteredCount *int `json:"filtered_count,omitempty"`
+	TotalCount    *int `json:"total_count,omitempty"`
+	// RegexCompileError name_regex 无法编译时的错误，此时不按名称过滤
+	RegexCompileError string `json:"regex_compile_error,omitempty"`
+}
+
+// CreateDirResult dufs_create_dir 的返回
+type CreateDirResult struct {
+	Success        bool   `json:"success"`
+	AlreadyExisted bool   `json:"already_existed"`
+	Message        string `json:"message"`
+	Status         int    `json:"status"`
+	// Created 和 Existed 仅在 parents=true 时返回：路径上新建的目录和已存在的目录
+	Created []string `json:"created,omitempty"`
+	Existed []string `json:"existed,omitempty"`
+}
+
+// MoveResult dufs_move 的返回
+type MoveResult struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+}
+
+// LockResult dufs_lock 的返回
+type LockResult struct {
+	Success bool   `json:"success"`
+	Path    string `json:"path"`
+	Token   string `json:"token"`
+	// TimeoutSeconds 请求的锁超时时间
+	TimeoutSeconds int `json:"timeout_seconds"`
+	Status         int `json:"status"`
+}
+
+// UnlockResult dufs_unlock 的返回
+type UnlockResult struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+}
+
+// MoveTreeItem dufs_move_tree 中单个文件的移动结果
+type MoveTreeItem struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Success     bool   `json:"success"`
+	Error       string `json:"error,omitempty"`
+}
+
+// MoveTreeResult dufs_move_tree 的返回，有文件移动失败时 Success 为 false。DryRun 时只列出计划的移动
+type MoveTreeResult struct {
+	Success     bool           `json:"success"`
+	DryRun      bool           `json:"dry_run"`
+	Results     []MoveTreeItem `json:"results"`
+	Count       int            `json:"count"`
+	FailedCount int            `json:"failed_count"`
+}
+
+// MoveBatchItem dufs_move_batch 中单个移动的结果
+type MoveBatchItem struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Success     bool   `json:"success"`
+	HTTPStatus  int    `json:"http_status,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// Skipped continue_on_error=false 且已有移动失败时，未执行的移动
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// MoveBatchResult dufs_move_batch 的返回，Results 与 moves 参数顺序一致
+type MoveBatchResult struct {
+	Success   bool            `json:"success"`
+	Results   []MoveBatchItem `json:"results"`
+	Succeeded int             `json:"succeeded"`
+	Failed    int             `json:"failed"`
+	Skipped   int             `json:"skipped"`
+}
+
+// PlanStepResult dufs_exec_plan 中单个步骤的结果，Result 为对应工具的返回
+type PlanStepResult struct {
+	Index  int         `json:"index"`
+	Type   string      `json:"type"`
+	Status string      `json:"status"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// ExecPlanResult dufs_exec_plan 同步执行的返回，Results 与 steps 参数顺序一致
+type ExecPlanResult struct {
+	Success   bool             `json:"success"`
+	Results   []PlanStepResult `json:"results"`
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+	Skipped   int              `json:"skipped"`
+}
+
+// HashResult dufs_get_hash 的返回
+type HashResult struct {
+	Success bool   `json:"success"`
+	Hash    string `json:"hash"`
+	Path    string `json:"path"`
+}
+
+// PathHashResult dufs_get_multiple_hashes 中单个路径的结果。Match 仅在传入 expected 且该路径有期望值时返回
+type PathHashResult struct {
+	Path  string `json:"path"`
+	Hash  string `json:"hash,omitempty"`
+	Error string `json:"error,omitempty"`
+	Match *bool  `json:"match,omitempty"`
+}
+
+// MultipleHashesResult dufs_get_multiple_hashes 的返回，有路径失败或哈希不匹配时 Success 为 false
+type MultipleHashesResult struct {
+	Success         bool             `json:"success"`
+	Results         []PathHashResult `json:"results"`
+	Count           int              `json:"count"`
+	FailedCount     int              `json:"failed_count"`
+	MismatchedCount int              `json:"mismatched_count"`
+}
+
+// PreviewResult dufs_preview 的返回。文本内容直接放在 Preview 中，二进制内容为 base64
+type PreviewResult struct {
+	Success bool   `json:"success"`
+	Path    string `json:"path"`
+	Preview string `json:"preview"`
+	// Encoding text 或 base64
+	Encoding     string `json:"encoding"`
+	IsText       bool   `json:"is_text"`
+	ContentType  string `json:"content_type"`
+	PreviewBytes int    `json:"preview_bytes"`
+	// TotalSize 文件总大小，服务器没有返回时为 -1
+	TotalSize int64 `json:"total_size"`
+	// Truncated 预览没有包含完整文件时为 true
+	Truncated bool `json:"truncated"`
+	Status    int  `json:"status"`
+}
+
+// DiffResult dufs_diff 的返回，路径均相对于比较的目录
+type DiffResult struct {
+	Success         bool     `json:"success"`
+	OnlyLocal       []string `json:"only_local"`
+	OnlyRemote      []string `json:"only_remote"`
+	Different       []string `json:"different"`
+	OnlyLocalBytes  int64    `json:"only_local_bytes"`
+	OnlyRemoteBytes int64    `json:"only_remote_bytes"`
+	DifferentBytes  int64    `json:"different_bytes"`
+	IdenticalCount  int      `json:"identical_count"`
+}
+
+// ListDiffResult dufs_list_diff 的返回，路径均相对于比较的目录。Hashes 仅在 compare_hashes=true 时返回
+type ListDiffResult struct {
+	Success bool            `json:"success"`
+	OnlyInA []string        `json:"only_in_a"`
+	OnlyInB []string        `json:"only_in_b"`
+	InBoth  []string        `json:"in_both"`
+	Hashes  *ListDiffHashes `json:"hashes,omitempty"`
+}
+
+// ListDiffHashes 两边都存在的文件按哈希比较的结果
+type ListDiffHashes struct {
+	Identical []IdenticalFile `json:"identical"`
+	Different []DifferentFile `json:"different"`
+}
+
+// IdenticalFile 两边内容相同的文件
+type IdenticalFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// DifferentFile 两边内容不同的文件
+type DifferentFile struct {
+	Path  string `json:"path"`
+	HashA string `json:"hash_a"`
+	HashB string `json:"hash_b"`
 }
 
-type UploadJob struct {
-	ID          string             `json:"id"`
-	Status      string             `json:"status"`
-	Error       string             `json:"error,omitempty"`
-	CreatedAt   time.Time          `json:"created_at"`
-	CompletedAt time.Time          `json:"completed_at,omitempty"`
-	Tasks       []UploadTaskResult `json:"tasks"`
+// SnapshotDiffResult dufs_diff_snapshot 的返回。Baseline 为 true 表示之前没有可用的快照，
+// 本次列表作为基准保存，Added/Removed/Modified 均为空
+type SnapshotDiffResult struct {
+	Success   bool   `json:"success"`
+	Path      string `json:"path"`
+	Recursive bool   `json:"recursive"`
+	Baseline  bool   `json:"baseline"`
+	// SnapshotCorrupt 之前的快照文件无法解析，已按首次调用处理并覆盖
+	SnapshotCorrupt bool            `json:"snapshot_corrupt,omitempty"`
+	PreviousAt      *time.Time      `json:"previous_at,omitempty"`
+	Added           []SnapshotEntry `json:"added"`
+	Removed         []SnapshotEntry `json:"removed"`
+	Modified        []SnapshotDelta `json:"modified"`
+	UnchangedCount  int             `json:"unchanged_count"`
+	Count           int             `json:"count"`
+	SnapshotFile    string          `json:"snapshot_file"`
+}
+
+// SnapshotEntry 快照中的一项，Path 为相对于列出目录的路径，Mtime 为毫秒时间戳
+type SnapshotEntry struct {
+	Path  string `json:"path"`
+	IsDir bool   `json:"is_dir,omitempty"`
+	Size  int64  `json:"size"`
+	Mtime int64  `json:"mtime"`
+}
+
+// SnapshotDelta 大小或修改时间发生变化的条目
+type SnapshotDelta struct {
+	Path     string `json:"path"`
+	OldSize  int64  `json:"old_size"`
+	NewSize  int64  `json:"new_size"`
+	OldMtime int64  `json:"old_mtime"`
+	NewMtime int64  `json:"new_mtime"`
+}
+
+// SetContentTypeResult dufs_set_content_type 的返回
+type SetContentTypeResult struct {
+	Success        bool   `json:"success"`
+	Message        string `json:"message"`
+	Path           string `json:"path"`
+	OldContentType string `json:"old_content_type"`
+	NewContentType string `json:"new_content_type"`
+	SizeBytes      int    `json:"size_bytes"`
+	Status         int    `json:"status"`
+}
+
+// ProxyTestResult dufs_test_proxy 的返回。ProxyURL 为访问 DUFS_URL 实际使用的代理（已隐藏密码），为空表示直连
+type ProxyTestResult struct {
+	Success    bool   `json:"success"`
+	Configured string `json:"configured"`
+	UsingProxy bool   `json:"using_proxy"`
+	ProxyURL   string `json:"proxy_url,omitempty"`
+	// RemoteAddr 实际建立连接的地址，经过代理时为代理的地址
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	Reachable  bool   `json:"reachable"`
+	Status     int    `json:"status,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// InfoResult dufs_info 的返回：实际生效的配置，密码和令牌只报告是否设置
+type InfoResult struct {
+	Success          bool   `json:"success"`
+	DufsURL          string `json:"dufs_url"`
+	AuthConfigured   bool   `json:"auth_configured"`
+	Username         string `json:"username,omitempty"`
+	PasswordSet      bool   `json:"password_set"`
+	UploadDir        string `json:"upload_dir,omitempty"`
+	AllowInsecure    bool   `json:"allow_insecure"`
+	ClientCertSet    bool   `json:"client_cert_set"`
+	CACertSet        bool   `json:"ca_cert_set"`
+	Proxy            string `json:"proxy"`
+	HTTP2            string `json:"http2"`
+	HTTPAuthTokenSet bool   `json:"http_auth_token_set"`
+	MaxReadSize      int64  `json:"max_read_size"`
+	MaxUploadBytes   int64  `json:"max_upload_bytes"`
+	MaxRetries       int    `json:"max_retries"`
+	DNSRetries       int    `json:"dns_retries"`
+	// HTTPTLS HTTP 模式是否启用 TLS，HTTPMTLS 是否要求并校验客户端证书
+	HTTPTLS  bool `json:"http_tls"`
+	HTTPMTLS bool `json:"http_mtls"`
+	// ConnectionTimeouts 连接阶段的超时，ToolTimeouts 为每个工具实际使用的超时
+	ConnectionTimeouts map[string]string `json:"connection_timeouts"`
+	ToolTimeouts       map[string]string `json:"tool_timeouts"`
+	Servers            []InfoServer      `json:"servers,omitempty"`
+	Tools              []string          `json:"tools"`
+}
+
+// UploadDirResult dufs_set_upload_dir 的返回
+type UploadDirResult struct {
+	Success bool `json:"success"`
+	// UploadDir 当前生效的默认上传目录，Previous 为修改前的值（仅修改时返回）
+	UploadDir string `json:"upload_dir"`
+	Previous  string `json:"previous,omitempty"`
+	// Configured 启动时配置的 DUFS_UPLOAD_DIR，Root 为 DUFS_UPLOAD_DIR_ROOT
+	Configured string `json:"configured"`
+	Root       string `json:"root,omitempty"`
+	Changed    bool   `json:"changed"`
+}
+
+// InfoServer dufs_info 中的一个命名服务器
+type InfoServer struct {
+	Name           string `json:"name"`
+	URL            string `json:"url"`
+	AuthConfigured bool   `json:"auth_configured"`
+}
+
+// MonitoringStatusResult dufs_start_monitoring、dufs_stop_monitoring 和 dufs_monitoring_status 的返回
+type MonitoringStatusResult struct {
+	Success         bool   `json:"success"`
+	Message         string `json:"message,omitempty"`
+	Running         bool   `json:"running"`
+	IntervalSeconds int    `json:"interval_seconds,omitempty"`
+	MaxFailures     int    `json:"max_failures,omitempty"`
+	CallbackURL     string `json:"callback_url,omitempty"`
+	// Healthy 最近一次检查是否成功，Checks 为已执行的检查次数
+	Healthy             bool       `json:"healthy"`
+	Checks              int        `json:"checks"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	StartedAt           *time.Time `json:"started_at,omitempty"`
+	LastCheckAt         *time.Time `json:"last_check_at,omitempty"`
+	LastStatus          int        `json:"last_status,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	// AlertsSent 成功发送到 callback_url 的告警数，LastAlertError 为最近一次发送失败的原因
+	AlertsSent     int    `json:"alerts_sent"`
+	LastAlertError string `json:"last_alert_error,omitempty"`
+}
+
+// HealthAlert 健康监控 POST 到 callback_url 的告警。event 为 unhealthy（连续失败达到 max_failures）
+// 或 recovered（告警后再次检查成功）
+type HealthAlert struct {
+	Event               string    `json:"event"`
+	DufsURL             string    `json:"dufs_url"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastStatus          int       `json:"last_status,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+	Time                time.Time `json:"time"`
+}
+
+// HealthResult dufs_health 的返回
+type HealthResult struct {
+	Success bool `json:"success"`
+	Status  int  `json:"status"`
+	Healthy bool `json:"healthy"`
+	// Protocol 与 dufs 实际使用的协议，如 HTTP/1.1、HTTP/2.0
+	Protocol string `json:"protocol"`
+}
+
+// outputSchemaOf 根据结果结构体的 json tag 生成工具的 outputSchema。
+// 工具有多种返回形式（例如同步和异步）时传入所有结果类型，字段取并集，
+// 只有所有形式都会返回（没有 omitempty）的字段才标记为 required
+func outputSchemaOf(results ...interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for i, result := range results {
+		props, req := structSchemaFields(reflect.TypeOf(result))
+		for name, prop := range props {
+			// 同名字段在不同形式中类型不同时（例如 status 在同步结果中是 HTTP 状态码，在异步结果中是任务状态），两种都允许
+			if existing, ok := properties[name]; ok && !reflect.DeepEqual(existing, prop) {
+				prop = map[string]interface{}{"anyOf": []interface{}{existing, prop}}
+			}
+			properties[name] = prop
+		}
+		if i == 0 {
+			required = req
+			continue
+		}
+		required = slices.DeleteFunc(required, func(name string) bool {
+			return !slices.Contains(req, name)
+		})
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// structSchemaFields 返回结构体各 json 字段的 schema 和必有字段，嵌入的结构体字段会被展开
+func structSchemaFields(t reflect.Type) (map[string]interface{}, []string) {
+	properties := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			props, req := structSchemaFields(field.Type)
+			for name, prop := range props {
+				properties[name] = prop
+			}
+			required = append(required, req...)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = typeSchema(field.Type)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	return properties, required
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// typeSchema 把 Go 类型映射为 JSON Schema。nil 的 slice 和 map 会被序列化为 null，因此允许 null
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": []string{"array", "null"}, "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": []string{"object", "null"}, "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties, required := structSchemaFields(t)
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	default:
+		// interface{} 等无法确定类型的字段不做限制
+		return map[string]interface{}{}
+	}
 }
 
 func NewDufsClient(config Config) *DufsClient {
 	return &DufsClient{
-		BaseURL:  config.DufsURL,
-		Username: config.Username,
-		Password: config.Password,
+		BaseURL:        config.DufsURL,
+		Username:       config.Username,
+		Password:       config.Password,
+		AcceptLanguage: config.AcceptLanguage,
+		// 不设置 Client.Timeout：它会把连接时间和整个传输时间算在一起，导致大文件传输超时
 		Client: &http.Client{
-			Timeout: 30 * time.Second,
+			Transport:     newTransport(config),
+			CheckRedirect: checkRedirect,
 		},
 	}
 }
 
-func (c *DufsClient) makeRequest(method, path string, body io.Reader, headers map[string]string) (*http.Response, error) {
-	url := strings.TrimSuffix(c.BaseURL, "/") + "/" + strings.TrimPrefix(path, "/")
-	req, err := http.NewRequest(method, url, body)
+// checkRedirect 只为 GET/HEAD 自动跟随重定向。其他方法遇到 301/302/303 时
+// Go 默认会改成不带请求体的 GET 再跟随，PUT 等写操作会因此被误报为成功，
+// 所以这里直接把 3xx 响应交给调用方处理
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if method := via[0].Method; method != "GET" && method != "HEAD" {
+		return http.ErrUseLastResponse
+	}
+	return nil
+}
+
+// newTransport 根据配置构建 dufs 客户端使用的 http.Transport
+func newTransport(config Config) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxyFunc(config.ProxyURL),
+		DialContext:           dialWithDNSRetry(dialer.DialContext, config.DNSRetries),
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConns:          100,
+		// 没有显式设置 Accept-Encoding 和 Range 的请求由 Transport 自动携带 Accept-Encoding: gzip
+		// 并透明解压 gzip 响应（resp.Uncompressed 为 true），大目录的 JSON 列表和文本下载因此按压缩传输。
+		// 不要在请求中手动设置 Accept-Encoding，否则需要自己解压
+		DisableCompression: false,
+		// 上传的请求体由 Transport 写入连接，缓冲区大小决定每次写入的系统调用大小
+		WriteBufferSize: config.CopyBufferSize,
+		ReadBufferSize:  config.CopyBufferSize,
+	}
+
+	if config.TLSConfig != nil {
+		transport.TLSClientConfig = config.TLSConfig.Clone()
+	} else if config.AllowInsecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	// 自定义了 DialContext 和 TLSClientConfig 的 Transport 默认不会启用 HTTP/2，需要显式开启。
+	// HTTP/2 下同一 dufs 的并发请求复用一个连接，WriteBufferSize/ReadBufferSize 只对 HTTP/1.1 生效
+	protocols := new(http.Protocols)
+	switch config.HTTP2 {
+	case "force":
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	case "off":
+		protocols.SetHTTP1(true)
+	default:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	}
+	transport.Protocols = protocols
+
+	return transport
+}
+
+// dnsRetryBaseDelay 域名解析失败后第一次重试前的等待时间，之后每次翻倍
+const dnsRetryBaseDelay = 500 * time.Millisecond
+
+// dialWithDNSRetry 包装 DialContext：容器刚启动时 dufs 的域名可能暂时无法解析，
+// 解析失败时按指数退避重试，最多 maxRetries 次，持续解析失败（NXDOMAIN）时返回最后一次的错误。
+// 重试发生在建立连接阶段，请求体尚未发送，因此上传请求同样可以安全重试
+func dialWithDNSRetry(dial func(ctx context.Context, network, addr string) (net.Conn, error), maxRetries int) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		for attempt := 0; ; attempt++ {
+			conn, err := dial(ctx, network, addr)
+			var dnsErr *net.DNSError
+			if err == nil || !errors.As(err, &dnsErr) || attempt >= maxRetries {
+				return conn, err
+			}
+
+			delay := dnsRetryBaseDelay << attempt
+			log.Printf("DNS lookup for %s failed (attempt %d/%d), retrying in %s: %v", addr, attempt+1, maxRetries+1, delay, err)
+			if err := sleepContext(ctx, delay); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// buildTLSConfig 加载客户端证书和自定义 CA，未配置任何 TLS 选项时返回 nil
+func buildTLSConfig(config Config) (*tls.Config, error) {
+	if config.ClientCertFile == "" && config.ClientKeyFile == "" && config.CACertFile == "" && !config.AllowInsecure {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.AllowInsecure,
+	}
+
+	if config.ClientCertFile != "" || config.ClientKeyFile != "" {
+		if config.ClientCertFile == "" || config.ClientKeyFile == "" {
+			return nil, fmt.Errorf("DUFS_CLIENT_CERT and DUFS_CLIENT_KEY must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.CACertFile != "" {
+		pem, err := os.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in %s", config.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// buildHTTPServerTLSConfig 加载 HTTP 模式的服务端证书，配置了客户端 CA 时要求并校验客户端证书（mTLS）。
+// 未配置证书时返回 nil
+func buildHTTPServerTLSConfig(config Config) (*tls.Config, error) {
+	if config.HTTPTLSCertFile == "" && config.HTTPTLSKeyFile == "" {
+		if config.HTTPTLSClientCAFile != "" {
+			return nil, fmt.Errorf("DUFS_TLS_CLIENT_CA_FILE requires DUFS_TLS_CERT_FILE and DUFS_TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if config.HTTPTLSCertFile == "" || config.HTTPTLSKeyFile == "" {
+		return nil, fmt.Errorf("DUFS_TLS_CERT_FILE and DUFS_TLS_KEY_FILE must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.HTTPTLSCertFile, config.HTTPTLSKeyFile)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
 	}
 
-	// 添加认证
-	if c.Username != "" && c.Password != "" {
-		req.SetBasicAuth(c.Username, c.Password)
+	if config.HTTPTLSClientCAFile != "" {
+		pem, err := os.ReadFile(config.HTTPTLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in %s", config.HTTPTLSClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	}
 
-	// 添加自定义 headers
-	for k, v := range headers {
-		req.Header.Set(k, v)
+	return tlsConfig, nil
+}
+
+// proxyFunc 返回 transport 使用的代理选择函数。proxyURL 已在 loadConfig 中校验。
+// 显式配置的代理同样遵循 NO_PROXY，与环境变量代理的行为一致
+func proxyFunc(proxyURL string) func(*http.Request) (*url.URL, error) {
+	switch proxyURL {
+	case "":
+		return http.ProxyFromEnvironment
+	case "direct":
+		return nil
 	}
 
-	return c.Client.Do(req)
+	proxyConfig := httpproxy.FromEnvironment()
+	proxyConfig.HTTPProxy = proxyURL
+	proxyConfig.HTTPSProxy = proxyURL
+	resolve := proxyConfig.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return resolve(req.URL)
+	}
 }
 
-// MCPServer MCP 文件服务器
-type MCPServer struct {
-	dufsClient *DufsClient
-	tools      []MCPTool
-	config     Config
-	jobs       map[string]*UploadJob
-	jobsMutex  sync.RWMutex
+// escapeRemotePath 对远程路径的每一段做百分号编码并保留 /，空格、#、? 和非 ASCII 字符因此不会破坏 URL
+func escapeRemotePath(remotePath string) string {
+	segments := strings.Split(remotePath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
 }
 
-func NewMCPServer(config Config) *MCPServer {
-	dufsClient := NewDufsClient(config)
+// remoteURL 用 net/url 把未编码的远程路径拼接到 DufsURL 上，rawQuery 为已编码的查询串（可为空）。
+// 远程路径先在 / 下规范化，.. 不会越过 DufsURL 自带的路径前缀；DufsURL 自带的查询参数会保留并以 & 连接
+func (c *DufsClient) remoteURL(remotePath, rawQuery string) string {
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		// DUFS_URL 在启动时已校验，这里只是兜底
+		u := strings.TrimSuffix(c.BaseURL, "/") + "/" + escapeRemotePath(strings.TrimPrefix(remotePath, "/"))
+		if rawQuery != "" {
+			u += "?" + rawQuery
+		}
+		return u
+	}
 
-	tools := []MCPTool{
-		{
-			Name:        "dufs_upload",
-			Description: "上传文件到 dufs 文件服务器。默认同步上传，如果指定 async=true 则异步上传并返回 job_id。",
-			InputSchema: map[string]interface{}{
-				"type": "object",
-				"properties": map[string]interface{}{
-					"local_path": map[string]interface{}{
+	cleaned := path.Clean("/" + remotePath)
+	if strings.HasSuffix(remotePath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	// JoinPath 把参数当作已编码的路径，文件名中的 % 需要先编码
+	u := base.JoinPath(escapeRemotePath(cleaned))
+	u.RawQuery = joinQuery(base.RawQuery, rawQuery)
+	u.Fragment = ""
+	return u.String()
+}
+
+// joinQuery 用 & 连接非空的查询串片段
+func joinQuery(parts ...string) string {
+	nonEmpty := parts[:0:0]
+	for _, part := range parts {
+		if part = strings.Trim(part, "?&"); part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, "&")
+}
+
+// makeRequest 发送请求，ctx 控制整个请求（包括请求体和响应体传输）的生命周期。
+// path 为未编码的远程路径，其中的 ? 和 # 属于文件名；需要查询参数时使用 makeRequestQuery
+func (c *DufsClient) makeRequest(ctx context.Context, method, path string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	return c.makeRequestQuery(ctx, method, path, "", body, headers)
+}
+
+// makeRequestQuery 与 makeRequest 相同，额外附加已编码的查询串 rawQuery（如 json、hash、zip）
+func (c *DufsClient) makeRequestQuery(ctx context.Context, method, path, rawQuery string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.remoteURL(path, rawQuery), body)
+	if err != nil {
+		return nil, err
+	}
+
+	// 添加认证
+	if c.Username != "" && c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	// 本次工具调用指定的 language 优先于全局配置
+	language := c.AcceptLanguage
+	if override := languageFromContext(ctx); override != "" {
+		language = override
+	}
+	if language != "" {
+		req.Header.Set("Accept-Language", language)
+	}
+
+	// 添加自定义 headers
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	return c.Client.Do(req)
+}
+
+// languageKey 工具调用的 language 参数在 context 中的键
+type languageKey struct{}
+
+// withLanguage 返回携带 Accept-Language 覆盖值的 context，后台任务通过 startJob 继承
+func withLanguage(ctx context.Context, language string) context.Context {
+	return context.WithValue(ctx, languageKey{}, language)
+}
+
+func languageFromContext(ctx context.Context) string {
+	language, _ := ctx.Value(languageKey{}).(string)
+	return language
+}
+
+// serverKey 工具调用的 server 参数在 context 中的键
+type serverKey struct{}
+
+// withServer 返回选择了命名服务器的 context，后台任务通过 startJob 继承
+func withServer(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, serverKey{}, name)
+}
+
+// MCPServer MCP 文件服务器
+type MCPServer struct {
+	// dufsClient 主服务器的客户端，dufsClients 为 DUFS_SERVERS 中的命名服务器
+	dufsClient  *DufsClient
+	dufsClients map[string]*DufsClient
+	tools       []MCPTool
+	config      Config
+	jobs        map[string]*Job
+	jobsMutex   sync.RWMutex
+	// jobSeq 任务序号，由 jobsMutex 保护
+	jobSeq uint64
+	// jobKeys idempotency_key 到任务 ID 的映射，由 jobsMutex 保护
+	jobKeys map[string]string
+	// notifier 用于向客户端推送通知，由运行模式在启动时设置
+	notifier func(MCPMessage)
+	// monitor 正在运行的健康监控，没有时为 nil，由 monitorMutex 保护
+	monitor      *healthMonitor
+	monitorMutex sync.Mutex
+	// uploadDir 当前生效的默认上传目录，可通过 dufs_set_upload_dir 修改，由 uploadDirMutex 保护
+	uploadDir      string
+	uploadDirMutex sync.RWMutex
+}
+
+func NewMCPServer(config Config) *MCPServer {
+	dufsClient := NewDufsClient(config)
+	dufsClients := make(map[string]*DufsClient, len(config.Servers))
+	for name, server := range config.Servers {
+		serverConfig := config
+		serverConfig.DufsURL = server.URL
+		serverConfig.Username = server.Username
+		serverConfig.Password = server.Password
+		dufsClients[name] = NewDufsClient(serverConfig)
+	}
+
+	tools := []MCPTool{
+		{
+			Name:        "dufs_upload",
+			Description: "上传文件到 dufs 文件服务器。默认同步上传，如果指定 async=true 则异步上传并返回 job_id。",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"local_path": map[string]interface{}{
+						"type":        "string",
+						"description": "本地文件路径，与 source_command 二选一",
+					},
+					"source_command": map[string]interface{}{
 						"type":        "string",
-						"description": "本地文件路径",
+						"description": "代替 local_path 的数据来源（可选）：通过 shell 执行该命令，把标准输出边生成边上传到 remote_path（必填），例如 pg_dump mydb。命令以非零状态退出时上传失败并返回其标准错误输出。需要设置 DUFS_ALLOW_SOURCE_COMMAND=true；不能与 async、verify_size、pre_process、preserve_mtime 和 split_threshold_bytes 同时使用",
 					},
 					"remote_path": map[string]interface{}{
 						"type":        "string",
@@ -137,9 +1392,51 @@ func NewMCPServer(config Config) *MCPServer {
 						"description": "是否异步上传（可选，默认为 false，即同步上传）。如果设置为 true，则立即返回 job_id，上传在后台执行。",
 						"default":     false,
 					},
+					"verify_size": map[string]interface{}{
+						"type":        "boolean",
+						"description": "上传后通过 HEAD 请求比对远程文件大小，不一致时自动重新上传，最多重试 DUFS_MAX_RETRIES 次（可选，默认为 false）",
+						"default":     false,
+					},
+					"pre_process": map[string]interface{}{
+						"type":        "string",
+						"description": "上传前对文件做的转换（可选，默认为 none）。gzip/zstd 会先压缩文件，远程路径自动追加 .gz/.zst 扩展名，并设置 Content-Encoding",
+						"enum":        []string{"none", "gzip", "zstd"},
+						"default":     "none",
+					},
+					"label": map[string]interface{}{
+						"type":        "string",
+						"description": "异步任务的可读名称（可选，仅 async=true 时使用），可在 dufs_list_jobs 中按前缀过滤。名称已被其他任务使用时返回 label_collision: true，但仍会创建新任务",
+					},
+					"idempotency_key": map[string]interface{}{
+						"type":        "string",
+						"description": "幂等键（可选，仅异步上传时使用）。已有使用相同键的任务时直接返回该任务（replayed: true）而不会重新上传，用于安全地重试超时的调用",
+					},
+					"lock_token": map[string]interface{}{
+						"type":        "string",
+						"description": "dufs_lock 返回的锁令牌（可选），通过 WebDAV If 请求头随写入目标文件的请求（atomic 时为最后的 MOVE）提交。不能与分片上传同时使用",
+					},
+					"atomic": map[string]interface{}{
+						"type":        "boolean",
+						"description": "先上传到临时路径 <remote_path>._tmp_<时间戳>，确认大小一致后再移动（覆盖）到 remote_path，避免其他读者看到不完整的文件（可选，默认 false）。失败时删除临时文件。不能与分片上传同时使用",
+						"default":     false,
+					},
+					"follow_symlinks": map[string]interface{}{
+						"type":        "boolean",
+						"description": "local_path 是符号链接时是否上传链接指向的文件（可选，默认 true）。为 false 时拒绝上传符号链接",
+						"default":     true,
+					},
+					"preserve_mtime": map[string]interface{}{
+						"type":        "boolean",
+						"description": "通过 X-Last-Modified 请求头把本地文件的修改时间传给服务器（可选，默认 false）。同步上传时返回本地和服务器上的修改时间，mtime_preserved 表示服务器是否采用了该时间。不能与分片上传同时使用",
+						"default":     false,
+					},
+					"split_threshold_bytes": map[string]interface{}{
+						"type":        "integer",
+						"description": "分片大小（可选）。文件超过该大小时切分为 <remote_path>.part0001、.part0002 ... 依次上传，每片为该大小（最后一片可能更小），返回包含各分片路径、大小和哈希的 manifest，可用 dufs_join_parts 合并。不能与 pre_process 同时使用",
+					},
 				},
-				"required": []string{"local_path"},
 			},
+			OutputSchema: outputSchemaOf(UploadResult{}, JobStartedResult{}),
 		},
 		{
 			Name:        "dufs_upload_batch",
@@ -165,28 +1462,124 @@ func NewMCPServer(config Config) *MCPServer {
 							"required": []string{"local_path"},
 						},
 					},
+					"source_dir": map[string]interface{}{
+						"type":        "string",
+						"description": "上传整个本地目录（可选，与 files 二选一）。递归上传其中的所有普通文件，远程路径保持相对于该目录的结构",
+					},
+					"remote_dir": map[string]interface{}{
+						"type":        "string",
+						"description": "source_dir 模式下的远程目标目录（可选）。未指定时为配置的 upload_dir（默认为 uploads）/当前日期",
+					},
+					"exclude_patterns": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "source_dir 模式下排除的文件或目录（可选），glob 模式，与相对路径或名称匹配，例如 .git、*.tmp",
+					},
 					"async": map[string]interface{}{
 						"type":        "boolean",
 						"description": "是否异步上传（可选，默认为 true，即异步上传）。如果设置为 false，则同步上传所有文件。",
 						"default":     true,
 					},
+					"label": map[string]interface{}{
+						"type":        "string",
+						"description": "异步任务的可读名称（可选），可在 dufs_list_jobs 中按前缀过滤。名称已被其他任务使用时返回 label_collision: true，但仍会创建新任务",
+					},
+					"idempotency_key": map[string]interface{}{
+						"type":        "string",
+						"description": "幂等键（可选，仅异步上传时使用）。已有使用相同键的任务时直接返回该任务（replayed: true）而不会重新上传，用于安全地重试超时的调用",
+					},
+					"manifest_path": map[string]interface{}{
+						"type":        "string",
+						"description": "任务结束后写入上传清单的本地 JSON 文件路径（可选，仅异步上传时使用），记录每个文件的本地路径、远程路径、大小、sha256 和状态",
+					},
+					"deduplicate": map[string]interface{}{
+						"type":        "boolean",
+						"description": "是否合并 local_path 重复的文件（可选，默认为 true）。重复项只保留第一次出现的 remote_path。",
+						"default":     true,
+					},
+					"max_task_retries": map[string]interface{}{
+						"type":        "integer",
+						"description": "失败文件的最大重试次数（可选，默认为 0）。大于 0 时单个文件失败不会终止任务，所有文件执行完后按指数退避重试失败的文件",
+						"default":     0,
+					},
 				},
-				"required": []string{"files"},
 			},
+			OutputSchema: outputSchemaOf(UploadBatchResult{}, UploadBatchStartedResult{}),
 		},
 		{
 			Name:        "dufs_upload_status",
-			Description: "查询批量上传任务状态",
+			Description: "查询后台任务（批量上传、批量下载等）的状态",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"job_id": map[string]interface{}{
+						"type":        "string",
+						"description": "批量上传或下载任务 ID",
+					},
+				},
+				"required": []string{"job_id"},
+			},
+			OutputSchema: outputSchemaOf(JobStatusResult{}),
+		},
+		{
+			Name:        "dufs_list_jobs",
+			Description: "列出后台任务（上传、下载等）及其状态，按创建时间排序",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"type": map[string]interface{}{
+						"type":        "string",
+						"description": "按任务类型过滤（可选），例如 upload, download, plan",
+					},
+					"status": map[string]interface{}{
+						"type":        "string",
+						"description": "按任务状态过滤（可选）：pending, running, completed, failed, cancelled",
+						"enum":        []string{"pending", "running", "completed", "failed", "cancelled"},
+					},
+					"label": map[string]interface{}{
+						"type":        "string",
+						"description": "按任务 label 前缀过滤（可选）",
+					},
+				},
+			},
+			OutputSchema: outputSchemaOf(ListJobsResult{}),
+		},
+		{
+			Name:        "dufs_cancel_job",
+			Description: "取消尚未结束的后台任务。正在传输的文件会被立即中断，尚未开始的文件不再执行",
 			InputSchema: map[string]interface{}{
 				"type": "object",
 				"properties": map[string]interface{}{
 					"job_id": map[string]interface{}{
 						"type":        "string",
-						"description": "批量上传任务 ID",
+						"description": "任务 ID",
 					},
 				},
 				"required": []string{"job_id"},
 			},
+			OutputSchema: outputSchemaOf(CancelJobResult{}),
+		},
+		{
+			Name:        "dufs_job_events",
+			Description: "批量获取多个后台任务的状态变化事件（按时间排序），适合同时监控多个任务，避免逐个轮询 dufs_upload_status",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"job_ids": map[string]interface{}{
+						"type":        "array",
+						"description": "任务 ID 列表",
+						"items": map[string]interface{}{
+							"type": "string",
+						},
+					},
+					"since": map[string]interface{}{
+						"type":        "string",
+						"description": "只返回该时间之后的事件（可选，RFC3339 格式）。可以传入上一次返回的最后一个事件的 timestamp 做增量查询",
+					},
+				},
+				"required": []string{"job_ids"},
+			},
+			OutputSchema: outputSchemaOf(JobEventsResult{}),
 		},
 		{
 			Name:        "dufs_download",
@@ -200,11 +1593,102 @@ func NewMCPServer(config Config) *MCPServer {
 					},
 					"local_path": map[string]interface{}{
 						"type":        "string",
-						"description": "本地保存路径（可选）",
+						"description": "本地保存路径（可选）。是已存在的目录或以 / 结尾时保存到该目录下并使用远程文件名，目录不存在时自动创建",
+					},
+					"post_process": map[string]interface{}{
+						"type":        "string",
+						"description": "下载后的解压方式（可选，默认为 auto）。auto 根据 Content-Encoding 或 .gz/.zst 扩展名自动解压，none 原样保存；本地文件名由远程文件名生成时，只有实际解压了才去掉压缩后缀",
+						"enum":        []string{"auto", "gzip", "zstd", "none"},
+						"default":     "auto",
+					},
+					"expected_sha256": map[string]interface{}{
+						"type":        "string",
+						"description": "期望的 SHA256（可选）。对写入本地文件的内容（解压时为解压后的内容）计算哈希并比对，不一致时删除本地文件并返回错误",
+					},
+					"strip_path_components": map[string]interface{}{
+						"type":        "integer",
+						"description": "未指定 local_path 时去掉远程路径开头的 N 级目录，其余部分作为当前目录下的相对路径并保留子目录结构（可选，默认 0 表示把路径中的 / 替换为 _ 作为文件名）。例如 N=1 时 uploads/20251125/report.pdf 保存为 20251125/report.pdf，自动创建本地目录",
+						"minimum":     0,
+						"default":     0,
 					},
 				},
 				"required": []string{"remote_path"},
 			},
+			OutputSchema: outputSchemaOf(DownloadResult{}),
+		},
+		{
+			Name:        "dufs_join_parts",
+			Description: "根据 dufs_upload 分片上传的 manifest（直接传入或从服务器上的 .manifest 文件读取）下载所有分片，校验大小和哈希后合并为本地文件",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"manifest": map[string]interface{}{
+						"type":        "object",
+						"description": "dufs_upload 使用 split_threshold_bytes 时返回的 manifest，与 manifest_path 二选一",
+					},
+					"manifest_path": map[string]interface{}{
+						"type":        "string",
+						"description": "服务器上 manifest 文件的路径（<remote_path>.manifest），与 manifest 二选一",
+					},
+					"local_path": map[string]interface{}{
+						"type":        "string",
+						"description": "合并后的本地文件路径（可选，默认根据 manifest 中的 remote_path 生成）",
+					},
+				},
+			},
+			OutputSchema: outputSchemaOf(JoinPartsResult{}),
+		},
+		{
+			Name:        "dufs_download_batch",
+			Description: "批量从 dufs 文件服务器下载文件。默认异步下载并立即返回 job_id（可通过 dufs_upload_status 查询），如果指定 async=false 则同步下载并返回每个文件的结果。",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"files": map[string]interface{}{
+						"type":        "array",
+						"description": "需要下载的文件列表",
+						"items": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"remote_path": map[string]interface{}{
+									"type":        "string",
+									"description": "远程文件路径",
+								},
+								"local_path": map[string]interface{}{
+									"type":        "string",
+									"description": "本地保存路径（可选）。是已存在的目录或以 / 结尾时保存到该目录下并使用远程文件名",
+								},
+								"skip_if_exists": map[string]interface{}{
+									"type":        "boolean",
+									"description": "本地文件已存在时跳过（可选，默认取顶层 skip_if_exists）",
+								},
+								"verify_hash": map[string]interface{}{
+									"type":        "boolean",
+									"description": "下载后与服务器的 SHA256 比对（可选，默认取顶层 verify_hash）",
+								},
+							},
+							"required": []string{"remote_path"},
+						},
+					},
+					"async": map[string]interface{}{
+						"type":        "boolean",
+						"description": "是否异步下载（可选，默认为 true）。如果设置为 false，则同步下载所有文件，单个文件失败不影响其他文件。",
+						"default":     true,
+					},
+					"skip_if_exists": map[string]interface{}{
+						"type":        "boolean",
+						"description": "所有文件的默认设置：本地文件已存在时跳过（可选，默认为 false）",
+						"default":     false,
+					},
+					"verify_hash": map[string]interface{}{
+						"type":        "boolean",
+						"description": "所有文件的默认设置：下载后校验 SHA256，不一致则删除本地文件并报错（可选，默认为 false）",
+						"default":     false,
+					},
+				},
+				"required": []string{"files"},
+			},
+			OutputSchema: outputSchemaOf(DownloadBatchResult{}, JobStartedResult{}),
 		},
 		{
 			Name:        "dufs_delete",
@@ -216,9 +1700,47 @@ func NewMCPServer(config Config) *MCPServer {
 						"type":        "string",
 						"description": "要删除的文件或目录路径",
 					},
+					"recursive": map[string]interface{}{
+						"type":        "boolean",
+						"description": "删除非空目录时必须显式设置为 true（可选，默认为 false）",
+						"default":     false,
+					},
+					"expected_count": map[string]interface{}{
+						"type":        "integer",
+						"description": "预期目录中的条目数（可选）。目录实际条目数超过该值时中止删除",
+					},
+					"hard_delete": map[string]interface{}{
+						"type":        "boolean",
+						"description": "配置了 DUFS_TRASH_DIR 时跳过回收站直接删除（可选，默认为 false）",
+						"default":     false,
+					},
+					"lock_token": map[string]interface{}{
+						"type":        "string",
+						"description": "dufs_lock 返回的锁令牌（可选），通过 WebDAV If 请求头随删除（或移动到回收站）的请求提交",
+					},
 				},
 				"required": []string{"path"},
 			},
+			OutputSchema: outputSchemaOf(DeleteResult{}),
+		},
+		{
+			Name:        "dufs_restore",
+			Description: "把 dufs_delete 移动到回收站（DUFS_TRASH_DIR）的文件或目录还原到原位置",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"trash_path": map[string]interface{}{
+						"type":        "string",
+						"description": "回收站中的路径，即 dufs_delete 返回的 trash_path",
+					},
+					"remote_path": map[string]interface{}{
+						"type":        "string",
+						"description": "还原到的路径（可选，默认为删除前的原始路径）",
+					},
+				},
+				"required": []string{"trash_path"},
+			},
+			OutputSchema: outputSchemaOf(RestoreResult{}),
 		},
 		{
 			Name:        "dufs_list",
@@ -234,13 +1756,79 @@ func NewMCPServer(config Config) *MCPServer {
 						"type":        "string",
 						"description": "搜索查询（可选）",
 					},
+					"rank": map[string]interface{}{
+						"type":        "boolean",
+						"description": "按与 query 的匹配程度排序搜索结果（可选，默认 false）：名称完全一致 > 名称前缀 > 名称包含 > 其他，每个条目附带 score 和 match_span。需要指定 query，不能与 sort_by/sort_order 同时使用，只支持 json 和 simple 格式",
+					},
 					"format": map[string]interface{}{
 						"type":        "string",
-						"description": "输出格式：json, simple（可选）",
-						"enum":        []string{"json", "simple"},
+						"description": "输出格式（可选）：json 为 dufs 的完整 JSON 列表；simple 为只包含条目名称（文件和目录）的数组；raw 为 dufs simple 格式的原始文本。未指定时返回 dufs 的原始 HTML",
+						"enum":        []string{"json", "simple", "raw"},
+					},
+					"sort_by": map[string]interface{}{
+						"type":        "string",
+						"description": "排序字段（可选）：name, modified, size",
+						"enum":        []string{"name", "modified", "size"},
+					},
+					"sort_order": map[string]interface{}{
+						"type":        "string",
+						"description": "排序方向（可选）：asc, desc",
+						"enum":        []string{"asc", "desc"},
+					},
+					"newest_first": map[string]interface{}{
+						"type":        "boolean",
+						"description": "按修改时间倒序排列，最新的文件在前（可选）。相当于 sort_by=modified 且 sort_order=desc，不能与 sort_by/sort_order 同时使用",
+					},
+					"group_by": map[string]interface{}{
+						"type":        "string",
+						"description": "分组方式（可选）：extension 按小写扩展名，date 按修改日期（UTC, YYYY-MM-DD），size_tier 按 small/medium/large。设置后 data 为分组后的对象，且只能使用 json 格式",
+						"enum":        []string{"extension", "date", "size_tier"},
+					},
+					"small_max_bytes": map[string]interface{}{
+						"type":        "integer",
+						"description": "group_by=size_tier 时 small 的上限（含），默认 1048576（1 MiB）",
+					},
+					"large_min_bytes": map[string]interface{}{
+						"type":        "integer",
+						"description": "group_by=size_tier 时 large 的下限（含），默认 104857600（100 MiB）",
+					},
+					"with_hashes": map[string]interface{}{
+						"type":        "boolean",
+						"description": "为每个文件附加 sha256 字段（可选，默认 false）。会对每个文件请求一次哈希，只能使用 json 格式",
+					},
+					"modified_after": map[string]interface{}{
+						"type":        "string",
+						"description": "只返回修改时间晚于该时间的条目（可选，RFC3339 格式，如 2024-01-01T00:00:00Z），只能使用 json 格式",
+					},
+					"modified_before": map[string]interface{}{
+						"type":        "string",
+						"description": "只返回修改时间早于该时间的条目（可选，RFC3339 格式），只能使用 json 格式",
+					},
+					"name_regex": map[string]interface{}{
+						"type":        "string",
+						"description": "只返回名称匹配该正则表达式的条目（可选，RE2 语法，如 ^report_\\d{8}\\.pdf$），只支持 json 和 simple 格式。表达式无效时不过滤，并在返回中附带 regex_compile_error",
+					},
+					"min_entries": map[string]interface{}{
+						"type":        "integer",
+						"description": "至少应包含的条目数（可选，在 query、name_regex、modified_after 等过滤之后计数），不足时返回错误码 -32002，可用于检查流水线是否产出了文件。只支持 json 和 simple 格式",
+						"minimum":     1,
+					},
+					"annotate_totals": map[string]interface{}{
+						"type":        "boolean",
+						"description": "为每个目录附加递归统计的 total_size 和 file_count（可选，默认 false），类似对每一项执行 du -s。需要递归列出所有子目录，开销较大，只能使用 json 格式",
+					},
+					"totals_max_depth": map[string]interface{}{
+						"type":        "integer",
+						"description": "annotate_totals 递归的最大深度（可选，默认 10），1 表示只统计目录的直接子项。超过深度的目录不再展开，对应条目带有 totals_truncated: true",
+					},
+					"human_readable": map[string]interface{}{
+						"type":        "boolean",
+						"description": "在原始字节数旁附加可读的大小（可选，默认 false）：文件的 size 对应 size_human，annotate_totals 的 total_size 对应 total_size_human，按 SI 单位（1 KB = 1000 B）保留两位小数，例如 1.50 MB。只能使用 json 格式",
+						"default":     false,
 					},
 				},
 			},
+			OutputSchema: outputSchemaOf(ListResult{}),
 		},
 		{
 			Name:        "dufs_create_dir",
@@ -252,9 +1840,15 @@ func NewMCPServer(config Config) *MCPServer {
 						"type":        "string",
 						"description": "要创建的目录路径",
 					},
+					"parents": map[string]interface{}{
+						"type":        "boolean",
+						"description": "同时创建路径上所有不存在的上级目录，类似 mkdir -p（可选，默认 false）。为 false 时上级目录不存在会返回错误",
+						"default":     false,
+					},
 				},
 				"required": []string{"path"},
 			},
+			OutputSchema: outputSchemaOf(CreateDirResult{}),
 		},
 		{
 			Name:        "dufs_move",
@@ -270,41 +1864,381 @@ func NewMCPServer(config Config) *MCPServer {
 						"type":        "string",
 						"description": "目标路径",
 					},
+					"lock_token": map[string]interface{}{
+						"type":        "string",
+						"description": "dufs_lock 返回的锁令牌（可选），通过 WebDAV If 请求头随 MOVE 请求提交",
+					},
 				},
 				"required": []string{"source", "destination"},
 			},
+			OutputSchema: outputSchemaOf(MoveResult{}),
 		},
 		{
-			Name:        "dufs_get_hash",
-			Description: "获取文件的 SHA256 哈希值",
+			Name:        "dufs_move_tree",
+			Description: "把源目录下的所有文件按相同的相对路径移动到目标目录下（例如把 src/ 整体迁移到 dst/），自动创建目标目录结构，返回每个文件的结果。支持 dry_run 预览",
 			InputSchema: map[string]interface{}{
 				"type": "object",
 				"properties": map[string]interface{}{
-					"path": map[string]interface{}{
+					"source_dir": map[string]interface{}{
 						"type":        "string",
-						"description": "文件路径",
+						"description": "源目录",
+					},
+					"destination_dir": map[string]interface{}{
+						"type":        "string",
+						"description": "目标目录，不能位于源目录内",
+					},
+					"dry_run": map[string]interface{}{
+						"type":        "boolean",
+						"description": "只返回计划的移动，不实际执行（可选，默认 false）",
+						"default":     false,
 					},
 				},
-				"required": []string{"path"},
+				"required": []string{"source_dir", "destination_dir"},
 			},
+			OutputSchema: outputSchemaOf(MoveTreeResult{}),
 		},
 		{
-			Name:        "dufs_download_folder",
-			Description: "下载整个文件夹为 zip 文件",
+			Name:        "dufs_move_batch",
+			Description: "在一次调用中并发移动或重命名多个文件或目录，返回每个移动的结果以及成功和失败的数量",
 			InputSchema: map[string]interface{}{
 				"type": "object",
 				"properties": map[string]interface{}{
-					"remote_path": map[string]interface{}{
-						"type":        "string",
-						"description": "远程文件夹路径",
-					},
-					"local_path": map[string]interface{}{
-						"type":        "string",
-						"description": "本地保存路径（可选，默认为当前目录）",
-					},
+					"moves": map[string]interface{}{
+						"type":        "array",
+						"description": "需要执行的移动列表",
+						"items": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"source": map[string]interface{}{
+									"type":        "string",
+									"description": "源路径",
+								},
+								"destination": map[string]interface{}{
+									"type":        "string",
+									"description": "目标路径",
+								},
+							},
+							"required": []string{"source", "destination"},
+						},
+					},
+					"continue_on_error": map[string]interface{}{
+						"type":        "boolean",
+						"description": "某个移动失败后是否继续执行其余移动（可选，默认 true）。为 false 时尚未开始的移动被跳过（skipped: true）",
+						"default":     true,
+					},
+					"concurrency": map[string]interface{}{
+						"type":        "integer",
+						"description": "同时进行的移动数（可选，默认 4）",
+						"minimum":     1,
+						"default":     defaultMoveBatchConcurrency,
+					},
+					"create_parent": map[string]interface{}{
+						"type":        "boolean",
+						"description": "移动前为所有目标路径创建缺少的上级目录（可选，默认 false）",
+						"default":     false,
+					},
+				},
+				"required": []string{"moves"},
+			},
+			OutputSchema: outputSchemaOf(MoveBatchResult{}),
+		},
+		{
+			Name:        "dufs_exec_plan",
+			Description: "按顺序执行一组不同类型的文件操作（mkdir、upload、move、delete），每个步骤交给对应的工具处理，返回按步骤顺序排列的结果。默认遇到失败即停止，也可以继续执行其余步骤；async=true 时在后台执行并返回 job_id",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"steps": map[string]interface{}{
+						"type":        "array",
+						"description": "按顺序执行的步骤列表",
+						"items": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"type": map[string]interface{}{
+									"type":        "string",
+									"description": "步骤类型：mkdir 对应 dufs_create_dir，upload 对应 dufs_upload，move 对应 dufs_move，delete 对应 dufs_delete",
+									"enum":        planStepTypes,
+								},
+								"arguments": map[string]interface{}{
+									"type":        "object",
+									"description": "步骤的参数，与对应工具的参数相同。upload 步骤不能使用 async",
+								},
+							},
+							"required": []string{"type", "arguments"},
+						},
+					},
+					"stop_on_error": map[string]interface{}{
+						"type":        "boolean",
+						"description": "某个步骤失败后是否停止（可选，默认 true）。为 true 时其后的步骤不再执行（同步执行时 status 为 skipped），为 false 时继续执行其余步骤",
+						"default":     true,
+					},
+					"async": map[string]interface{}{
+						"type":        "boolean",
+						"description": "是否在后台执行（可选，默认 false）。为 true 时立即返回 job_id，每个步骤为任务中的一项，可通过 dufs_upload_status 查询",
+						"default":     false,
+					},
+					"label": map[string]interface{}{
+						"type":        "string",
+						"description": "异步任务的可读名称（可选，仅 async=true 时使用）",
+					},
+				},
+				"required": []string{"steps"},
+			},
+			OutputSchema: outputSchemaOf(ExecPlanResult{}, JobStartedResult{}),
+		},
+		{
+			Name:        "dufs_lock",
+			Description: "通过 WebDAV LOCK 对 dufs 上的路径加排他写锁，返回锁令牌。用于多个客户端写同一路径时的协调，写入时在 dufs_upload、dufs_move、dufs_delete 中通过 lock_token 提交令牌，完成后用 dufs_unlock 释放",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "要加锁的文件或目录路径",
+					},
+					"timeout_seconds": map[string]interface{}{
+						"type":        "integer",
+						"description": "锁的超时时间（秒，可选，默认 600），超时后服务器自动释放",
+						"minimum":     1,
+						"default":     defaultLockTimeoutSeconds,
+					},
+					"owner": map[string]interface{}{
+						"type":        "string",
+						"description": "锁的持有者说明（可选，默认 dufs-mcp-server），写入 LOCK 请求的 owner 字段",
+					},
+				},
+				"required": []string{"path"},
+			},
+			OutputSchema: outputSchemaOf(LockResult{}),
+		},
+		{
+			Name:        "dufs_unlock",
+			Description: "通过 WebDAV UNLOCK 释放 dufs_lock 获得的锁",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "加锁时使用的路径",
+					},
+					"lock_token": map[string]interface{}{
+						"type":        "string",
+						"description": "dufs_lock 返回的锁令牌",
+					},
+				},
+				"required": []string{"path", "lock_token"},
+			},
+			OutputSchema: outputSchemaOf(UnlockResult{}),
+		},
+		{
+			Name:        "dufs_get_hash",
+			Description: "获取文件的 SHA256 哈希值",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "文件路径",
+					},
+				},
+				"required": []string{"path"},
+			},
+			OutputSchema: outputSchemaOf(HashResult{}),
+		},
+		{
+			Name:        "dufs_get_multiple_hashes",
+			Description: "批量获取多个文件的 SHA256 哈希值，可传入期望的哈希值校验清单",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"paths": map[string]interface{}{
+						"type":        "array",
+						"description": "文件路径列表",
+						"items": map[string]interface{}{
+							"type": "string",
+						},
+					},
+					"expected": map[string]interface{}{
+						"type":        "object",
+						"description": "期望的哈希值（可选），键为文件路径，值为 SHA256。传入后每个路径返回 match 表示是否一致",
+						"additionalProperties": map[string]interface{}{
+							"type": "string",
+						},
+					},
+					"concurrency": map[string]interface{}{
+						"type":        "integer",
+						"description": "并发请求数（可选，默认为 DUFS_UPLOAD_CONCURRENCY）",
+					},
+				},
+				"required": []string{"paths"},
+			},
+			OutputSchema: outputSchemaOf(MultipleHashesResult{}),
+		},
+		{
+			Name:        "dufs_preview",
+			Description: "预览文件开头的一部分内容（默认 4 KB），自动判断文本或二进制，二进制内容以 base64 返回，同时返回内容类型和文件总大小",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "文件路径",
+					},
+					"bytes": map[string]interface{}{
+						"type":        "integer",
+						"description": "预览的字节数（可选，默认 4096，不超过 DUFS_MAX_READ_SIZE）",
+						"default":     defaultPreviewBytes,
+					},
+				},
+				"required": []string{"path"},
+			},
+			OutputSchema: outputSchemaOf(PreviewResult{}),
+		},
+		{
+			Name:        "dufs_download_folder",
+			Description: "下载整个文件夹为 zip 文件",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"remote_path": map[string]interface{}{
+						"type":        "string",
+						"description": "远程文件夹路径",
+					},
+					"local_path": map[string]interface{}{
+						"type":        "string",
+						"description": "本地保存路径（可选，默认为当前目录）",
+					},
+					"show_progress": map[string]interface{}{
+						"type":        "boolean",
+						"description": "是否跟踪下载进度（可选，默认为 false）。设置为 true 时立即返回 job_id，下载在后台执行，可通过 dufs_download_status 查询已下载字节数",
+						"default":     false,
+					},
+					"include": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "只下载匹配的文件（可选），glob 模式，与相对路径或文件名匹配，例如 *.go、docs/*.md。指定 include 或 exclude 时改为逐个下载文件到 local_path 目录，而不是下载 zip",
+					},
+					"exclude": map[string]interface{}{
+						"type":        "array",
+						"items":       map[string]interface{}{"type": "string"},
+						"description": "排除匹配的文件或目录（可选），glob 模式，与相对路径或名称匹配，例如 node_modules、*.tmp。被排除的目录不会继续展开",
+					},
+					"client_zip": map[string]interface{}{
+						"type":        "boolean",
+						"description": "在本地组装 zip（可选，默认 false）：递归列出文件夹并逐个下载文件，以流的方式写入本地 zip，不依赖服务器的 ?zip。可与 include/exclude 同时使用，不支持 show_progress",
+						"default":     false,
+					},
+					"compression_level": map[string]interface{}{
+						"type":        "integer",
+						"description": "client_zip 的压缩级别（可选，默认 -1 即 deflate 默认级别）。0 表示只存储不压缩，1 最快，9 压缩率最高",
+						"minimum":     -1,
+						"maximum":     9,
+					},
 				},
 				"required": []string{"remote_path"},
 			},
+			OutputSchema: outputSchemaOf(DownloadResult{}, FolderDownloadStartedResult{}, FilteredFolderDownloadResult{}, ClientZipResult{}),
+		},
+		{
+			Name:        "dufs_download_status",
+			Description: "查询后台下载任务（dufs_download_batch、dufs_download_folder 的 show_progress 模式）的状态和字节级进度",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"job_id": map[string]interface{}{
+						"type":        "string",
+						"description": "下载任务 ID",
+					},
+				},
+				"required": []string{"job_id"},
+			},
+			OutputSchema: outputSchemaOf(DownloadStatusResult{}),
+		},
+		{
+			Name:        "dufs_set_content_type",
+			Description: "修改文件的 MIME 类型。dufs 在上传时确定 Content-Type，因此会把文件读回后带新的 Content-Type 重新上传，仅适用于不超过 DUFS_MAX_READ_SIZE 的文件",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "文件路径",
+					},
+					"content_type": map[string]interface{}{
+						"type":        "string",
+						"description": "新的 MIME 类型，例如 application/json",
+					},
+				},
+				"required": []string{"path", "content_type"},
+			},
+			OutputSchema: outputSchemaOf(SetContentTypeResult{}),
+		},
+		{
+			Name:        "dufs_diff",
+			Description: "比较本地目录与远程目录的差异（不传输文件），返回仅本地存在、仅远程存在以及内容不同的文件列表和各自的总字节数",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"local_dir": map[string]interface{}{
+						"type":        "string",
+						"description": "本地目录路径",
+					},
+					"remote_dir": map[string]interface{}{
+						"type":        "string",
+						"description": "远程目录路径",
+					},
+				},
+				"required": []string{"local_dir", "remote_dir"},
+			},
+			OutputSchema: outputSchemaOf(DiffResult{}),
+		},
+		{
+			Name:        "dufs_list_diff",
+			Description: "比较 dufs 上两个远程目录的差异（递归），返回仅在 A、仅在 B 以及两边都存在的文件，可选按哈希比较两边都存在的文件",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path_a": map[string]interface{}{
+						"type":        "string",
+						"description": "远程目录 A",
+					},
+					"path_b": map[string]interface{}{
+						"type":        "string",
+						"description": "远程目录 B",
+					},
+					"compare_hashes": map[string]interface{}{
+						"type":        "boolean",
+						"description": "是否获取两边都存在的文件的哈希并分为 identical 和 different（可选，默认 false）",
+					},
+				},
+				"required": []string{"path_a", "path_b"},
+			},
+			OutputSchema: outputSchemaOf(ListDiffResult{}),
+		},
+		{
+			Name:        "dufs_diff_snapshot",
+			Description: "与上次保存的目录列表快照比较，返回新增、删除和修改（大小或修改时间变化）的条目，并把当前列表保存为新的快照。首次调用只建立基准。快照按服务器和路径保存在本地 DUFS_SNAPSHOT_DIR 中，用于轮询式的变化检测",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{
+						"type":        "string",
+						"description": "远程目录路径",
+					},
+					"recursive": map[string]interface{}{
+						"type":        "boolean",
+						"description": "是否递归比较子目录中的所有文件（可选，默认 false，只比较直接子项，包括目录）。递归与非递归的快照分别保存",
+						"default":     false,
+					},
+					"update": map[string]interface{}{
+						"type":        "boolean",
+						"description": "比较后是否把当前列表保存为新的快照（可选，默认 true）。为 false 时下次仍与同一个旧快照比较",
+						"default":     true,
+					},
+				},
+				"required": []string{"path"},
+			},
+			OutputSchema: outputSchemaOf(SnapshotDiffResult{}),
 		},
 		{
 			Name:        "dufs_health",
@@ -313,795 +2247,6957 @@ func NewMCPServer(config Config) *MCPServer {
 				"type":       "object",
 				"properties": map[string]interface{}{},
 			},
+			OutputSchema: outputSchemaOf(HealthResult{}),
+		},
+		{
+			Name:        "dufs_start_monitoring",
+			Description: "启动后台健康监控：按固定间隔检查 dufs 健康状态，连续失败达到 max_failures 时向 callback_url POST JSON 告警，恢复后再发送一次 recovered 告警。同一时间只能运行一个监控",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"interval_seconds": map[string]interface{}{
+						"type":        "integer",
+						"description": "检查间隔秒数（可选，默认 30）",
+						"default":     defaultMonitorInterval,
+						"minimum":     1,
+					},
+					"max_failures": map[string]interface{}{
+						"type":        "integer",
+						"description": "连续失败多少次后发送告警（可选，默认 3）",
+						"default":     defaultMonitorMaxFailures,
+						"minimum":     1,
+					},
+					"callback_url": map[string]interface{}{
+						"type":        "string",
+						"description": "接收告警的 http/https 地址（可选），不设置时只记录状态，可通过 dufs_monitoring_status 查询",
+					},
+				},
+			},
+			OutputSchema: outputSchemaOf(MonitoringStatusResult{}),
+		},
+		{
+			Name:        "dufs_stop_monitoring",
+			Description: "停止正在运行的后台健康监控，返回停止前的最终状态",
+			InputSchema: map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{},
+			},
+			OutputSchema: outputSchemaOf(MonitoringStatusResult{}),
+		},
+		{
+			Name:        "dufs_monitoring_status",
+			Description: "查询后台健康监控的状态：是否运行、检查次数、连续失败次数、最近一次检查结果和已发送的告警数",
+			InputSchema: map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{},
+			},
+			OutputSchema: outputSchemaOf(MonitoringStatusResult{}),
+		},
+		{
+			Name:        "dufs_test_proxy",
+			Description: "检查访问 dufs 时是否经过代理：返回当前的代理配置、访问 DUFS_URL 实际使用的代理以及连接的远端地址",
+			InputSchema: map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{},
+			},
+			OutputSchema: outputSchemaOf(ProxyTestResult{}),
+		},
+		{
+			Name:        "dufs_info",
+			Description: "返回本服务实际生效的配置（dufs 地址、是否配置认证、上传目录、超时、工具列表等），用于排查部署问题。密码和令牌只报告是否设置，不返回内容",
+			InputSchema: map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{},
+			},
+			OutputSchema: outputSchemaOf(InfoResult{}),
+		},
+		{
+			Name:        "dufs_set_upload_dir",
+			Description: "查看或修改本次运行中未指定 remote_path 时上传使用的默认目录（DUFS_UPLOAD_DIR），修改对之后的上传立即生效，重启后恢复为配置值。不传 upload_dir 时只返回当前值",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"upload_dir": map[string]interface{}{
+						"type":        "string",
+						"description": "新的默认上传目录（可选），如 projects/demo。配置了 DUFS_UPLOAD_DIR_ROOT 时必须位于该目录之内",
+					},
+					"reset": map[string]interface{}{
+						"type":        "boolean",
+						"description": "恢复为启动时配置的 DUFS_UPLOAD_DIR（可选，默认 false），不能与 upload_dir 同时使用",
+						"default":     false,
+					},
+				},
+			},
+			OutputSchema: outputSchemaOf(UploadDirResult{}),
 		},
 	}
 
-	return &MCPServer{
-		dufsClient: dufsClient,
-		tools:      tools,
-		config:     config,
-		jobs:       make(map[string]*UploadJob),
+	addLanguageArg(tools)
+	addServerArg(tools, config.Servers)
+
+	return &MCPServer{
+		dufsClient:  dufsClient,
+		dufsClients: dufsClients,
+		tools:       tools,
+		config:      config,
+		jobs:        make(map[string]*Job),
+		jobKeys:     make(map[string]string),
+		uploadDir:   strings.Trim(config.UploadDir, "/"),
+	}
+}
+
+// client 返回本次工具调用选择的 dufs 客户端，未通过 server 参数选择时为主服务器
+func (s *MCPServer) client(ctx context.Context) *DufsClient {
+	if name, _ := ctx.Value(serverKey{}).(string); name != "" {
+		if client, ok := s.dufsClients[name]; ok {
+			return client
+		}
+	}
+	return s.dufsClient
+}
+
+// toolsWithoutPathArgs 不接受路径参数的工具，不提供 language 参数
+var toolsWithoutPathArgs = map[string]bool{
+	"dufs_upload_status":     true,
+	"dufs_list_jobs":         true,
+	"dufs_cancel_job":        true,
+	"dufs_job_events":        true,
+	"dufs_download_status":   true,
+	"dufs_health":            true,
+	"dufs_test_proxy":        true,
+	"dufs_info":              true,
+	"dufs_set_upload_dir":    true,
+	"dufs_start_monitoring":  true,
+	"dufs_stop_monitoring":   true,
+	"dufs_monitoring_status": true,
+}
+
+// addLanguageArg 为带路径参数的工具增加 language 参数，用于覆盖本次调用的 Accept-Language
+func addLanguageArg(tools []MCPTool) {
+	for _, tool := range tools {
+		if toolsWithoutPathArgs[tool.Name] {
+			continue
+		}
+		properties, ok := tool.InputSchema["properties"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		properties["language"] = map[string]interface{}{
+			"type":        "string",
+			"description": "本次调用发送给 dufs 的 Accept-Language（可选，如 en-US），覆盖 DUFS_ACCEPT_LANGUAGE",
+		}
+	}
+}
+
+// localOnlyTools 只查询本服务内部状态、不访问 dufs 的工具，不提供 server 参数
+var localOnlyTools = map[string]bool{
+	"dufs_upload_status":     true,
+	"dufs_list_jobs":         true,
+	"dufs_cancel_job":        true,
+	"dufs_job_events":        true,
+	"dufs_download_status":   true,
+	"dufs_info":              true,
+	"dufs_set_upload_dir":    true,
+	"dufs_stop_monitoring":   true,
+	"dufs_monitoring_status": true,
+}
+
+// addServerArg 配置了命名服务器时，为访问 dufs 的工具增加 server 参数
+func addServerArg(tools []MCPTool, servers map[string]ServerConfig) {
+	if len(servers) == 0 {
+		return
+	}
+
+	names := []string{defaultServerName}
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+
+	for _, tool := range tools {
+		if localOnlyTools[tool.Name] {
+			continue
+		}
+		properties, ok := tool.InputSchema["properties"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		properties["server"] = map[string]interface{}{
+			"type":        "string",
+			"description": "使用的 dufs 服务器（可选，默认为 DUFS_URL 对应的主服务器 default）",
+			"enum":        names,
+		}
+	}
+}
+
+// sendNotification 向客户端推送 JSON-RPC 通知（没有 ID 的消息）
+func (s *MCPServer) sendNotification(method string, params interface{}) {
+	if s.notifier == nil {
+		return
+	}
+
+	raw, err := json.Marshal(params)
+	if err != nil {
+		log.Printf("Failed to marshal notification %s: %v", method, err)
+		return
+	}
+
+	s.notifier(MCPMessage{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  raw,
+	})
+}
+
+// notifyJobFinished 启用 DUFS_NOTIFY_JOB_COMPLETION 时，在任务完成或失败后发送 notifications/message，
+// 客户端无需轮询即可得知任务结束
+func (s *MCPServer) notifyJobFinished(job *Job) {
+	if !s.config.NotifyJobCompletion {
+		return
+	}
+
+	s.jobsMutex.RLock()
+	status := job.Status
+	data := map[string]interface{}{
+		"job_id":          job.ID,
+		"status":          job.Status,
+		"task_count":      len(job.Tasks),
+		"elapsed_seconds": math.Round(job.CompletedAt.Sub(job.CreatedAt).Seconds()*1000) / 1000,
+	}
+	if job.Error != "" {
+		data["error"] = job.Error
+	}
+	s.jobsMutex.RUnlock()
+
+	level := "info"
+	switch status {
+	case "completed":
+	case "failed":
+		level = "error"
+	default:
+		// 被取消的任务不通知
+		return
+	}
+
+	s.sendNotification("notifications/message", map[string]interface{}{
+		"level":  level,
+		"logger": "dufs-mcp-server",
+		"data":   data,
+	})
+}
+
+func (s *MCPServer) handleInitialize(params json.RawMessage) (interface{}, error) {
+	return map[string]interface{}{
+		"protocolVersion": "2024-11-05",
+		"capabilities": map[string]interface{}{
+			"tools": map[string]interface{}{},
+			// 资源只通过 resources/templates/list 中的模板访问，resources/list 为空
+			"resources": map[string]interface{}{},
+		},
+		"serverInfo": map[string]interface{}{
+			"name":    "dufs-mcp-server",
+			"version": "1.0.0",
+		},
+	}, nil
+}
+
+// ResourceTemplate MCP 资源模板，uriTemplate 遵循 RFC 6570
+type ResourceTemplate struct {
+	URITemplate string `json:"uriTemplate"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	MimeType    string `json:"mimeType,omitempty"`
+}
+
+// ResourceContent resources/read 返回的一项内容，文本放在 Text 中，二进制内容经 base64 编码后放在 Blob 中
+type ResourceContent struct {
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Blob     string `json:"blob,omitempty"`
+}
+
+// 资源 URI 的前缀，其后为远程路径（可以百分号编码）
+const (
+	resourceFilesPrefix    = "dufs://files/"
+	resourceListingsPrefix = "dufs://listings/"
+	resourceHashesPrefix   = "dufs://hashes/"
+)
+
+// resourceTemplates resources/templates/list 返回的模板，{+path} 允许路径中包含 /
+var resourceTemplates = []ResourceTemplate{
+	{
+		URITemplate: resourceFilesPrefix + "{+path}",
+		Name:        "dufs 文件内容",
+		Description: "dufs 上文件的内容，文本文件以 text 返回，其他文件以 base64 blob 返回，大小不超过 DUFS_MAX_READ_SIZE",
+	},
+	{
+		URITemplate: resourceListingsPrefix + "{+path}",
+		Name:        "dufs 目录列表",
+		Description: "dufs 上目录的直接子项（JSON 数组，包含 name、path_type、mtime、size）",
+		MimeType:    "application/json",
+	},
+	{
+		URITemplate: resourceHashesPrefix + "{+path}",
+		Name:        "dufs 文件哈希",
+		Description: "dufs 上文件的 SHA256 哈希（十六进制文本）",
+		MimeType:    "text/plain",
+	},
+}
+
+// resourceRemotePath 从资源 URI 中取出解码后的远程路径
+func resourceRemotePath(uri, prefix string) (string, error) {
+	remotePath, err := url.PathUnescape(strings.TrimPrefix(uri, prefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid resource uri %s: %v", uri, err)
+	}
+	return "/" + strings.TrimPrefix(remotePath, "/"), nil
+}
+
+func (s *MCPServer) handleResourcesRead(params json.RawMessage) (interface{}, error) {
+	var readParams struct {
+		URI string `json:"uri"`
+	}
+	if err := json.Unmarshal(params, &readParams); err != nil {
+		return nil, fmt.Errorf("invalid parameters: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultToolTimeout)
+	defer cancel()
+
+	uri := readParams.URI
+	content := ResourceContent{URI: uri}
+	switch {
+	case strings.HasPrefix(uri, resourceFilesPrefix):
+		remotePath, err := resourceRemotePath(uri, resourceFilesPrefix)
+		if err != nil {
+			return nil, err
+		}
+		data, err := s.readRemoteFile(ctx, remotePath)
+		if err != nil {
+			return nil, err
+		}
+		content.MimeType = mime.TypeByExtension(path.Ext(remotePath))
+		if utf8.Valid(data) {
+			if content.MimeType == "" {
+				content.MimeType = "text/plain"
+			}
+			content.Text = string(data)
+		} else {
+			if content.MimeType == "" {
+				content.MimeType = "application/octet-stream"
+			}
+			content.Blob = base64.StdEncoding.EncodeToString(data)
+		}
+	case strings.HasPrefix(uri, resourceListingsPrefix):
+		remotePath, err := resourceRemotePath(uri, resourceListingsPrefix)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := s.listRemoteDir(ctx, remotePath)
+		if err != nil {
+			return nil, err
+		}
+		if entries == nil {
+			entries = []dufsEntry{}
+		}
+		data, err := json.Marshal(entries)
+		if err != nil {
+			return nil, err
+		}
+		content.MimeType = "application/json"
+		content.Text = string(data)
+	case strings.HasPrefix(uri, resourceHashesPrefix):
+		remotePath, err := resourceRemotePath(uri, resourceHashesPrefix)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := s.fetchRemoteHash(ctx, remotePath)
+		if err != nil {
+			return nil, err
+		}
+		content.MimeType = "text/plain"
+		content.Text = hash
+	default:
+		return nil, &rpcError{
+			Code:    errCodeNotFound,
+			Message: fmt.Sprintf("unknown resource uri: %s", uri),
+		}
+	}
+
+	return map[string]interface{}{
+		"contents": []ResourceContent{content},
+	}, nil
+}
+
+// toolsPageSize tools/list 每页返回的工具数量
+const toolsPageSize = 5
+
+func (s *MCPServer) handleToolsList(params json.RawMessage) (interface{}, error) {
+	var listParams struct {
+		Cursor string `json:"cursor"`
+	}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &listParams); err != nil {
+			return nil, fmt.Errorf("invalid parameters: %v", err)
+		}
+	}
+
+	// cursor 是下一页起始位置的偏移量，对客户端来说是不透明的字符串
+	offset := 0
+	if listParams.Cursor != "" {
+		n, err := strconv.Atoi(listParams.Cursor)
+		if err != nil || n < 0 || n > len(s.tools) {
+			return nil, fmt.Errorf("invalid cursor: %s", listParams.Cursor)
+		}
+		offset = n
+	}
+
+	end := offset + toolsPageSize
+	if end > len(s.tools) {
+		end = len(s.tools)
+	}
+
+	result := map[string]interface{}{
+		"tools": s.tools[offset:end],
+	}
+	if end < len(s.tools) {
+		result["nextCursor"] = strconv.Itoa(end)
+	}
+
+	return result, nil
+}
+
+func (s *MCPServer) handleToolsCall(params json.RawMessage) (response interface{}, callErr error) {
+	var callParams struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+	}
+	if err := json.Unmarshal(params, &callParams); err != nil {
+		return nil, fmt.Errorf("invalid parameters: %v", err)
+	}
+
+	// 工具处理函数中的 panic 不应导致整个服务退出
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic in tool %s: %v\n%s", callParams.Name, r, debug.Stack())
+			response = nil
+			callErr = &rpcError{
+				Code:    errCodeInternal,
+				Message: fmt.Sprintf("internal error while executing tool %s", callParams.Name),
+			}
+		}
+	}()
+
+	// 每个工具调用都有自己的超时，快速操作尽早失败，传输类操作给予更长的时间
+	timeout := s.toolTimeout(callParams.Name)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if language, ok := callParams.Arguments["language"].(string); ok && language != "" {
+		ctx = withLanguage(ctx, language)
+	}
+	if server, ok := callParams.Arguments["server"].(string); ok && server != "" && server != defaultServerName {
+		if _, exists := s.dufsClients[server]; !exists {
+			return toolErrorResult(fmt.Errorf("unknown server: %s", server)), nil
+		}
+		ctx = withServer(ctx, server)
+	}
+
+	var result interface{}
+	var err error
+
+	switch callParams.Name {
+	case "dufs_upload":
+		result, err = s.handleUpload(ctx, callParams.Arguments)
+	case "dufs_upload_batch":
+		result, err = s.handleUploadBatch(ctx, callParams.Arguments)
+	case "dufs_upload_status":
+		result, err = s.handleUploadStatus(ctx, callParams.Arguments)
+	case "dufs_list_jobs":
+		result, err = s.handleListJobs(ctx, callParams.Arguments)
+	case "dufs_cancel_job":
+		result, err = s.handleCancelJob(ctx, callParams.Arguments)
+	case "dufs_job_events":
+		result, err = s.handleJobEvents(ctx, callParams.Arguments)
+	case "dufs_download":
+		result, err = s.handleDownload(ctx, callParams.Arguments)
+	case "dufs_join_parts":
+		result, err = s.handleJoinParts(ctx, callParams.Arguments)
+	case "dufs_download_batch":
+		result, err = s.handleDownloadBatch(ctx, callParams.Arguments)
+	case "dufs_delete":
+		result, err = s.handleDelete(ctx, callParams.Arguments)
+	case "dufs_restore":
+		result, err = s.handleRestore(ctx, callParams.Arguments)
+	case "dufs_list":
+		result, err = s.handleList(ctx, callParams.Arguments)
+	case "dufs_create_dir":
+		result, err = s.handleCreateDir(ctx, callParams.Arguments)
+	case "dufs_move":
+		result, err = s.handleMove(ctx, callParams.Arguments)
+	case "dufs_move_tree":
+		result, err = s.handleMoveTree(ctx, callParams.Arguments)
+	case "dufs_move_batch":
+		result, err = s.handleMoveBatch(ctx, callParams.Arguments)
+	case "dufs_exec_plan":
+		result, err = s.handleExecPlan(ctx, callParams.Arguments)
+	case "dufs_lock":
+		result, err = s.handleLock(ctx, callParams.Arguments)
+	case "dufs_unlock":
+		result, err = s.handleUnlock(ctx, callParams.Arguments)
+	case "dufs_get_hash":
+		result, err = s.handleGetHash(ctx, callParams.Arguments)
+	case "dufs_get_multiple_hashes":
+		result, err = s.handleGetMultipleHashes(ctx, callParams.Arguments)
+	case "dufs_preview":
+		result, err = s.handlePreview(ctx, callParams.Arguments)
+	case "dufs_download_folder":
+		result, err = s.handleDownloadFolder(ctx, callParams.Arguments)
+	case "dufs_download_status":
+		result, err = s.handleDownloadStatus(ctx, callParams.Arguments)
+	case "dufs_diff":
+		result, err = s.handleDiff(ctx, callParams.Arguments)
+	case "dufs_list_diff":
+		result, err = s.handleListDiff(ctx, callParams.Arguments)
+	case "dufs_diff_snapshot":
+		result, err = s.handleDiffSnapshot(ctx, callParams.Arguments)
+	case "dufs_health":
+		result, err = s.handleHealth(ctx, callParams.Arguments)
+	case "dufs_start_monitoring":
+		result, err = s.handleStartMonitoring(ctx, callParams.Arguments)
+	case "dufs_stop_monitoring":
+		result, err = s.handleStopMonitoring(ctx, callParams.Arguments)
+	case "dufs_monitoring_status":
+		result, err = s.handleMonitoringStatus(ctx, callParams.Arguments)
+	case "dufs_test_proxy":
+		result, err = s.handleTestProxy(ctx, callParams.Arguments)
+	case "dufs_set_upload_dir":
+		result, err = s.handleSetUploadDir(ctx, callParams.Arguments)
+	case "dufs_info":
+		result, err = s.handleInfo(ctx, callParams.Arguments)
+	case "dufs_set_content_type":
+		result, err = s.handleSetContentType(ctx, callParams.Arguments)
+	default:
+		return nil, fmt.Errorf("unknown tool: %s", callParams.Name)
+	}
+
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("tool %s timed out after %s: %w", callParams.Name, timeout, err)
+		}
+		return toolErrorResult(err), nil
+	}
+
+	// 根据 MCP 协议，tools/call 的返回格式应该是包含 content 数组的对象。
+	// 同时通过 structuredContent 返回同一个结果对象，新版客户端可以直接使用而不必解析 text
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal result: %v", err)
+	}
+
+	// 结果中 success 为 false（例如批量操作中有文件失败）时标记为 isError
+	var outcome struct {
+		Success *bool `json:"success"`
+	}
+	_ = json.Unmarshal(resultJSON, &outcome)
+	isError := outcome.Success != nil && !*outcome.Success
+
+	return map[string]interface{}{
+		"content": []map[string]interface{}{
+			{
+				"type": "text",
+				"text": string(resultJSON),
+			},
+		},
+		"structuredContent": json.RawMessage(resultJSON),
+		"isError":           isError,
+	}, nil
+}
+
+// ToolErrorResult 工具执行失败时 structuredContent 中的内容，Code 仅在错误带有自定义错误码时返回
+type ToolErrorResult struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+	Code    int    `json:"code,omitempty"`
+}
+
+// toolErrorResult 把工具执行失败包装为 isError 为 true 的结果。按照 MCP 约定，
+// 工具本身的失败（文件不存在、dufs 返回错误等）作为结果返回，JSON-RPC 错误只用于协议层面的问题
+func toolErrorResult(err error) map[string]interface{} {
+	result := ToolErrorResult{Error: err.Error()}
+	var coded *rpcError
+	if errors.As(err, &coded) {
+		result.Code = coded.Code
+	}
+
+	return map[string]interface{}{
+		"content": []map[string]interface{}{
+			{
+				"type": "text",
+				"text": err.Error(),
+			},
+		},
+		"structuredContent": result,
+		"isError":           true,
+	}
+}
+
+// defaultToolTimeout 未单独配置的工具使用的超时
+const defaultToolTimeout = time.Minute
+
+// defaultToolTimeouts 各工具的默认超时，键为去掉 dufs_ 前缀的工具名
+var defaultToolTimeouts = map[string]time.Duration{
+	"health":           5 * time.Second,
+	"upload":           30 * time.Minute,
+	"upload_batch":     30 * time.Minute,
+	"download":         30 * time.Minute,
+	"download_batch":   30 * time.Minute,
+	"download_folder":  30 * time.Minute,
+	"join_parts":       30 * time.Minute,
+	"diff":             30 * time.Minute,
+	"list_diff":        30 * time.Minute,
+	"diff_snapshot":    30 * time.Minute,
+	"move_tree":        30 * time.Minute,
+	"move_batch":       30 * time.Minute,
+	"exec_plan":        30 * time.Minute,
+	"set_content_type": 5 * time.Minute,
+}
+
+// toolTimeout 返回工具的超时时间，DUFS_TOOL_TIMEOUTS 中的配置优先
+func (s *MCPServer) toolTimeout(toolName string) time.Duration {
+	key := strings.TrimPrefix(toolName, "dufs_")
+	if d, ok := s.config.ToolTimeouts[key]; ok {
+		return d
+	}
+	if d, ok := defaultToolTimeouts[key]; ok {
+		return d
+	}
+	return defaultToolTimeout
+}
+
+// parseToolTimeouts 解析 "health=5s,upload=10m" 格式的工具超时配置
+func parseToolTimeouts(value string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	for _, item := range splitList(value) {
+		name, durationText, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected name=duration, got %q", item)
+		}
+		d, err := parseDurationEnv(strings.TrimSpace(durationText))
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout for %s: %v", name, err)
+		}
+		if d == 0 {
+			return nil, fmt.Errorf("timeout for %s must be positive", name)
+		}
+		timeouts[strings.TrimPrefix(strings.TrimSpace(name), "dufs_")] = d
+	}
+	return timeouts, nil
+}
+
+func (s *MCPServer) resolveRemotePath(localPath, remotePath string) string {
+	if remotePath != "" {
+		return strings.TrimPrefix(remotePath, "/")
+	}
+
+	fileName := filepath.Base(localPath)
+	now := time.Now()
+	dateDir := now.Format("20060102")
+
+	baseDir := s.currentUploadDir()
+	if baseDir == "" {
+		baseDir = "uploads"
+	}
+
+	return fmt.Sprintf("%s/%s/%s", baseDir, dateDir, fileName)
+}
+
+// currentUploadDir 返回当前生效的默认上传目录（不带首尾的 /），为空时使用 uploads
+func (s *MCPServer) currentUploadDir() string {
+	s.uploadDirMutex.RLock()
+	defer s.uploadDirMutex.RUnlock()
+	return s.uploadDir
+}
+
+// normalizeUploadDir 校验并规范化上传目录：不允许 .. 和控制字符，配置了 root 时必须位于 root 之内
+func normalizeUploadDir(dir, root string) (string, error) {
+	for _, segment := range strings.Split(dir, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("upload_dir must not contain '..': %s", dir)
+		}
+	}
+	if strings.ContainsFunc(dir, func(r rune) bool { return r < 0x20 || r == 0x7f || r == '\\' }) {
+		return "", fmt.Errorf("upload_dir contains invalid characters: %q", dir)
+	}
+
+	cleaned := strings.Trim(path.Clean("/"+strings.TrimSpace(dir)), "/")
+	if cleaned == "" {
+		return "", fmt.Errorf("upload_dir must not be empty")
+	}
+	if root = strings.Trim(root, "/"); root != "" && cleaned != root && !strings.HasPrefix(cleaned, root+"/") {
+		return "", fmt.Errorf("upload_dir %s is outside DUFS_UPLOAD_DIR_ROOT %s", cleaned, root)
+	}
+	return cleaned, nil
+}
+
+// ensureRemoteDirectories 创建远程文件路径的所有上级目录，位于根目录下的文件不需要创建
+func (s *MCPServer) ensureRemoteDirectories(ctx context.Context, remotePath string) error {
+	_, _, err := s.createRemoteDirs(ctx, parentRemoteDir(remotePath))
+	return err
+}
+
+// parentRemoteDir 返回远程路径的上级目录（以 / 开头）
+func parentRemoteDir(remotePath string) string {
+	return path.Dir(path.Clean("/" + remotePath))
+}
+
+// mkcolRemote 用 MKCOL 创建单个目录，created 为 false 表示目录已存在。
+// MKCOL 返回 405 既可能是目录已存在，也可能是服务器禁用了 MKCOL（例如 dufs 没有开启上传）。
+// 服务器尚未确认支持 MKCOL 时通过 HEAD 判断：路径存在说明是前者，不存在说明 MKCOL 被禁用。
+// 探测结果按客户端缓存，确认禁用后不再发送 MKCOL，直接返回配置错误
+func (s *MCPServer) mkcolRemote(ctx context.Context, dir string) (created bool, status int, err error) {
+	client := s.client(ctx)
+	if client.mkcolState.Load() == mkcolDisabled {
+		return false, http.StatusMethodNotAllowed, errMkcolDisabled(client.BaseURL)
+	}
+
+	resp, err := client.makeRequest(ctx, "MKCOL", dir, nil, nil)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to create remote directory %s: %w", dir, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		if !isSuccessStatus(resp.StatusCode) {
+			body, _ := io.ReadAll(resp.Body)
+			return false, resp.StatusCode, fmt.Errorf("create directory failed with status %d: %s", resp.StatusCode, string(body))
+		}
+		client.mkcolState.Store(mkcolSupported)
+		return true, resp.StatusCode, nil
+	}
+
+	if client.mkcolState.Load() == mkcolSupported {
+		return false, resp.StatusCode, nil
+	}
+	exists, err := s.remoteExists(ctx, dir)
+	if err != nil {
+		return false, resp.StatusCode, err
+	}
+	if !exists {
+		client.mkcolState.Store(mkcolDisabled)
+		return false, resp.StatusCode, errMkcolDisabled(client.BaseURL)
+	}
+	return false, resp.StatusCode, nil
+}
+
+// errMkcolDisabled 服务器禁用 MKCOL 时返回的配置错误
+func errMkcolDisabled(baseURL string) error {
+	return fmt.Errorf("dufs server %s does not allow MKCOL (405 for a directory that does not exist), directories cannot be created; check that uploads are enabled on the server (dufs --allow-upload)", redactURL(baseURL))
+}
+
+// createRemoteDirs 从根开始依次用 MKCOL 创建目录路径的每一级，返回新建的目录和已存在的目录
+func (s *MCPServer) createRemoteDirs(ctx context.Context, remoteDir string) (created, existed []string, err error) {
+	parts := strings.Split(strings.TrimPrefix(remoteDir, "/"), "/")
+	current := ""
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		if current == "" {
+			current = part
+		} else {
+			current = current + "/" + part
+		}
+
+		isNew, _, err := s.mkcolRemote(ctx, current)
+		if err != nil {
+			return created, existed, err
+		}
+		if isNew {
+			created = append(created, "/"+current)
+		} else {
+			existed = append(existed, "/"+current)
+		}
+	}
+
+	return created, existed, nil
+}
+
+// uploadOptions dufs_upload 的可选行为
+type uploadOptions struct {
+	// VerifySize 上传后通过 HEAD 比对远程文件大小，不一致时重新上传
+	VerifySize bool
+	// PreProcess 上传前对文件做的转换：gzip、zstd 或空（不处理）
+	PreProcess string
+	// Progress 不为空时记录传输进度
+	Progress *transferProgress
+	// SplitThreshold 大于 0 且文件超过该大小时，按该大小切分为多个分片上传
+	SplitThreshold int64
+	// PreserveMtime 通过 X-Last-Modified 请求头把本地文件的修改时间传给服务器
+	PreserveMtime bool
+	// Atomic 先上传到临时路径，校验大小后再 MOVE 到目标路径
+	Atomic bool
+	// LockToken dufs_lock 返回的锁令牌，随写入目标路径的请求通过 If 请求头提交
+	LockToken string
+}
+
+// preProcessors 支持的上传前压缩方式，值为追加到远程路径的扩展名
+var preProcessors = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// compressToTemp 把本地文件压缩到临时文件，调用方负责删除返回的临时文件
+func compressToTemp(localPath, method string) (string, error) {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %v", err)
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp("", "dufs-upload-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	tmpPath := tmp.Name()
+
+	var writer io.WriteCloser
+	switch method {
+	case "gzip":
+		writer = gzip.NewWriter(tmp)
+	case "zstd":
+		writer, err = zstd.NewWriter(tmp)
+	default:
+		err = fmt.Errorf("unsupported pre_process: %s", method)
+	}
+	if err == nil {
+		if _, err = io.Copy(writer, src); err == nil {
+			err = writer.Close()
+		}
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to %s %s: %v", method, localPath, err)
+	}
+	return tmpPath, nil
+}
+
+// uploadOutcome 单个文件的上传结果
+type uploadOutcome struct {
+	RemotePath string
+	StatusCode int
+	// Headers dufs（或其前置 CDN/代理）在 PUT 响应中返回的 headers
+	Headers map[string]string
+	// Attempts 实际执行 PUT 的次数
+	Attempts     int
+	SizeVerified bool
+	// 使用 pre_process 压缩时记录压缩前后的大小
+	OriginalSize   int64
+	CompressedSize int64
+	// Duration 最后一次 PUT 的耗时，BytesPerSecond 为对应的平均速度
+	Duration       time.Duration
+	BytesPerSecond float64
+	// Manifest 分片上传时的分片清单，未分片时为 nil；ManifestPath 为清单在服务器上的路径
+	Manifest     *SplitManifest
+	ManifestPath string
+	// Atomic 文件经临时路径上传后移动到了目标路径
+	Atomic bool
+}
+
+// SplitManifest 分片上传的清单，dufs_join_parts 根据它下载并合并分片
+type SplitManifest struct {
+	// RemotePath 未分片时文件的远程路径，各分片路径为其追加 .partNNNN
+	RemotePath string      `json:"remote_path"`
+	TotalSize  int64       `json:"total_size"`
+	PartSize   int64       `json:"part_size"`
+	SHA256     string      `json:"sha256"`
+	Parts      []SplitPart `json:"parts"`
+}
+
+// SplitPart 清单中的一个分片
+type SplitPart struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// compressionRatio 压缩后与压缩前的大小之比
+func (o uploadOutcome) compressionRatio() float64 {
+	if o.OriginalSize == 0 {
+		return 0
+	}
+	return math.Round(float64(o.CompressedSize)/float64(o.OriginalSize)*10000) / 10000
+}
+
+func (s *MCPServer) performUpload(ctx context.Context, localPath, remotePath string, opts uploadOptions) (uploadOutcome, error) {
+	var outcome uploadOutcome
+	if localPath == "" {
+		return outcome, fmt.Errorf("local_path is required")
+	}
+
+	if err := s.checkExtensionAllowed(localPath); err != nil {
+		return outcome, err
+	}
+	if err := s.checkUploadSize(localPath, opts); err != nil {
+		return outcome, err
+	}
+
+	finalRemotePath := s.resolveRemotePath(localPath, remotePath)
+
+	if opts.SplitThreshold > 0 {
+		info, err := os.Stat(localPath)
+		if err != nil {
+			return outcome, fmt.Errorf("failed to open file: %v", err)
+		}
+		if info.Size() > opts.SplitThreshold {
+			if opts.PreProcess != "" && opts.PreProcess != "none" {
+				return outcome, fmt.Errorf("split_threshold_bytes cannot be combined with pre_process")
+			}
+			if opts.PreserveMtime {
+				return outcome, fmt.Errorf("preserve_mtime cannot be used with split uploads")
+			}
+			if opts.Atomic {
+				return outcome, fmt.Errorf("atomic cannot be used with split uploads")
+			}
+			if opts.LockToken != "" {
+				return outcome, fmt.Errorf("lock_token cannot be used with split uploads")
+			}
+			return s.performSplitUpload(ctx, localPath, finalRemotePath, info.Size(), opts)
+		}
+	}
+
+	// 压缩时先写到临时文件，这样重试和大小校验都针对压缩后的内容
+	uploadPath := localPath
+	var headers map[string]string
+	if opts.PreProcess != "" && opts.PreProcess != "none" {
+		ext, ok := preProcessors[opts.PreProcess]
+		if !ok {
+			return outcome, fmt.Errorf("invalid pre_process: %s", opts.PreProcess)
+		}
+		if !strings.HasSuffix(finalRemotePath, ext) {
+			finalRemotePath += ext
+		}
+
+		tmpPath, err := compressToTemp(localPath, opts.PreProcess)
+		if err != nil {
+			return outcome, err
+		}
+		defer os.Remove(tmpPath)
+		uploadPath = tmpPath
+		headers = map[string]string{"Content-Encoding": opts.PreProcess}
+	}
+
+	if err := s.ensureRemoteDirectories(ctx, finalRemotePath); err != nil {
+		return outcome, err
+	}
+
+	original, err := os.Stat(localPath)
+	if err != nil {
+		return outcome, fmt.Errorf("failed to open file: %v", err)
+	}
+	info, err := os.Stat(uploadPath)
+	if err != nil {
+		return outcome, fmt.Errorf("failed to open file: %v", err)
+	}
+	outcome.OriginalSize = original.Size()
+	outcome.CompressedSize = info.Size()
+	if opts.PreserveMtime {
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers["X-Last-Modified"] = original.ModTime().UTC().Format(http.TimeFormat)
+	}
+	if opts.Progress != nil {
+		opts.Progress.total.Store(info.Size())
+	}
+
+	// atomic 模式先上传到临时路径，确认完整后再移动到目标路径，其他读者不会看到写了一半的文件。
+	// 任一步骤失败时删除临时文件
+	putPath := finalRemotePath
+	putHeaders := headers
+	if ifHeader := lockTokenHeaders(opts.LockToken); ifHeader != nil && !opts.Atomic {
+		putHeaders = make(map[string]string, len(headers)+1)
+		for k, v := range headers {
+			putHeaders[k] = v
+		}
+		putHeaders["If"] = ifHeader["If"]
+	}
+	committed := true
+	if opts.Atomic {
+		putPath = fmt.Sprintf("%s._tmp_%d", finalRemotePath, time.Now().UnixNano())
+		committed = false
+		defer func() {
+			if !committed {
+				s.removeRemoteTemp(ctx, putPath)
+			}
+		}()
+	}
+
+	for {
+		outcome.Attempts++
+		if opts.Progress != nil {
+			opts.Progress.transferred.Store(0)
+		}
+		start := time.Now()
+		statusCode, respHeaders, err := s.putFile(ctx, uploadPath, putPath, putHeaders, opts.Progress)
+		outcome.StatusCode = statusCode
+		if err != nil {
+			return outcome, err
+		}
+		outcome.Duration = time.Since(start)
+		outcome.BytesPerSecond = transferRate(info.Size(), outcome.Duration)
+		outcome.RemotePath = finalRemotePath
+		outcome.Headers = respHeaders
+
+		if !opts.VerifySize {
+			break
+		}
+
+		remoteSize, err := s.remoteContentLength(ctx, putPath)
+		if err != nil {
+			return outcome, err
+		}
+		if remoteSize == info.Size() {
+			outcome.SizeVerified = true
+			break
+		}
+
+		log.Printf("Size mismatch after uploading %s to %s (attempt %d): expected %d bytes, remote has %d bytes",
+			localPath, putPath, outcome.Attempts, info.Size(), remoteSize)
+		if outcome.Attempts > s.config.MaxRetries {
+			return outcome, fmt.Errorf("upload size mismatch after %d attempts: expected %d bytes, remote has %d bytes",
+				outcome.Attempts, info.Size(), remoteSize)
+		}
+	}
+
+	if !opts.Atomic {
+		return outcome, nil
+	}
+
+	// 未要求 verify_size 时同样需要确认临时文件完整后才能替换目标文件
+	if !outcome.SizeVerified {
+		remoteSize, err := s.remoteContentLength(ctx, putPath)
+		if err != nil {
+			return outcome, err
+		}
+		if remoteSize != info.Size() {
+			return outcome, fmt.Errorf("atomic upload size mismatch for %s: expected %d bytes, remote has %d bytes", putPath, info.Size(), remoteSize)
+		}
+	}
+	moveHeaders := map[string]string{"Overwrite": "T"}
+	for k, v := range lockTokenHeaders(opts.LockToken) {
+		moveHeaders[k] = v
+	}
+	if _, err := s.moveRemoteWithHeaders(ctx, putPath, finalRemotePath, moveHeaders); err != nil {
+		return outcome, err
+	}
+	committed = true
+	outcome.Atomic = true
+	return outcome, nil
+}
+
+// removeRemoteTemp 尽力删除失败的 atomic 上传留下的临时文件。工具调用可能已经超时，
+// 因此使用不随调用取消的 context，失败只记录日志
+func (s *MCPServer) removeRemoteTemp(ctx context.Context, remotePath string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+
+	resp, err := s.client(ctx).makeRequest(ctx, "DELETE", remotePath, nil, nil)
+	if err != nil {
+		log.Printf("Failed to remove temporary upload %s: %v", remotePath, err)
+		return
+	}
+	defer resp.Body.Close()
+	if !isSuccessStatus(resp.StatusCode) && resp.StatusCode != http.StatusNotFound {
+		log.Printf("Failed to remove temporary upload %s: status %d", remotePath, resp.StatusCode)
+	}
+}
+
+// performSplitUpload 把文件按 opts.SplitThreshold 切分后依次上传为 remotePath.part0001、.part0002 ...，
+// 返回的 outcome.Manifest 记录各分片的路径、大小和哈希。任一分片失败时返回错误，已上传的分片不会删除
+func (s *MCPServer) performSplitUpload(ctx context.Context, localPath, remotePath string, size int64, opts uploadOptions) (uploadOutcome, error) {
+	outcome := uploadOutcome{OriginalSize: size, CompressedSize: size}
+	if err := s.ensureRemoteDirectories(ctx, remotePath); err != nil {
+		return outcome, err
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return outcome, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	if opts.Progress != nil {
+		opts.Progress.total.Store(size)
+		opts.Progress.transferred.Store(0)
+	}
+
+	manifest := &SplitManifest{RemotePath: remotePath, TotalSize: size, PartSize: opts.SplitThreshold}
+	whole := sha256.New()
+	start := time.Now()
+	for n, offset := 1, int64(0); offset < size; n, offset = n+1, offset+opts.SplitThreshold {
+		partSize := min(opts.SplitThreshold, size-offset)
+		partPath := fmt.Sprintf("%s.part%04d", remotePath, n)
+		partHash := sha256.New()
+		body := io.TeeReader(io.NewSectionReader(file, offset, partSize), io.MultiWriter(partHash, whole))
+
+		outcome.Attempts++
+		statusCode, respHeaders, err := s.putReader(ctx, body, partPath, nil, opts.Progress)
+		outcome.StatusCode = statusCode
+		if err != nil {
+			return outcome, fmt.Errorf("part %s: %w", partPath, err)
+		}
+		outcome.Headers = respHeaders
+
+		if opts.VerifySize {
+			remoteSize, err := s.remoteContentLength(ctx, partPath)
+			if err != nil {
+				return outcome, err
+			}
+			if remoteSize != partSize {
+				return outcome, fmt.Errorf("upload size mismatch for %s: expected %d bytes, remote has %d bytes", partPath, partSize, remoteSize)
+			}
+		}
+
+		manifest.Parts = append(manifest.Parts, SplitPart{
+			Path:   partPath,
+			Size:   partSize,
+			SHA256: hex.EncodeToString(partHash.Sum(nil)),
+		})
+	}
+	manifest.SHA256 = hex.EncodeToString(whole.Sum(nil))
+
+	// 清单同时写到服务器上，之后可以只凭 <remote_path>.manifest 下载并合并
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return outcome, fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	manifestPath := remotePath + splitManifestSuffix
+	if _, _, err := s.putReader(ctx, bytes.NewReader(manifestData), manifestPath, map[string]string{"Content-Type": "application/json"}, nil); err != nil {
+		return outcome, fmt.Errorf("manifest %s: %w", manifestPath, err)
+	}
+
+	outcome.SizeVerified = opts.VerifySize
+	outcome.Duration = time.Since(start)
+	outcome.BytesPerSecond = transferRate(size, outcome.Duration)
+	outcome.RemotePath = remotePath
+	outcome.Manifest = manifest
+	outcome.ManifestPath = manifestPath
+	return outcome, nil
+}
+
+// splitManifestSuffix 分片上传时写到服务器上的清单文件后缀
+const splitManifestSuffix = ".manifest"
+
+// checkUploadSize 在发起任何网络请求前按 DUFS_MAX_UPLOAD_BYTES 校验文件大小。
+// 分片上传时每个分片单独上传，校验的是分片大小
+func (s *MCPServer) checkUploadSize(localPath string, opts uploadOptions) error {
+	if s.config.MaxUploadBytes <= 0 {
+		return nil
+	}
+
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	size := info.Size()
+	if opts.SplitThreshold > 0 && size > opts.SplitThreshold {
+		if opts.SplitThreshold > s.config.MaxUploadBytes {
+			return fmt.Errorf("split part size %d exceeds configured limit %d", opts.SplitThreshold, s.config.MaxUploadBytes)
+		}
+		return nil
+	}
+	if size > s.config.MaxUploadBytes {
+		return fmt.Errorf("file size %d exceeds configured limit %d", size, s.config.MaxUploadBytes)
+	}
+	return nil
+}
+
+// checkExtensionAllowed 按 DUFS_ALLOWED_EXTENSIONS 校验文件扩展名，未配置白名单时不做限制
+func (s *MCPServer) checkExtensionAllowed(name string) error {
+	if len(s.config.AllowedExtensions) == 0 {
+		return nil
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, allowed := range s.config.AllowedExtensions {
+		if ext == allowed {
+			return nil
+		}
+	}
+	return &rpcError{
+		Code:    errCodeFileTypeNotPermitted,
+		Message: fmt.Sprintf("file type not permitted: %s", name),
+	}
+}
+
+// putFile 执行一次 PUT 上传，返回 HTTP 状态码和响应 headers
+func (s *MCPServer) putFile(ctx context.Context, localPath, remotePath string, headers map[string]string, progress *transferProgress) (int, map[string]string, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	return s.putReader(ctx, file, remotePath, headers, progress)
+}
+
+// putReader 以 body 为内容执行一次 PUT 上传，返回 HTTP 状态码和响应 headers
+func (s *MCPServer) putReader(ctx context.Context, body io.Reader, remotePath string, headers map[string]string, progress *transferProgress) (int, map[string]string, error) {
+	resp, err := s.client(ctx).makeRequest(ctx, "PUT", remotePath, trackProgress(body, progress), headers)
+	if err != nil {
+		return 0, nil, fmt.Errorf("upload failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// 3xx 不算成功：文件并没有写入请求的路径，需要把 Location 告诉调用方
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		location := resp.Header.Get("Location")
+		if location == "" {
+			return resp.StatusCode, nil, fmt.Errorf("upload redirected with status %d and no Location header", resp.StatusCode)
+		}
+		return resp.StatusCode, nil, fmt.Errorf("upload redirected with status %d to %s; point DUFS_URL or remote_path at the final location", resp.StatusCode, location)
+	}
+	if !isSuccessStatus(resp.StatusCode) {
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, nil, fmt.Errorf("upload failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return resp.StatusCode, flattenHeaders(resp.Header), nil
+}
+
+// remoteContentLength 通过 HEAD 请求获取远程文件大小
+func (s *MCPServer) remoteContentLength(ctx context.Context, remotePath string) (int64, error) {
+	resp, err := s.client(ctx).makeRequest(ctx, "HEAD", remotePath, nil, nil)
+	if err != nil {
+		return 0, fmt.Errorf("head request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if !isSuccessStatus(resp.StatusCode) {
+		return 0, fmt.Errorf("head request failed with status %d", resp.StatusCode)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("server did not report Content-Length for %s", remotePath)
+	}
+
+	return resp.ContentLength, nil
+}
+
+// remoteLastModified 通过 HEAD 请求读取远程文件的 Last-Modified
+func (s *MCPServer) remoteLastModified(ctx context.Context, remotePath string) (time.Time, error) {
+	resp, err := s.client(ctx).makeRequest(ctx, "HEAD", remotePath, nil, nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("head request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if !isSuccessStatus(resp.StatusCode) {
+		return time.Time{}, fmt.Errorf("head request failed with status %d", resp.StatusCode)
+	}
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("server did not report a valid Last-Modified for %s", remotePath)
+	}
+	return modified, nil
+}
+
+// checkSymlink 判断 local_path 是否为符号链接，是则返回链接的目标。follow 为 false 时拒绝符号链接，
+// 链接目标不存在时返回明确的错误。不是符号链接或无法 Lstat 时返回空，由后续打开文件时报错
+func checkSymlink(localPath string, follow bool) (string, error) {
+	info, err := os.Lstat(localPath)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return "", nil
+	}
+	if !follow {
+		return "", fmt.Errorf("refusing to upload symlink: %s", localPath)
+	}
+
+	target, err := os.Readlink(localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read symlink %s: %v", localPath, err)
+	}
+	if _, err := os.Stat(localPath); errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("symlink target not found: %s -> %s", localPath, target)
+	}
+	return target, nil
+}
+
+// isSuccessStatus 判断 dufs 的响应是否表示操作成功。所有方法都只有 2xx 算成功（下载的
+// 206 Partial Content 也在其中），1xx/3xx 一律视为失败，避免被误报为成功。个别方法的例外由调用方
+// 单独判断：MKCOL 的 405 由 mkcolRemote 区分目录已存在和服务器禁用了 MKCOL，清理临时文件时的 404 视为已删除
+func isSuccessStatus(code int) bool {
+	return code >= 200 && code < 300
+}
+
+// flattenHeaders 把 http.Header 转换为单值 map，多个值以逗号拼接
+func flattenHeaders(header http.Header) map[string]string {
+	flat := make(map[string]string, len(header))
+	for k, v := range header {
+		flat[k] = strings.Join(v, ", ")
+	}
+	return flat
+}
+
+func (s *MCPServer) handleUpload(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	if command, _ := args["source_command"].(string); command != "" {
+		return s.handleCommandUpload(ctx, command, args)
+	}
+	localPath, ok := args["local_path"].(string)
+	if !ok || localPath == "" {
+		return nil, fmt.Errorf("local_path is required")
+	}
+
+	remotePath, _ := args["remote_path"].(string)
+	async, _ := args["async"].(bool)
+	verifySize, _ := args["verify_size"].(bool)
+	preProcess, _ := args["pre_process"].(string)
+	if _, ok := preProcessors[preProcess]; !ok && preProcess != "" && preProcess != "none" {
+		return nil, fmt.Errorf("invalid pre_process: %s", preProcess)
+	}
+	preserveMtime, _ := args["preserve_mtime"].(bool)
+	atomicUpload, _ := args["atomic"].(bool)
+	idempotencyKey, _ := args["idempotency_key"].(string)
+	if idempotencyKey != "" && !async {
+		return nil, fmt.Errorf("idempotency_key requires async=true")
+	}
+	followSymlinks, ok := args["follow_symlinks"].(bool)
+	if !ok {
+		followSymlinks = true
+	}
+	symlinkTarget, err := checkSymlink(localPath, followSymlinks)
+	if err != nil {
+		return nil, err
+	}
+	lockToken, _ := args["lock_token"].(string)
+	opts := uploadOptions{VerifySize: verifySize, PreProcess: preProcess, PreserveMtime: preserveMtime, Atomic: atomicUpload, LockToken: lockToken}
+	if v, ok := args["split_threshold_bytes"].(float64); ok {
+		if v < 1 {
+			return nil, fmt.Errorf("split_threshold_bytes must be positive")
+		}
+		opts.SplitThreshold = int64(v)
+	}
+
+	// 如果 async=true，使用异步上传
+	if async {
+		// 创建单个文件的任务
+		tasks := []JobTask{
+			{
+				Operation:           jobTypeUpload,
+				LocalPath:           localPath,
+				RequestedRemotePath: remotePath,
+				Status:              "pending",
+				UploadOptions:       opts,
+				progress:            &transferProgress{},
+			},
+		}
+
+		label, _ := args["label"].(string)
+		labelCollision := s.jobLabelExists(label)
+		job, replayed, err := s.startJobWithOptions(ctx, jobOptions{IdempotencyKey: idempotencyKey}, jobTypeUpload, label, tasks, s.toolTimeout("dufs_upload"))
+		if err != nil {
+			return nil, err
+		}
+		if replayed {
+			return s.replayedJobResult(job), nil
+		}
+
+		return JobStartedResult{
+			Success:        true,
+			JobID:          job.ID,
+			Status:         "pending",
+			TaskCount:      1,
+			Label:          label,
+			LabelCollision: labelCollision,
+		}, nil
+	}
+
+	// 同步上传
+	outcome, err := s.performUpload(ctx, localPath, remotePath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := UploadResult{
+		Success:         true,
+		Message:         fmt.Sprintf("File uploaded successfully to %s", outcome.RemotePath),
+		RemotePath:      outcome.RemotePath,
+		Status:          outcome.StatusCode,
+		ResponseHeaders: outcome.Headers,
+		DurationMs:      outcome.Duration.Milliseconds(),
+		BytesPerSecond:  math.Round(outcome.BytesPerSecond),
+		Mbps:            bytesPerSecondToMbps(outcome.BytesPerSecond),
+		Atomic:          outcome.Atomic,
+		IsSymlink:       symlinkTarget != "",
+		SymlinkTarget:   symlinkTarget,
+	}
+	if opts.VerifySize {
+		result.SizeVerified = &outcome.SizeVerified
+		result.Attempts = outcome.Attempts
+	}
+	if _, ok := preProcessors[opts.PreProcess]; ok {
+		result.OriginalSize = outcome.OriginalSize
+		result.CompressedSize = outcome.CompressedSize
+		result.CompressionRatio = outcome.compressionRatio()
+	}
+	if outcome.Manifest != nil {
+		result.Message = fmt.Sprintf("File uploaded successfully to %s in %d parts", outcome.RemotePath, len(outcome.Manifest.Parts))
+		result.Manifest = outcome.Manifest
+		result.ManifestPath = outcome.ManifestPath
+	}
+	if preserveMtime {
+		// 服务器不一定支持 X-Last-Modified，读回远程修改时间确认是否生效（Last-Modified 精度为秒）
+		info, err := os.Stat(localPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file: %v", err)
+		}
+		remoteMtime, err := s.remoteLastModified(ctx, outcome.RemotePath)
+		if err != nil {
+			return nil, err
+		}
+		preserved := info.ModTime().Truncate(time.Second).Equal(remoteMtime.Truncate(time.Second))
+		result.PreservedMtime = info.ModTime().UTC().Format(time.RFC3339)
+		result.RemoteMtime = remoteMtime.UTC().Format(time.RFC3339)
+		result.MtimePreserved = &preserved
+	}
+
+	return result, nil
+}
+
+// handleCommandUpload 处理 source_command：执行命令并把标准输出通过 io.Pipe 直接作为 PUT 的请求体，
+// 不在本地落盘。输出长度未知，请求以 chunked 编码发送
+func (s *MCPServer) handleCommandUpload(ctx context.Context, command string, args map[string]interface{}) (interface{}, error) {
+	if !s.config.AllowSourceCommand {
+		return nil, fmt.Errorf("source_command is disabled; set DUFS_ALLOW_SOURCE_COMMAND=true to enable it")
+	}
+	for _, name := range []string{"local_path", "source_url"} {
+		if v, _ := args[name].(string); v != "" {
+			return nil, fmt.Errorf("source_command cannot be combined with %s", name)
+		}
+	}
+	for _, name := range []string{"async", "verify_size", "preserve_mtime"} {
+		if v, _ := args[name].(bool); v {
+			return nil, fmt.Errorf("%s cannot be used with source_command", name)
+		}
+	}
+	if v, _ := args["pre_process"].(string); v != "" && v != "none" {
+		return nil, fmt.Errorf("pre_process cannot be used with source_command")
+	}
+	if _, ok := args["split_threshold_bytes"]; ok {
+		return nil, fmt.Errorf("split_threshold_bytes cannot be used with source_command")
+	}
+	remotePath, _ := args["remote_path"].(string)
+	remotePath = strings.TrimPrefix(remotePath, "/")
+	if remotePath == "" {
+		return nil, fmt.Errorf("remote_path is required with source_command")
+	}
+	if err := s.checkExtensionAllowed(remotePath); err != nil {
+		return nil, err
+	}
+	if err := s.ensureRemoteDirectories(ctx, remotePath); err != nil {
+		return nil, err
+	}
+	atomicUpload, _ := args["atomic"].(bool)
+	lockToken, _ := args["lock_token"].(string)
+
+	putPath := remotePath
+	putHeaders := lockTokenHeaders(lockToken)
+	committed := true
+	if atomicUpload {
+		putPath = fmt.Sprintf("%s._tmp_%d", remotePath, time.Now().UnixNano())
+		putHeaders = nil
+		committed = false
+		defer func() {
+			if !committed {
+				s.removeRemoteTemp(ctx, putPath)
+			}
+		}()
+	}
+
+	progress := &transferProgress{}
+	start := time.Now()
+	statusCode, respHeaders, err := s.putCommandOutput(ctx, command, putPath, putHeaders, progress)
+	if err != nil {
+		return nil, err
+	}
+	duration := time.Since(start)
+	size := progress.transferred.Load()
+
+	if atomicUpload {
+		remoteSize, err := s.remoteContentLength(ctx, putPath)
+		if err != nil {
+			return nil, err
+		}
+		if remoteSize != size {
+			return nil, fmt.Errorf("atomic upload size mismatch for %s: expected %d bytes, remote has %d bytes", putPath, size, remoteSize)
+		}
+		moveHeaders := map[string]string{"Overwrite": "T"}
+		for k, v := range lockTokenHeaders(lockToken) {
+			moveHeaders[k] = v
+		}
+		if _, err := s.moveRemoteWithHeaders(ctx, putPath, remotePath, moveHeaders); err != nil {
+			return nil, err
+		}
+		committed = true
+	}
+
+	rate := transferRate(size, duration)
+	return UploadResult{
+		Success:         true,
+		Message:         fmt.Sprintf("Command output (%d bytes) uploaded successfully to %s", size, remotePath),
+		RemotePath:      remotePath,
+		Status:          statusCode,
+		ResponseHeaders: respHeaders,
+		DurationMs:      duration.Milliseconds(),
+		BytesPerSecond:  math.Round(rate),
+		Mbps:            bytesPerSecondToMbps(rate),
+		Atomic:          atomicUpload,
+		SourceCommand:   command,
+		UploadedBytes:   size,
+	}, nil
+}
+
+// commandStderrLimit 上传失败时随错误返回的命令标准错误输出的最大字节数（保留末尾部分）
+const commandStderrLimit = 4096
+
+// tailBuffer 只保留最后 limit 个字节的 io.Writer，用于收集命令的标准错误输出
+type tailBuffer struct {
+	mu    sync.Mutex
+	buf   []byte
+	limit int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.limit {
+		t.buf = t.buf[len(t.buf)-t.limit:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.TrimSpace(string(t.buf))
+}
+
+// shellCommand 返回通过系统 shell 执行 command 的 exec.Cmd，ctx 取消时进程会被杀死
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// putCommandOutput 执行 command，把标准输出经 io.Pipe 流式上传到 remotePath。命令失败时
+// 以带标准错误输出的错误中断请求体，上传随之失败；配置了 DUFS_MAX_UPLOAD_BYTES 时输出超出上限也会中断上传
+func (s *MCPServer) putCommandOutput(ctx context.Context, command, remotePath string, headers map[string]string, progress *transferProgress) (int, map[string]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stderr := &tailBuffer{limit: commandStderrLimit}
+	pr, pw := io.Pipe()
+	cmd := shellCommand(ctx, command)
+	cmd.Stdout = pw
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return 0, nil, fmt.Errorf("failed to start source_command: %v", err)
+	}
+
+	// done 在 cmdErr 写入后、关闭管道写端之前关闭，请求体读取出错时 cmdErr 一定已经可见
+	var cmdErr error
+	done := make(chan struct{})
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			cmdErr = fmt.Errorf("source_command failed: %v", err)
+			if msg := stderr.String(); msg != "" {
+				cmdErr = fmt.Errorf("source_command failed: %v: %s", err, msg)
+			}
+		}
+		close(done)
+		// 命令成功时以 EOF 结束请求体，失败时让请求体读取出错，避免把不完整的输出当成完整文件
+		pw.CloseWithError(cmdErr)
+	}()
+
+	var body io.Reader = pr
+	if s.config.MaxUploadBytes > 0 {
+		body = &limitedUploadReader{reader: pr, remaining: s.config.MaxUploadBytes, limit: s.config.MaxUploadBytes}
+	}
+	statusCode, respHeaders, err := s.putReader(ctx, body, remotePath, headers, progress)
+	if err != nil {
+		select {
+		case <-done:
+			if cmdErr != nil {
+				return statusCode, nil, cmdErr
+			}
+		default:
+			// 请求提前结束（服务器拒绝、超出大小等）时命令可能还在写管道，关闭读端并杀死进程
+			pr.CloseWithError(io.ErrClosedPipe)
+			cancel()
+			<-done
+		}
+		return statusCode, nil, err
+	}
+	<-done
+	return statusCode, respHeaders, nil
+}
+
+// limitedUploadReader 读取超过 limit 字节时返回错误，用于长度未知的上传
+type limitedUploadReader struct {
+	reader    io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (l *limitedUploadReader) Read(buf []byte) (int, error) {
+	n, err := l.reader.Read(buf)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, fmt.Errorf("command output exceeds configured limit %d", l.limit)
+	}
+	return n, err
+}
+
+func (s *MCPServer) handleUploadBatch(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	filesParam, _ := args["files"].([]interface{})
+	sourceDir, _ := args["source_dir"].(string)
+	switch {
+	case sourceDir != "" && len(filesParam) > 0:
+		return nil, fmt.Errorf("files and source_dir cannot be used together")
+	case sourceDir != "":
+		files, err := s.collectSourceDir(sourceDir, args)
+		if err != nil {
+			return nil, err
+		}
+		filesParam = files
+	case len(filesParam) == 0:
+		return nil, fmt.Errorf("files is required and must contain at least one entry")
+	}
+
+	async, ok := args["async"].(bool)
+	if !ok {
+		async = true // 默认异步
+	}
+	idempotencyKey, _ := args["idempotency_key"].(string)
+	if idempotencyKey != "" && !async {
+		return nil, fmt.Errorf("idempotency_key requires async=true")
+	}
+	manifestPath, _ := args["manifest_path"].(string)
+	if manifestPath != "" && !async {
+		return nil, fmt.Errorf("manifest_path requires async=true")
+	}
+
+	deduplicate, ok := args["deduplicate"].(bool)
+	if !ok {
+		deduplicate = true // 默认去重
+	}
+
+	maxRetries := 0
+	if v, ok := args["max_task_retries"].(float64); ok {
+		if v < 0 {
+			return nil, fmt.Errorf("max_task_retries must not be negative")
+		}
+		maxRetries = int(v)
+	}
+
+	discoveredCount := 0
+	if sourceDir != "" {
+		discoveredCount = len(filesParam)
+	}
+
+	tasks := make([]JobTask, 0, len(filesParam))
+	for _, item := range filesParam {
+		fileArgs, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid file entry: %+v", item)
+		}
+		localPath, ok := fileArgs["local_path"].(string)
+		if !ok || localPath == "" {
+			return nil, fmt.Errorf("local_path is required for each file")
+		}
+		remotePath, _ := fileArgs["remote_path"].(string)
+
+		tasks = append(tasks, JobTask{
+			Operation:           jobTypeUpload,
+			LocalPath:           localPath,
+			RequestedRemotePath: remotePath,
+			Status:              "pending",
+			MaxRetries:          maxRetries,
+			progress:            &transferProgress{},
+		})
+	}
+
+	duplicatesRemoved := 0
+	if deduplicate {
+		tasks, duplicatesRemoved = deduplicateUploadTasks(tasks)
+	}
+
+	// 如果 async=false，同步上传所有文件
+	if !async {
+		upload := func(task JobTask) UploadFileResult {
+			outcome, err := s.performUpload(ctx, task.LocalPath, task.RequestedRemotePath, task.UploadOptions)
+			if err != nil {
+				return UploadFileResult{
+					LocalPath:  task.LocalPath,
+					RemotePath: task.RequestedRemotePath,
+					Success:    false,
+					Error:      err.Error(),
+					Status:     outcome.StatusCode,
+				}
+			}
+			return UploadFileResult{
+				LocalPath:  task.LocalPath,
+				RemotePath: outcome.RemotePath,
+				Success:    true,
+				Status:     outcome.StatusCode,
+			}
+		}
+
+		results := make([]UploadFileResult, 0, len(tasks))
+		for _, task := range tasks {
+			results = append(results, upload(task))
+		}
+
+		for attempt := 1; attempt <= maxRetries; attempt++ {
+			var failed []int
+			for i, result := range results {
+				if !result.Success {
+					failed = append(failed, i)
+				}
+			}
+			if len(failed) == 0 {
+				break
+			}
+			if err := sleepContext(ctx, taskRetryDelay(attempt)); err != nil {
+				break
+			}
+			for _, i := range failed {
+				results[i] = upload(tasks[i])
+				results[i].RetryCount = attempt
+			}
+		}
+
+		allSuccess := true
+		for _, result := range results {
+			if !result.Success {
+				allSuccess = false
+				break
+			}
+		}
+
+		return UploadBatchResult{
+			Success:           allSuccess,
+			Results:           results,
+			Count:             len(results),
+			DuplicatesRemoved: duplicatesRemoved,
+			DiscoveredCount:   discoveredCount,
+		}, nil
+	}
+
+	// 异步上传
+	label, _ := args["label"].(string)
+	labelCollision := s.jobLabelExists(label)
+	jobOpts := jobOptions{IdempotencyKey: idempotencyKey, ManifestPath: manifestPath}
+	job, replayed, err := s.startJobWithOptions(ctx, jobOpts, jobTypeUpload, label, tasks, s.toolTimeout("dufs_upload_batch"))
+	if err != nil {
+		return nil, err
+	}
+	if replayed {
+		return UploadBatchStartedResult{JobStartedResult: s.replayedJobResult(job)}, nil
+	}
+
+	return UploadBatchStartedResult{
+		JobStartedResult: JobStartedResult{
+			Success:        true,
+			JobID:          job.ID,
+			Status:         "pending",
+			TaskCount:      len(tasks),
+			Label:          label,
+			LabelCollision: labelCollision,
+		},
+		DuplicatesRemoved: duplicatesRemoved,
+		DiscoveredCount:   discoveredCount,
+	}, nil
+}
+
+// collectSourceDir 遍历 dufs_upload_batch 的 source_dir，为每个普通文件生成与 files 参数相同结构的条目，
+// 远程路径为 remote_dir（默认 upload_dir/当前日期）加上相对于 source_dir 的路径。
+// 匹配 exclude_patterns 的目录整体跳过，符号链接等非普通文件忽略
+func (s *MCPServer) collectSourceDir(sourceDir string, args map[string]interface{}) ([]interface{}, error) {
+	exclude, err := patternListArg(args, "exclude_patterns")
+	if err != nil {
+		return nil, err
+	}
+	remoteDir, _ := args["remote_dir"].(string)
+	if remoteDir == "" {
+		remoteDir = path.Dir(s.resolveRemotePath(filepath.Join(sourceDir, "file"), ""))
+	}
+
+	var files []interface{}
+	err = filepath.WalkDir(sourceDir, func(localPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(sourceDir, localPath)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if matchesAnyPattern(exclude, rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		files = append(files, map[string]interface{}{
+			"local_path":  localPath,
+			"remote_path": path.Join("/", remoteDir, rel),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk source_dir: %v", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files found in source_dir %s", sourceDir)
+	}
+	return files, nil
+}
+
+// deduplicateUploadTasks 合并 local_path 相同的任务，保留第一次出现的 remote_path
+func deduplicateUploadTasks(tasks []JobTask) ([]JobTask, int) {
+	seen := make(map[string]bool, len(tasks))
+	unique := make([]JobTask, 0, len(tasks))
+	removed := 0
+
+	for _, task := range tasks {
+		key := filepath.Clean(task.LocalPath)
+		if seen[key] {
+			log.Printf("Warning: duplicate local_path %s in batch upload, skipping", task.LocalPath)
+			removed++
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, task)
+	}
+
+	return unique, removed
+}
+
+func (s *MCPServer) handleUploadStatus(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	jobID, ok := args["job_id"].(string)
+	if !ok || jobID == "" {
+		return nil, fmt.Errorf("job_id is required")
+	}
+
+	s.jobsMutex.RLock()
+	job, exists := s.jobs[jobID]
+	if !exists {
+		s.jobsMutex.RUnlock()
+		return nil, fmt.Errorf("job %s not found", jobID)
+	}
+
+	jobCopy := copyJob(job)
+	s.jobsMutex.RUnlock()
+
+	return JobStatusResult{
+		Success: true,
+		Job:     jobCopy,
+	}, nil
+}
+
+func copyJob(job *Job) Job {
+	jobCopy := *job
+	jobCopy.Events = nil
+	jobCopy.Tasks = make([]JobTask, len(job.Tasks))
+	copy(jobCopy.Tasks, job.Tasks)
+	for i := range jobCopy.Tasks {
+		task := &jobCopy.Tasks[i]
+		if task.progress == nil {
+			continue
+		}
+		task.BytesTransferred = task.progress.transferred.Load()
+		task.TotalBytes = task.progress.total.Load()
+		if task.TotalBytes > 0 {
+			task.ProgressPercent = math.Round(float64(task.BytesTransferred)/float64(task.TotalBytes)*10000) / 100
+		}
+
+		if task.StartedAt.IsZero() {
+			continue
+		}
+		end := task.CompletedAt
+		if end.IsZero() {
+			end = time.Now()
+		}
+		task.BytesPerSecond = math.Round(transferRate(task.BytesTransferred, end.Sub(task.StartedAt)))
+		if task.Status == "running" && task.BytesPerSecond > 0 && task.TotalBytes > task.BytesTransferred {
+			task.ETASeconds = math.Round(float64(task.TotalBytes-task.BytesTransferred)/task.BytesPerSecond*10) / 10
+		}
+	}
+	return jobCopy
+}
+
+// startJob 登记新任务并在后台执行：context 保留调用中的值（如 language）但不随调用结束而取消，整体不超过 timeout，未结束的任务数达到 DUFS_MAX_JOBS 时拒绝
+func (s *MCPServer) startJob(ctx context.Context, jobType, label string, tasks []JobTask, timeout time.Duration) (*Job, error) {
+	job, _, err := s.startJobWithOptions(ctx, jobOptions{}, jobType, label, tasks, timeout)
+	return job, err
+}
+
+// jobOptions 创建任务时的可选设置
+type jobOptions struct {
+	// IdempotencyKey 不为空且已有使用该 key 的任务时不创建新任务
+	IdempotencyKey string
+	// ManifestPath 不为空时在任务结束后把上传清单写入该本地路径
+	ManifestPath string
+}
+
+// startJobWithOptions 与 startJob 相同，但指定了 IdempotencyKey 且已有使用该 key 的任务时直接返回该任务，
+// replayed 为 true。检查和创建在同一把锁内完成，并发的重复调用也只会创建一个任务
+func (s *MCPServer) startJobWithOptions(ctx context.Context, opts jobOptions, jobType, label string, tasks []JobTask, timeout time.Duration) (job *Job, replayed bool, err error) {
+	key := opts.IdempotencyKey
+	s.jobsMutex.Lock()
+	if key != "" {
+		if existing, ok := s.jobs[s.jobKeys[key]]; ok {
+			s.jobsMutex.Unlock()
+			return existing, true, nil
+		}
+	}
+	if s.config.MaxJobs > 0 {
+		active := 0
+		for _, existing := range s.jobs {
+			if !existing.isTerminal() {
+				active++
+			}
+		}
+		if active >= s.config.MaxJobs {
+			s.jobsMutex.Unlock()
+			return nil, false, fmt.Errorf("too many active jobs (%d/%d), wait for running jobs to finish or cancel some", active, s.config.MaxJobs)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	job = &Job{
+		ID:             s.newJobID(label),
+		Type:           jobType,
+		Label:          label,
+		CreatedAt:      time.Now(),
+		IdempotencyKey: key,
+		ManifestPath:   opts.ManifestPath,
+		Tasks:          tasks,
+		cancel:         cancel,
+	}
+	job.setStatus("pending", fmt.Sprintf("%d task(s) queued", len(tasks)))
+	s.jobs[job.ID] = job
+	if key != "" {
+		s.jobKeys[key] = job.ID
+	}
+	s.jobsMutex.Unlock()
+
+	go s.runJob(ctx, job)
+
+	return job, false, nil
+}
+
+// replayedJobResult 重复使用 idempotency_key 时返回已有任务的当前状态
+func (s *MCPServer) replayedJobResult(job *Job) JobStartedResult {
+	s.jobsMutex.RLock()
+	defer s.jobsMutex.RUnlock()
+	return JobStartedResult{
+		Success:   true,
+		JobID:     job.ID,
+		Status:    job.Status,
+		TaskCount: len(job.Tasks),
+		Message:   fmt.Sprintf("Job %s already exists for this idempotency_key, no new upload started", job.ID),
+		Label:     job.Label,
+		Replayed:  true,
+	}
+}
+
+// jobIDFormats DUFS_JOB_ID_FORMAT 支持的取值，空字符串为默认格式
+var jobIDFormats = map[string]bool{
+	"":           true,
+	"nano":       true,
+	"uuid":       true,
+	"sequential": true,
+	"label-nano": true,
+}
+
+// newJobID 按 DUFS_JOB_ID_FORMAT 生成任务 ID，调用方需持有 jobsMutex。
+// 默认格式由递增序号和随机部分组成：序号保证唯一，随机部分保证不可猜测；
+// 其他格式生成的 ID 与已有任务重复时重新生成
+func (s *MCPServer) newJobID(label string) string {
+	s.jobSeq++
+	for {
+		var id string
+		switch s.config.JobIDFormat {
+		case "nano":
+			id = fmt.Sprintf("job-%d", time.Now().UnixNano())
+		case "uuid":
+			id = newUUID()
+		case "sequential":
+			id = fmt.Sprintf("job-%d", s.jobSeq)
+		case "label-nano":
+			prefix := "job"
+			if cleaned := jobIDLabelPattern.ReplaceAllString(label, "-"); strings.Trim(cleaned, "-") != "" {
+				prefix = strings.Trim(cleaned, "-")
+			}
+			id = prefix + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+		default:
+			id = fmt.Sprintf("job-%d-%s", s.jobSeq, newRandomID())
+		}
+		if _, exists := s.jobs[id]; !exists {
+			return id
+		}
+	}
+}
+
+// jobIDLabelPattern label-nano 格式中需要替换为 - 的字符
+var jobIDLabelPattern = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// jobLabelExists 是否已有任务使用该 label，空 label 不算冲突
+func (s *MCPServer) jobLabelExists(label string) bool {
+	if label == "" {
+		return false
+	}
+
+	s.jobsMutex.RLock()
+	defer s.jobsMutex.RUnlock()
+	for _, job := range s.jobs {
+		if job.Label == label {
+			return true
+		}
+	}
+	return false
+}
+
+// runJob 在后台依次执行任务中的每一项，遇到失败或被取消时终止整个任务。
+// 设置了 MaxRetries 的任务项失败时不终止任务，而是在所有任务项执行完后按指数退避重试
+func (s *MCPServer) runJob(ctx context.Context, job *Job) {
+	defer job.cancel()
+	defer s.notifyJobFinished(job)
+	defer s.writeJobManifest(job)
+
+	s.jobsMutex.Lock()
+	if job.Status == "cancelled" {
+		s.jobsMutex.Unlock()
+		return
+	}
+	job.setStatus("running", "")
+	s.jobsMutex.Unlock()
+
+	for i := range job.Tasks {
+		if ctx.Err() != nil {
+			s.jobsMutex.Lock()
+			s.markJobTimedOut(ctx, job)
+			s.jobsMutex.Unlock()
+			return
+		}
+
+		err := s.runJobTask(ctx, job, i)
+		if err == nil {
+			continue
+		}
+
+		s.jobsMutex.Lock()
+		if s.markJobTimedOut(ctx, job) {
+			s.jobsMutex.Unlock()
+			return
+		}
+		if (job.Tasks[i].MaxRetries > 0 || job.Tasks[i].ContinueOnError) && job.Status != "cancelled" {
+			s.jobsMutex.Unlock()
+			continue
+		}
+		if job.Status != "cancelled" {
+			job.setStatus("failed", err.Error())
+			job.Error = err.Error()
+			job.CompletedAt = time.Now()
+		}
+		s.jobsMutex.Unlock()
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		s.jobsMutex.Lock()
+		var retry []int
+		for i, task := range job.Tasks {
+			if task.Status == "failed" && attempt <= task.MaxRetries {
+				retry = append(retry, i)
+			}
+		}
+		s.jobsMutex.Unlock()
+		if len(retry) == 0 {
+			break
+		}
+
+		if err := sleepContext(ctx, taskRetryDelay(attempt)); err != nil {
+			s.jobsMutex.Lock()
+			s.markJobTimedOut(ctx, job)
+			s.jobsMutex.Unlock()
+			return
+		}
+
+		for _, i := range retry {
+			s.jobsMutex.Lock()
+			if job.Status == "cancelled" {
+				s.jobsMutex.Unlock()
+				return
+			}
+			job.Tasks[i].RetryCount = attempt
+			job.Tasks[i].Error = ""
+			s.jobsMutex.Unlock()
+
+			if err := s.runJobTask(ctx, job, i); err != nil {
+				s.jobsMutex.Lock()
+				timedOut := s.markJobTimedOut(ctx, job)
+				s.jobsMutex.Unlock()
+				if timedOut {
+					return
+				}
+			}
+		}
+	}
+
+	s.jobsMutex.Lock()
+	if job.Status != "cancelled" {
+		failed := 0
+		for _, task := range job.Tasks {
+			if task.Status == "failed" {
+				failed++
+			}
+		}
+		if failed > 0 {
+			job.Error = fmt.Sprintf("%d of %d tasks failed", failed, len(job.Tasks))
+			job.setStatus("failed", job.Error)
+		} else {
+			job.setStatus("completed", "")
+		}
+		job.CompletedAt = time.Now()
+	}
+	s.jobsMutex.Unlock()
+}
+
+// UploadManifest dufs_upload_batch 指定 manifest_path 时在任务结束后写入的上传清单
+type UploadManifest struct {
+	JobID       string               `json:"job_id"`
+	Label       string               `json:"label,omitempty"`
+	Status      string               `json:"status"`
+	CreatedAt   time.Time            `json:"created_at"`
+	CompletedAt time.Time            `json:"completed_at"`
+	Files       []UploadManifestFile `json:"files"`
+}
+
+// UploadManifestFile 上传清单中的一个文件，Size 和 SHA256 为本地文件的大小和哈希，仅对上传成功的文件计算
+type UploadManifestFile struct {
+	LocalPath  string `json:"local_path"`
+	RemotePath string `json:"remote_path,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	SHA256     string `json:"sha256,omitempty"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+// writeJobManifest 任务结束后把上传清单写入 ManifestPath，结果记录在任务的 ManifestWritten/ManifestError 中
+func (s *MCPServer) writeJobManifest(job *Job) {
+	s.jobsMutex.RLock()
+	if job.ManifestPath == "" {
+		s.jobsMutex.RUnlock()
+		return
+	}
+	manifestPath := job.ManifestPath
+	manifest := UploadManifest{
+		JobID:       job.ID,
+		Label:       job.Label,
+		Status:      job.Status,
+		CreatedAt:   job.CreatedAt,
+		CompletedAt: job.CompletedAt,
+		Files:       make([]UploadManifestFile, 0, len(job.Tasks)),
+	}
+	for _, task := range job.Tasks {
+		manifest.Files = append(manifest.Files, UploadManifestFile{
+			LocalPath:  task.LocalPath,
+			RemotePath: task.ResolvedRemotePath,
+			Status:     task.Status,
+			Error:      task.Error,
+		})
+	}
+	s.jobsMutex.RUnlock()
+
+	// 哈希在锁外计算，大文件不会阻塞其他任务的状态查询
+	for i := range manifest.Files {
+		file := &manifest.Files[i]
+		if file.Status != "succeeded" {
+			continue
+		}
+		if info, err := os.Stat(file.LocalPath); err == nil {
+			file.Size = info.Size()
+		}
+		if hash, err := hashLocalFile(file.LocalPath); err == nil {
+			file.SHA256 = hash
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = os.WriteFile(manifestPath, data, 0644)
+	}
+
+	s.jobsMutex.Lock()
+	defer s.jobsMutex.Unlock()
+	if err != nil {
+		log.Printf("Failed to write manifest for job %s: %v", job.ID, err)
+		job.ManifestError = err.Error()
+		return
+	}
+	job.ManifestWritten = true
+}
+
+// runJobTask 执行任务中的第 i 项并记录结果，失败时返回错误
+func (s *MCPServer) runJobTask(ctx context.Context, job *Job, i int) error {
+	s.jobsMutex.Lock()
+	job.setTaskStatus(i, "running", job.Tasks[i].LocalPath)
+	job.Tasks[i].StartedAt = time.Now()
+	task := job.Tasks[i]
+	s.jobsMutex.Unlock()
+
+	result, err := s.executeJobTask(ctx, task)
+	result.CompletedAt = time.Now()
+
+	s.jobsMutex.Lock()
+	defer s.jobsMutex.Unlock()
+	if err != nil {
+		result.Status = job.Tasks[i].Status
+		result.Error = err.Error()
+		job.Tasks[i] = result
+		job.setTaskStatus(i, "failed", err.Error())
+		return err
+	}
+	status := result.Status
+	result.Status = job.Tasks[i].Status
+	job.Tasks[i] = result
+	job.setTaskStatus(i, status, result.Message)
+	return nil
+}
+
+// taskRetryBaseDelay 第一次重试前的等待时间，之后每次翻倍
+const taskRetryBaseDelay = time.Second
+
+// taskRetryMaxDelay 重试等待时间的上限
+const taskRetryMaxDelay = 30 * time.Second
+
+// taskRetryDelay 第 attempt 次重试（从 1 开始）前的等待时间
+func taskRetryDelay(attempt int) time.Duration {
+	delay := taskRetryBaseDelay
+	for i := 1; i < attempt && delay < taskRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, taskRetryMaxDelay)
+}
+
+// sleepContext 等待 d，ctx 结束时提前返回 ctx 的错误
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// markJobTimedOut 任务超时时将其标记为失败并把未开始的任务项标记为 cancelled，调用方需持有 jobsMutex
+func (s *MCPServer) markJobTimedOut(ctx context.Context, job *Job) bool {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) || job.isTerminal() {
+		return false
+	}
+
+	job.Error = fmt.Sprintf("job timed out after %s", time.Since(job.CreatedAt).Round(time.Second))
+	job.setStatus("failed", job.Error)
+	job.CompletedAt = time.Now()
+	for i := range job.Tasks {
+		if job.Tasks[i].Status == "pending" {
+			job.setTaskStatus(i, "cancelled", "job timed out")
+		}
+	}
+	return true
+}
+
+// executeJobTask 执行一项操作，返回填充了结果字段的任务副本
+func (s *MCPServer) executeJobTask(ctx context.Context, task JobTask) (JobTask, error) {
+	switch task.Operation {
+	case jobOpDownloadFolder:
+		outcome, err := s.performDownloadFolder(ctx, task.RequestedRemotePath, task.LocalPath, task.progress)
+		task.HTTPStatus = outcome.StatusCode
+		task.LocalPath = outcome.LocalPath
+		if err != nil {
+			return task, err
+		}
+
+		task.Status = "succeeded"
+		task.Message = fmt.Sprintf("folder downloaded to %s", outcome.LocalPath)
+		task.ResolvedRemotePath = task.RequestedRemotePath
+		task.SizeBytes = outcome.SizeBytes
+		return task, nil
+
+	case jobTypeDownload:
+		opts := task.DownloadOptions
+		opts.Progress = task.progress
+		outcome, err := s.performDownload(ctx, task.RequestedRemotePath, task.LocalPath, opts)
+		task.HTTPStatus = outcome.StatusCode
+		task.LocalPath = outcome.LocalPath
+		if err != nil {
+			return task, err
+		}
+
+		task.Status = "succeeded"
+		task.Message = fmt.Sprintf("downloaded to %s", outcome.LocalPath)
+		if outcome.Skipped {
+			task.Status = "skipped"
+			task.Message = fmt.Sprintf("%s already exists", outcome.LocalPath)
+		}
+		task.ResolvedRemotePath = task.RequestedRemotePath
+		task.SizeBytes = outcome.SizeBytes
+		task.SHA256 = outcome.SHA256
+		return task, nil
+
+	case jobTypeUpload:
+		opts := task.UploadOptions
+		opts.Progress = task.progress
+		outcome, err := s.performUpload(ctx, task.LocalPath, task.RequestedRemotePath, opts)
+		task.HTTPStatus = outcome.StatusCode
+		if err != nil {
+			return task, err
+		}
+
+		task.Status = "succeeded"
+		task.ResolvedRemotePath = outcome.RemotePath
+		task.Message = fmt.Sprintf("uploaded to %s", outcome.RemotePath)
+		if _, ok := preProcessors[task.UploadOptions.PreProcess]; ok {
+			task.Message = fmt.Sprintf("uploaded to %s (%s, %d -> %d bytes)", outcome.RemotePath,
+				task.UploadOptions.PreProcess, outcome.OriginalSize, outcome.CompressedSize)
+		}
+		if outcome.Manifest != nil {
+			task.Message = fmt.Sprintf("uploaded to %s in %d parts, manifest at %s", outcome.RemotePath, len(outcome.Manifest.Parts), outcome.ManifestPath)
+			task.Manifest = outcome.Manifest
+		}
+		task.ResponseHeaders = outcome.Headers
+		return task, nil
+
+	case jobOpPlanStep:
+		result, err := s.runPlanStep(ctx, task.StepType, task.StepArgs)
+		if err != nil {
+			return task, err
+		}
+
+		task.Status = "succeeded"
+		task.Message = fmt.Sprintf("%s step completed", task.StepType)
+		task.StepResult = result
+		return task, nil
+
+	default:
+		return task, fmt.Errorf("unknown operation: %s", task.Operation)
+	}
+}
+
+func (s *MCPServer) handleListJobs(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	jobType, _ := args["type"].(string)
+	status, _ := args["status"].(string)
+	labelPrefix, _ := args["label"].(string)
+
+	s.jobsMutex.RLock()
+	jobs := make([]JobSummary, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		if jobType != "" && job.Type != jobType {
+			continue
+		}
+		if status != "" && job.Status != status {
+			continue
+		}
+		if labelPrefix != "" && !strings.HasPrefix(job.Label, labelPrefix) {
+			continue
+		}
+		summary := JobSummary{
+			ID:        job.ID,
+			Type:      job.Type,
+			Label:     job.Label,
+			Status:    job.Status,
+			CreatedAt: job.CreatedAt,
+			Error:     job.Error,
+			TaskCount: len(job.Tasks),
+		}
+		if !job.CompletedAt.IsZero() {
+			completedAt := job.CompletedAt
+			summary.CompletedAt = &completedAt
+		}
+		jobs = append(jobs, summary)
+	}
+	s.jobsMutex.RUnlock()
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+
+	return ListJobsResult{
+		Success: true,
+		Jobs:    jobs,
+		Count:   len(jobs),
+	}, nil
+}
+
+func (s *MCPServer) handleJobEvents(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	var jobIDs []string
+	if raw, ok := args["job_ids"].([]interface{}); ok {
+		for _, item := range raw {
+			id, ok := item.(string)
+			if !ok || id == "" {
+				return nil, fmt.Errorf("job_ids must be an array of job IDs")
+			}
+			jobIDs = append(jobIDs, id)
+		}
+	}
+	if len(jobIDs) == 0 {
+		return nil, fmt.Errorf("job_ids is required and must contain at least one job ID")
+	}
+
+	var since time.Time
+	if v, _ := args["since"].(string); v != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid since, expected RFC3339 timestamp: %v", err)
+		}
+		since = parsed
+	}
+
+	s.jobsMutex.RLock()
+	events := []UploadJobEvent{}
+	for _, id := range jobIDs {
+		job, exists := s.jobs[id]
+		if !exists {
+			s.jobsMutex.RUnlock()
+			return nil, fmt.Errorf("job %s not found", id)
+		}
+		for _, event := range job.Events {
+			if event.Timestamp.After(since) {
+				events = append(events, event)
+			}
+		}
+	}
+	s.jobsMutex.RUnlock()
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+
+	return JobEventsResult{
+		Success: true,
+		Events:  events,
+		Count:   len(events),
+	}, nil
+}
+
+func (s *MCPServer) handleCancelJob(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	jobID, ok := args["job_id"].(string)
+	if !ok || jobID == "" {
+		return nil, fmt.Errorf("job_id is required")
+	}
+
+	s.jobsMutex.Lock()
+	defer s.jobsMutex.Unlock()
+
+	job, exists := s.jobs[jobID]
+	if !exists {
+		return nil, fmt.Errorf("job %s not found", jobID)
+	}
+	if job.isTerminal() {
+		return nil, fmt.Errorf("job %s already %s", jobID, job.Status)
+	}
+
+	// 取消任务的 context 会中断正在进行的请求，正在执行的任务项随之失败；尚未开始的任务项不再执行
+	job.cancel()
+	job.Error = "cancelled by user"
+	job.setStatus("cancelled", job.Error)
+	job.CompletedAt = time.Now()
+	for i := range job.Tasks {
+		if job.Tasks[i].Status == "pending" {
+			job.setTaskStatus(i, "cancelled", job.Error)
+		}
+	}
+
+	return CancelJobResult{
+		Success: true,
+		Message: fmt.Sprintf("Job %s cancelled", jobID),
+		Job:     copyJob(job),
+	}, nil
+}
+
+func (s *MCPServer) handleDownload(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	remotePath, ok := args["remote_path"].(string)
+	if !ok {
+		return nil, fmt.Errorf("remote_path is required")
+	}
+
+	localPath, _ := args["local_path"].(string)
+	postProcess, _ := args["post_process"].(string)
+	if postProcess == "" {
+		postProcess = "auto"
+	}
+	if _, ok := preProcessors[postProcess]; !ok && postProcess != "auto" && postProcess != "none" {
+		return nil, fmt.Errorf("invalid post_process: %s", postProcess)
+	}
+	expectedSHA256, _ := args["expected_sha256"].(string)
+	opts := downloadOptions{
+		PostProcess:    postProcess,
+		ExpectedSHA256: expectedSHA256,
+	}
+	if v, ok := args["strip_path_components"].(float64); ok {
+		if v < 0 {
+			return nil, fmt.Errorf("strip_path_components must not be negative")
+		}
+		if v > 0 && localPath != "" {
+			return nil, fmt.Errorf("strip_path_components cannot be combined with local_path")
+		}
+		opts.StripComponents = int(v)
+	}
+
+	outcome, err := s.performDownload(ctx, remotePath, localPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := DownloadResult{
+		Success:    true,
+		Message:    fmt.Sprintf("File downloaded successfully to %s", outcome.LocalPath),
+		RemotePath: remotePath,
+		LocalPath:  outcome.LocalPath,
+		SizeBytes:  outcome.SizeBytes,
+		Status:     outcome.StatusCode,
+	}
+	if outcome.Decompressed != "" {
+		result.Decompressed = outcome.Decompressed
+		result.CompressedBytes = outcome.CompressedBytes
+		result.DecompressedBytes = outcome.SizeBytes
+	}
+	if expectedSHA256 != "" {
+		result.SHA256 = outcome.WrittenSHA256
+	}
+
+	return result, nil
+}
+
+// downloadOutcome 单个文件的下载结果
+type downloadOutcome struct {
+	LocalPath string
+	// SizeBytes 写入本地文件的字节数（解压时为解压后的大小）
+	SizeBytes int64
+	// SHA256 服务器上原始内容（解压前）的哈希
+	SHA256 string
+	// WrittenSHA256 写入本地文件内容的哈希，仅在指定 ExpectedSHA256 时计算
+	WrittenSHA256 string
+	Skipped       bool
+	StatusCode    int
+	// Decompressed 下载时使用的解压方式，未解压时为空
+	Decompressed string
+	// CompressedBytes 解压时从服务器读取的压缩数据字节数
+	CompressedBytes int64
+}
+
+// detectCompression 根据 Content-Encoding 或文件扩展名判断压缩方式，无法识别时返回空
+func detectCompression(contentEncoding, remotePath string) string {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "x-gzip":
+		return "gzip"
+	case "zstd":
+		return "zstd"
+	}
+	for method, ext := range preProcessors {
+		if strings.HasSuffix(strings.ToLower(remotePath), ext) {
+			return method
+		}
+	}
+	return ""
+}
+
+// decompressReader 包装流式解压 reader，返回的 close 函数用于释放解压器
+func decompressReader(reader io.Reader, method string) (io.Reader, func(), error) {
+	switch method {
+	case "gzip":
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, func() { gz.Close() }, nil
+	case "zstd":
+		zr, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported post_process: %s", method)
+}
+
+// defaultLocalPath 根据远程路径生成默认的本地文件名
+func defaultLocalPath(remotePath string) string {
+	localPath := strings.TrimPrefix(strings.TrimPrefix(remotePath, "/"), "./")
+	return strings.ReplaceAll(localPath, "/", "_")
+}
+
+// strippedLocalPath 去掉远程路径开头的 n 级目录，返回当前目录下保留其余目录结构的本地相对路径
+func strippedLocalPath(remotePath string, n int) (string, error) {
+	cleaned := strings.TrimPrefix(path.Clean("/"+remotePath), "/")
+	components := strings.Split(cleaned, "/")
+	if cleaned == "" || n >= len(components) {
+		return "", fmt.Errorf("cannot strip %d path components from %s: it has only %d", n, remotePath, len(components))
+	}
+	return filepath.Join(components[n:]...), nil
+}
+
+// isLocalDirTarget 本地路径以路径分隔符结尾或是已存在的目录时，视为保存目录而不是文件名
+func isLocalDirTarget(localPath string) bool {
+	if strings.HasSuffix(localPath, "/") || strings.HasSuffix(localPath, string(filepath.Separator)) {
+		return true
+	}
+	info, err := os.Stat(localPath)
+	return err == nil && info.IsDir()
+}
+
+// downloadOptions 下载的可选行为
+type downloadOptions struct {
+	// SkipIfExists 本地文件已存在时跳过
+	SkipIfExists bool
+	// VerifyHash 下载后与服务器返回的 SHA256 比对，不一致则删除本地文件并返回错误
+	VerifyHash bool
+	// Progress 不为空时记录传输进度
+	Progress *transferProgress
+	// PostProcess 下载后的解压方式：auto、gzip、zstd，空或 none 表示不解压
+	PostProcess string
+	// ExpectedSHA256 写入本地文件内容的期望哈希，不一致则删除本地文件并返回错误
+	ExpectedSHA256 string
+	// StripComponents 未指定本地路径时去掉远程路径开头的目录级数，其余部分保留目录结构
+	StripComponents int
+}
+
+// copyBuffered 使用 DUFS_COPY_BUFFER 大小的缓冲区复制数据。
+// *os.File 实现了 ReaderFrom，直接交给 io.CopyBuffer 时会绕过传入的缓冲区，因此隐藏两端的可选接口
+func (s *MCPServer) copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	size := s.config.CopyBufferSize
+	if size <= 0 {
+		size = defaultCopyBufferSize
+	}
+	buf := make([]byte, size)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+}
+
+// createLocalFile 创建（或截断）下载的目标文件，父目录不存在时先逐级创建
+func createLocalFile(localPath string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create local directory: %v", err)
+	}
+	file, err := os.Create(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local file: %v", err)
+	}
+	return file, nil
+}
+
+// performDownload 下载单个文件
+func (s *MCPServer) performDownload(ctx context.Context, remotePath, localPath string, opts downloadOptions) (downloadOutcome, error) {
+	if remotePath == "" {
+		return downloadOutcome{}, fmt.Errorf("remote_path is required")
+	}
+
+	// 显式指定或者能从扩展名判断的压缩方式；auto 模式下仅靠 Content-Encoding 识别出的压缩在收到响应后判断
+	method := opts.PostProcess
+	if method == "auto" {
+		method = detectCompression("", remotePath)
+	} else if method == "none" {
+		method = ""
+	}
+
+	// 本地文件名由远程文件名生成时，只有真正解压了才去掉压缩后缀，保证文件名与内容一致
+	derivedName := localPath == ""
+	if localPath == "" {
+		if opts.StripComponents > 0 {
+			stripped, err := strippedLocalPath(remotePath, opts.StripComponents)
+			if err != nil {
+				return downloadOutcome{}, err
+			}
+			localPath = stripped
+		} else {
+			localPath = defaultLocalPath(remotePath)
+		}
+	} else if isLocalDirTarget(localPath) {
+		// 目标是目录时保存为目录下与远程文件同名的文件
+		if err := os.MkdirAll(localPath, 0755); err != nil {
+			return downloadOutcome{}, fmt.Errorf("failed to create local directory: %v", err)
+		}
+		name := path.Base(path.Clean("/" + remotePath))
+		if name == "/" {
+			return downloadOutcome{}, fmt.Errorf("remote_path %s has no file name", remotePath)
+		}
+		localPath = filepath.Join(localPath, name)
+		derivedName = true
+	}
+	decompressedPath := func(method string) string {
+		if ext, ok := preProcessors[method]; ok && derivedName {
+			return strings.TrimSuffix(localPath, ext)
+		}
+		return localPath
+	}
+	outcome := downloadOutcome{LocalPath: decompressedPath(method)}
+
+	// 跳过判断发生在请求之前，按预期的解压方式推断本地文件名
+	if opts.SkipIfExists {
+		if info, err := os.Stat(outcome.LocalPath); err == nil {
+			outcome.Skipped = true
+			outcome.SizeBytes = info.Size()
+			return outcome, nil
+		}
+	}
+
+	resp, err := s.client(ctx).makeRequest(ctx, "GET", remotePath, nil, nil)
+	if err != nil {
+		return outcome, fmt.Errorf("download failed: %v", err)
+	}
+	defer resp.Body.Close()
+	outcome.StatusCode = resp.StatusCode
+
+	if !isSuccessStatus(resp.StatusCode) {
+		body, _ := io.ReadAll(resp.Body)
+		return outcome, fmt.Errorf("download failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	// Transport 已经去掉的 gzip 传输压缩（resp.Uncompressed）与文件本身的压缩无关，不作为解压依据
+	if opts.PostProcess == "auto" && method == "" && !resp.Uncompressed {
+		method = detectCompression(resp.Header.Get("Content-Encoding"), "")
+	}
+
+	// 哈希针对服务器上的原始内容计算，解压以流的方式进行，不缓存整个文件
+	hasher := sha256.New()
+	raw := &transferProgress{}
+	rawReader := io.TeeReader(trackProgress(trackProgress(resp.Body, opts.Progress), raw), hasher)
+	buffered := bufio.NewReader(rawReader)
+	var reader io.Reader = buffered
+	// 服务器对 .gz 文件同时声明了 Content-Encoding: gzip 时，Transport 解压后得到的已是原始内容，不再重复解压
+	if method == "gzip" && resp.Uncompressed {
+		if magic, _ := buffered.Peek(2); !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			outcome.Decompressed = method
+			method = ""
+		}
+	}
+	if method != "" {
+		decompressed, closeReader, err := decompressReader(buffered, method)
+		if err != nil {
+			return outcome, fmt.Errorf("failed to %s-decompress %s: %v", method, remotePath, err)
+		}
+		defer closeReader()
+		reader = decompressed
+		outcome.Decompressed = method
+	}
+	outcome.LocalPath = decompressedPath(outcome.Decompressed)
+	localPath = outcome.LocalPath
+
+	file, err := createLocalFile(localPath)
+	if err != nil {
+		return outcome, err
+	}
+	defer file.Close()
+
+	if opts.Progress != nil {
+		opts.Progress.total.Store(resp.ContentLength)
+	}
+
+	// 校验 expected_sha256 时在写入的同时计算落盘内容的哈希
+	var sink io.Writer = file
+	var writtenHasher hash.Hash
+	if opts.ExpectedSHA256 != "" {
+		writtenHasher = sha256.New()
+		sink = io.MultiWriter(file, writtenHasher)
+	}
+
+	written, err := s.copyBuffered(sink, reader)
+	if err != nil {
+		return outcome, fmt.Errorf("failed to write file: %v", err)
+	}
+	// 解压器不一定读到 EOF，把剩余数据读完保证哈希覆盖完整内容
+	if _, err := io.Copy(io.Discard, rawReader); err != nil {
+		return outcome, fmt.Errorf("failed to read response: %v", err)
+	}
+	outcome.SizeBytes = written
+	outcome.CompressedBytes = raw.transferred.Load()
+	outcome.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+
+	if writtenHasher != nil {
+		outcome.WrittenSHA256 = hex.EncodeToString(writtenHasher.Sum(nil))
+		if !strings.EqualFold(opts.ExpectedSHA256, outcome.WrittenSHA256) {
+			file.Close()
+			os.Remove(localPath)
+			return outcome, fmt.Errorf("sha256 mismatch for %s: expected %s, actual %s", remotePath, opts.ExpectedSHA256, outcome.WrittenSHA256)
+		}
+	}
+
+	if opts.VerifyHash {
+		remoteHash, err := s.fetchRemoteHash(ctx, remotePath)
+		if err != nil {
+			return outcome, err
+		}
+		if !strings.EqualFold(remoteHash, outcome.SHA256) {
+			file.Close()
+			os.Remove(localPath)
+			return outcome, fmt.Errorf("hash mismatch for %s: remote %s, local %s", remotePath, remoteHash, outcome.SHA256)
+		}
+	}
+
+	return outcome, nil
+}
+
+func (s *MCPServer) handleJoinParts(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	manifestParam, hasManifest := args["manifest"].(map[string]interface{})
+	manifestPath, _ := args["manifest_path"].(string)
+
+	var raw []byte
+	switch {
+	case hasManifest && manifestPath != "":
+		return nil, fmt.Errorf("manifest and manifest_path cannot be used together")
+	case hasManifest:
+		var err error
+		if raw, err = json.Marshal(manifestParam); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %v", err)
+		}
+	case manifestPath != "":
+		var err error
+		if raw, err = s.readRemoteFile(ctx, manifestPath); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("manifest or manifest_path is required")
+	}
+
+	var manifest SplitManifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if len(manifest.Parts) == 0 {
+		return nil, fmt.Errorf("manifest has no parts")
+	}
+
+	localPath, _ := args["local_path"].(string)
+	if localPath == "" {
+		localPath = defaultLocalPath(manifest.RemotePath)
+	}
+
+	file, err := createLocalFile(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// 任一分片失败时删除不完整的本地文件
+	size, sum, err := s.downloadParts(ctx, manifest.Parts, file)
+	if err == nil && manifest.TotalSize > 0 && size != manifest.TotalSize {
+		err = fmt.Errorf("joined size mismatch: expected %d bytes, got %d bytes", manifest.TotalSize, size)
+	}
+	if err == nil && manifest.SHA256 != "" && !strings.EqualFold(sum, manifest.SHA256) {
+		err = fmt.Errorf("joined hash mismatch: expected %s, got %s", manifest.SHA256, sum)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(localPath)
+		return nil, err
+	}
+
+	return JoinPartsResult{
+		Success:   true,
+		Message:   fmt.Sprintf("Joined %d parts into %s", len(manifest.Parts), localPath),
+		LocalPath: localPath,
+		SizeBytes: size,
+		PartCount: len(manifest.Parts),
+		SHA256:    sum,
+	}, nil
+}
+
+// readRemoteFile 把远程文件读入内存，超过 DUFS_MAX_READ_SIZE 时返回错误
+func (s *MCPServer) readRemoteFile(ctx context.Context, remotePath string) ([]byte, error) {
+	resp, err := s.client(ctx).makeRequest(ctx, "GET", remotePath, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("download %s failed: %v", remotePath, err)
+	}
+	defer resp.Body.Close()
+
+	if !isSuccessStatus(resp.StatusCode) {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("download %s failed with status %d: %s", remotePath, resp.StatusCode, string(body))
+	}
+
+	maxSize := s.config.MaxReadSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxReadSize
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", remotePath, err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("file %s is larger than the %d byte limit", remotePath, maxSize)
+	}
+	return data, nil
+}
+
+// downloadParts 依次下载各分片并写入 w，校验每个分片的大小和哈希，返回写入的总字节数和整体 SHA256
+func (s *MCPServer) downloadParts(ctx context.Context, parts []SplitPart, w io.Writer) (int64, string, error) {
+	whole := sha256.New()
+	var total int64
+	for _, part := range parts {
+		if part.Path == "" {
+			return total, "", fmt.Errorf("manifest part is missing path")
+		}
+
+		resp, err := s.client(ctx).makeRequest(ctx, "GET", part.Path, nil, nil)
+		if err != nil {
+			return total, "", fmt.Errorf("download %s failed: %v", part.Path, err)
+		}
+
+		if !isSuccessStatus(resp.StatusCode) {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return total, "", fmt.Errorf("download %s failed with status %d: %s", part.Path, resp.StatusCode, string(body))
+		}
+
+		partHash := sha256.New()
+		written, err := s.copyBuffered(io.MultiWriter(w, whole, partHash), resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return total, "", fmt.Errorf("failed to write %s: %v", part.Path, err)
+		}
+		total += written
+
+		if written != part.Size {
+			return total, "", fmt.Errorf("part %s size mismatch: expected %d bytes, got %d bytes", part.Path, part.Size, written)
+		}
+		if sum := hex.EncodeToString(partHash.Sum(nil)); part.SHA256 != "" && !strings.EqualFold(sum, part.SHA256) {
+			return total, "", fmt.Errorf("part %s hash mismatch: expected %s, got %s", part.Path, part.SHA256, sum)
+		}
+	}
+	return total, hex.EncodeToString(whole.Sum(nil)), nil
+}
+
+func (s *MCPServer) handleDownloadBatch(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	filesParam, ok := args["files"].([]interface{})
+	if !ok || len(filesParam) == 0 {
+		return nil, fmt.Errorf("files is required and must contain at least one entry")
+	}
+
+	async, ok := args["async"].(bool)
+	if !ok {
+		async = true // 默认异步
+	}
+	defaultSkip, _ := args["skip_if_exists"].(bool)
+	defaultVerify, _ := args["verify_hash"].(bool)
+
+	tasks := make([]JobTask, 0, len(filesParam))
+	for _, item := range filesParam {
+		fileArgs, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid file entry: %+v", item)
+		}
+		remotePath, ok := fileArgs["remote_path"].(string)
+		if !ok || remotePath == "" {
+			return nil, fmt.Errorf("remote_path is required for each file")
+		}
+		localPath, _ := fileArgs["local_path"].(string)
+
+		skipIfExists, ok := fileArgs["skip_if_exists"].(bool)
+		if !ok {
+			skipIfExists = defaultSkip
+		}
+		verifyHash, ok := fileArgs["verify_hash"].(bool)
+		if !ok {
+			verifyHash = defaultVerify
+		}
+
+		tasks = append(tasks, JobTask{
+			Operation:           jobTypeDownload,
+			LocalPath:           localPath,
+			RequestedRemotePath: remotePath,
+			Status:              "pending",
+			DownloadOptions: downloadOptions{
+				SkipIfExists: skipIfExists,
+				VerifyHash:   verifyHash,
+			},
+			progress: &transferProgress{},
+		})
+	}
+
+	// 如果 async=false，同步下载所有文件，单个文件失败不影响其他文件
+	if !async {
+		results := make([]DownloadFileResult, 0, len(tasks))
+		allSuccess := true
+		for _, task := range tasks {
+			outcome, err := s.performDownload(ctx, task.RequestedRemotePath, task.LocalPath, task.DownloadOptions)
+			if err != nil {
+				allSuccess = false
+				results = append(results, DownloadFileResult{
+					RemotePath: task.RequestedRemotePath,
+					LocalPath:  outcome.LocalPath,
+					Success:    false,
+					Error:      err.Error(),
+					Status:     outcome.StatusCode,
+				})
+				continue
+			}
+
+			results = append(results, DownloadFileResult{
+				RemotePath: task.RequestedRemotePath,
+				LocalPath:  outcome.LocalPath,
+				Success:    true,
+				Skipped:    outcome.Skipped,
+				SizeBytes:  outcome.SizeBytes,
+				SHA256:     outcome.SHA256,
+				Status:     outcome.StatusCode,
+			})
+		}
+
+		return DownloadBatchResult{
+			Success: allSuccess,
+			Results: results,
+			Count:   len(results),
+		}, nil
+	}
+
+	// 异步下载
+	job, err := s.startJob(ctx, jobTypeDownload, "", tasks, s.toolTimeout("dufs_download_batch"))
+	if err != nil {
+		return nil, err
+	}
+
+	return JobStartedResult{
+		Success:   true,
+		JobID:     job.ID,
+		Status:    "pending",
+		TaskCount: len(tasks),
+	}, nil
+}
+
+func (s *MCPServer) handleDelete(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	path, ok := args["path"].(string)
+	if !ok {
+		return nil, fmt.Errorf("path is required")
+	}
+
+	recursive, _ := args["recursive"].(bool)
+	isDir, err := s.checkDeleteGuard(ctx, path, recursive, args["expected_count"])
+	if err != nil {
+		return nil, err
+	}
+
+	// 启用回收站时默认移动到回收站，回收站内的条目或 hard_delete=true 时直接删除
+	lockToken, _ := args["lock_token"].(string)
+	lockHeaders := lockTokenHeaders(lockToken)
+
+	hardDelete, _ := args["hard_delete"].(bool)
+	if s.config.TrashDir != "" && !hardDelete && !s.inTrash(path) {
+		trashPath, statusCode, err := s.moveToTrash(ctx, path, lockHeaders)
+		if err != nil {
+			return nil, fmt.Errorf("move to trash failed: %v", err)
+		}
+		return DeleteResult{
+			Success:   true,
+			Message:   fmt.Sprintf("Moved %s to trash, use dufs_restore to undo", path),
+			TrashPath: trashPath,
+			Status:    statusCode,
+		}, nil
+	}
+
+	// 部分 dufs 配置删除非空目录时返回 409，recursive 的目录改为从叶子开始逐个删除
+	if recursive && isDir {
+		deleted, err := s.deleteRemoteTree(ctx, path, lockHeaders)
+		if err != nil {
+			return nil, err
+		}
+		return DeleteResult{
+			Success:      true,
+			Message:      fmt.Sprintf("Deleted %s and %d entries below it", path, deleted-1),
+			Status:       http.StatusNoContent,
+			DeletedCount: deleted,
+		}, nil
+	}
+
+	statusCode, err := s.deleteRemote(ctx, path, lockHeaders)
+	if statusCode == http.StatusConflict {
+		return nil, fmt.Errorf("directory %s is not empty; use recursive=true", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return DeleteResult{
+		Success: true,
+		Message: fmt.Sprintf("Deleted %s successfully", path),
+		Status:  statusCode,
+	}, nil
+}
+
+// deleteRemote 发送一次 DELETE，返回 HTTP 状态码
+func (s *MCPServer) deleteRemote(ctx context.Context, remotePath string, headers map[string]string) (int, error) {
+	resp, err := s.client(ctx).makeRequest(ctx, "DELETE", remotePath, nil, headers)
+	if err != nil {
+		return 0, fmt.Errorf("delete failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if !isSuccessStatus(resp.StatusCode) {
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("delete failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	return resp.StatusCode, nil
+}
+
+// deleteRemoteTree 深度优先删除目录树：先删除文件和子目录，最后删除目录本身，返回删除的条目数（包括 dir）。
+// 出错时立即停止，已删除的条目不会恢复
+func (s *MCPServer) deleteRemoteTree(ctx context.Context, dir string, headers map[string]string) (int, error) {
+	entries, err := s.listRemoteDir(ctx, dir)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, entry := range entries {
+		child := path.Join(dir, entry.Name)
+		if entry.isDir() {
+			n, err := s.deleteRemoteTree(ctx, child, headers)
+			deleted += n
+			if err != nil {
+				return deleted, err
+			}
+			continue
+		}
+		if _, err := s.deleteRemote(ctx, child, headers); err != nil {
+			return deleted, fmt.Errorf("%s: %w", child, err)
+		}
+		s.debugf("Deleted %s", child)
+		deleted++
+	}
+
+	if _, err := s.deleteRemote(ctx, dir, headers); err != nil {
+		return deleted, fmt.Errorf("%s: %w", dir, err)
+	}
+	s.debugf("Deleted directory %s", dir)
+	return deleted + 1, nil
+}
+
+// debugf 在 DUFS_DEBUG=true 时输出 [debug] 日志
+func (s *MCPServer) debugf(format string, args ...interface{}) {
+	if s.config.Debug {
+		log.Printf("[debug] "+format, args...)
+	}
+}
+
+// checkDeleteGuard 删除目录前的安全检查：非空目录必须显式指定 recursive，
+// 传入 expected_count 时目录条目数超过该值则中止，防止误删整个目录树。返回目标是否为目录
+func (s *MCPServer) checkDeleteGuard(ctx context.Context, target string, recursive bool, expectedCount interface{}) (bool, error) {
+	isDir, err := s.isRemoteDir(ctx, target)
+	if err != nil {
+		return false, err
+	}
+	if !isDir {
+		return false, nil
+	}
+
+	entries, err := s.listRemoteDir(ctx, target)
+	if err != nil {
+		return true, err
+	}
+	if len(entries) > 0 && !recursive {
+		return true, fmt.Errorf("directory %s is not empty (%d entries); set recursive=true to confirm deletion", target, len(entries))
+	}
+	if expectedCount != nil {
+		expected, ok := expectedCount.(float64)
+		if !ok || expected < 0 {
+			return true, fmt.Errorf("expected_count must be a non-negative integer")
+		}
+		if len(entries) > int(expected) {
+			return true, fmt.Errorf("directory %s has %d entries, more than expected_count %d; deletion aborted", target, len(entries), int(expected))
+		}
+	}
+	return true, nil
+}
+
+// listSortFields dufs_list 的 sort_by 取值与 dufs sort 参数的对应关系
+var listSortFields = map[string]string{
+	"name":     "name",
+	"modified": "mtime",
+	"size":     "size",
+}
+
+// size_tier 分组的默认阈值
+const (
+	defaultSmallMaxBytes = 1 << 20
+	defaultLargeMinBytes = 100 << 20
+)
+
+// listGroupKey 返回 group_by 对应的分组函数
+func listGroupKey(groupBy string, args map[string]interface{}) (func(dufsEntry) string, error) {
+	switch groupBy {
+	case "extension":
+		return func(e dufsEntry) string {
+			if e.isDir() {
+				return ""
+			}
+			return strings.TrimPrefix(strings.ToLower(path.Ext(e.Name)), ".")
+		}, nil
+	case "date":
+		return func(e dufsEntry) string {
+			// dufs 的 mtime 为毫秒时间戳
+			return time.UnixMilli(e.Mtime).UTC().Format("2006-01-02")
+		}, nil
+	case "size_tier":
+		smallMax := int64(defaultSmallMaxBytes)
+		if v, ok := args["small_max_bytes"].(float64); ok {
+			smallMax = int64(v)
+		}
+		largeMin := int64(defaultLargeMinBytes)
+		if v, ok := args["large_min_bytes"].(float64); ok {
+			largeMin = int64(v)
+		}
+		if smallMax < 0 || largeMin <= smallMax {
+			return nil, fmt.Errorf("invalid size thresholds: small_max_bytes=%d, large_min_bytes=%d", smallMax, largeMin)
+		}
+		return func(e dufsEntry) string {
+			switch {
+			case e.Size <= smallMax:
+				return "small"
+			case e.Size >= largeMin:
+				return "large"
+			default:
+				return "medium"
+			}
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid group_by: %s", groupBy)
+	}
+}
+
+// fillEntryHashes 并发获取 dir 下各文件的 SHA256 并填入 entries，并发数受 DUFS_UPLOAD_CONCURRENCY 限制。
+// 任一文件失败时返回第一个错误
+func (s *MCPServer) fillEntryHashes(ctx context.Context, dir string, entries []dufsEntry) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, s.config.UploadConcurrency)
+	for i := range entries {
+		if entries[i].isDir() {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(entry *dufsEntry) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			hash, err := s.fetchRemoteHash(ctx, path.Join("/", dir, entry.Name))
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to hash %s: %v", entry.Name, err)
+				}
+				mu.Unlock()
+				return
+			}
+			entry.SHA256 = hash
+		}(&entries[i])
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// timeArg 解析可选的 RFC3339 时间参数，未传入时返回零值
+func timeArg(args map[string]interface{}, name string) (time.Time, error) {
+	v, _ := args[name].(string)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s, expected RFC3339 timestamp: %v", name, err)
+	}
+	return parsed, nil
+}
+
+// rankEntries 按与 query 的匹配程度（不区分大小写）为条目打分并稳定排序，分数相同时保持 dufs 返回的顺序。
+// 搜索结果的 Name 可能是相对路径，名称匹配针对最后一段
+func rankEntries(entries []dufsEntry, query string) {
+	q := strings.ToLower(query)
+	for i := range entries {
+		name := strings.ToLower(entries[i].Name)
+		base := path.Base(name)
+		baseStart := len(name) - len(base)
+
+		score := 0
+		start := -1
+		switch {
+		case base == q:
+			score, start = 3, baseStart
+		case strings.HasPrefix(base, q):
+			score, start = 2, baseStart
+		case strings.Contains(base, q):
+			score, start = 1, baseStart+strings.Index(base, q)
+		default:
+			start = strings.Index(name, q)
+		}
+
+		entries[i].Score = &score
+		if start >= 0 {
+			entries[i].MatchSpan = []int{start, start + len(q)}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return *entries[i].Score > *entries[j].Score
+	})
+}
+
+// defaultTotalsMaxDepth dufs_list annotate_totals 默认的递归深度上限
+const defaultTotalsMaxDepth = 10
+
+// fillDirTotals 为 entries 中的每个目录递归统计文件总大小和文件数，最多展开 maxDepth 层
+func (s *MCPServer) fillDirTotals(ctx context.Context, dir string, entries []dufsEntry, maxDepth int) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, s.config.UploadConcurrency)
+	for i := range entries {
+		if !entries[i].isDir() {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(entry *dufsEntry) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			size, count, truncated, err := s.remoteDirTotals(ctx, path.Join("/", dir, entry.Name), maxDepth)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to compute totals of %s: %v", entry.Name, err)
+				}
+				mu.Unlock()
+				return
+			}
+			entry.TotalSize = &size
+			entry.FileCount = &count
+			entry.TotalsTruncated = truncated
+		}(&entries[i])
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// humanSizeUnits humanSize 使用的 SI 单位，相邻单位相差 1000 倍
+var humanSizeUnits = []string{"KB", "MB", "GB", "TB"}
+
+// humanSize 把字节数转换为 SI 单位的可读形式，不足 1 KB 时为整数字节，例如 512 B、1.50 MB
+func humanSize(size int64) string {
+	if size < 1000 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	unit := ""
+	for _, unit = range humanSizeUnits {
+		value /= 1000
+		// 四舍五入后达到 1000.00 时进到下一个单位，避免出现 1000.00 KB
+		if math.Round(value*100) < 1000*100 {
+			break
+		}
+	}
+	return fmt.Sprintf("%.2f %s", value, unit)
+}
+
+// remoteDirTotals 递归统计远程目录下文件的总大小和数量，depth 为剩余可展开的层数
+func (s *MCPServer) remoteDirTotals(ctx context.Context, dir string, depth int) (int64, int, bool, error) {
+	entries, err := s.listRemoteDir(ctx, dir)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	var size int64
+	count := 0
+	truncated := false
+	for _, entry := range entries {
+		if !entry.isDir() {
+			size += entry.Size
+			count++
+			continue
+		}
+		if depth <= 1 {
+			truncated = true
+			continue
+		}
+		childSize, childCount, childTruncated, err := s.remoteDirTotals(ctx, path.Join(dir, entry.Name), depth-1)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		size += childSize
+		count += childCount
+		truncated = truncated || childTruncated
+	}
+	return size, count, truncated, nil
+}
+
+func (s *MCPServer) handleList(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	path := "/"
+	if p, ok := args["path"].(string); ok && p != "" {
+		path = p
+	}
+
+	query, _ := args["query"].(string)
+	format, _ := args["format"].(string)
+	sortBy, _ := args["sort_by"].(string)
+	sortOrder, _ := args["sort_order"].(string)
+	newestFirst, _ := args["newest_first"].(bool)
+
+	if newestFirst {
+		if sortBy != "" || sortOrder != "" {
+			return nil, fmt.Errorf("newest_first cannot be combined with sort_by or sort_order")
+		}
+		sortBy = "modified"
+		sortOrder = "desc"
+	}
+
+	withHashes, _ := args["with_hashes"].(bool)
+	if withHashes {
+		if format != "" && format != "json" {
+			return nil, fmt.Errorf("with_hashes requires format json")
+		}
+		format = "json"
+	}
+
+	modifiedAfter, err := timeArg(args, "modified_after")
+	if err != nil {
+		return nil, err
+	}
+	modifiedBefore, err := timeArg(args, "modified_before")
+	if err != nil {
+		return nil, err
+	}
+	filterByTime := !modifiedAfter.IsZero() || !modifiedBefore.IsZero()
+	if filterByTime {
+		if format != "" && format != "json" {
+			return nil, fmt.Errorf("modified_after and modified_before require format json")
+		}
+		format = "json"
+	}
+
+	// name_regex 无效时不报错，只在结果中说明并跳过名称过滤
+	var nameRegex *regexp.Regexp
+	var regexCompileError string
+	if pattern, _ := args["name_regex"].(string); pattern != "" {
+		if format != "" && format != "json" && format != "simple" {
+			return nil, fmt.Errorf("name_regex requires format json or simple")
+		}
+		if format == "" {
+			format = "json"
+		}
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			regexCompileError = err.Error()
+		} else {
+			nameRegex = compiled
+		}
+	}
+
+	rank, _ := args["rank"].(bool)
+	if rank {
+		if query == "" {
+			return nil, fmt.Errorf("rank requires query")
+		}
+		if sortBy != "" || sortOrder != "" {
+			return nil, fmt.Errorf("rank cannot be combined with sort_by or sort_order")
+		}
+		if format != "" && format != "json" && format != "simple" {
+			return nil, fmt.Errorf("rank requires format json or simple")
+		}
+		if format == "" {
+			format = "json"
+		}
+	}
+
+	minEntries := 0
+	if v, ok := args["min_entries"].(float64); ok {
+		if v < 1 {
+			return nil, fmt.Errorf("min_entries must be at least 1")
+		}
+		if format != "" && format != "json" && format != "simple" {
+			return nil, fmt.Errorf("min_entries requires format json or simple")
+		}
+		if format == "" {
+			format = "json"
+		}
+		minEntries = int(v)
+	}
+
+	annotateTotals, _ := args["annotate_totals"].(bool)
+	totalsMaxDepth := defaultTotalsMaxDepth
+	if annotateTotals {
+		if format != "" && format != "json" {
+			return nil, fmt.Errorf("annotate_totals requires format json")
+		}
+		format = "json"
+
+		if v, ok := args["totals_max_depth"].(float64); ok {
+			if v < 1 {
+				return nil, fmt.Errorf("totals_max_depth must be at least 1")
+			}
+			totalsMaxDepth = int(v)
+		}
+	}
+
+	humanReadable, _ := args["human_readable"].(bool)
+	if humanReadable {
+		if format != "" && format != "json" {
+			return nil, fmt.Errorf("human_readable requires format json")
+		}
+		format = "json"
+	}
+
+	groupBy, _ := args["group_by"].(string)
+	var groupKey func(dufsEntry) string
+	if groupBy != "" {
+		if format != "" && format != "json" {
+			return nil, fmt.Errorf("group_by requires format json")
+		}
+		format = "json"
+
+		var err error
+		groupKey, err = listGroupKey(groupBy, args)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// simple 从 JSON 列表中提取名称；raw 保留 dufs simple 格式的原始文本
+	namesOnly := false
+	switch format {
+	case "", "json":
+	case "simple":
+		namesOnly = true
+		format = "json"
+	case "raw":
+		format = "simple"
+	default:
+		return nil, fmt.Errorf("invalid format: %s", format)
+	}
+
+	// dufs 的排序参数：sort=name|mtime|size，order=asc|desc
+	// 格式参数（json、simple）是不带值的标志，单独放在查询串开头
+	params := url.Values{}
+	if query != "" {
+		params.Set("q", query)
+	}
+	if sortBy != "" {
+		sortParam, ok := listSortFields[sortBy]
+		if !ok {
+			return nil, fmt.Errorf("invalid sort_by: %s", sortBy)
+		}
+		params.Set("sort", sortParam)
+	}
+	if sortOrder != "" {
+		if sortOrder != "asc" && sortOrder != "desc" {
+			return nil, fmt.Errorf("invalid sort_order: %s", sortOrder)
+		}
+		params.Set("order", sortOrder)
+	}
+
+	resp, err := s.client(ctx).makeRequestQuery(ctx, "GET", path, joinQuery(format, params.Encode()), nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("list failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if !isSuccessStatus(resp.StatusCode) {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("list failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	var result interface{}
+	var filteredCount, totalCount *int
+	if groupKey != nil || withHashes || annotateTotals || humanReadable || filterByTime || namesOnly || rank || nameRegex != nil || minEntries > 0 {
+		var index struct {
+			Paths []dufsEntry `json:"paths"`
+		}
+		if err := json.Unmarshal(body, &index); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON: %v", err)
+		}
+		// 先按修改时间和名称过滤，后续的哈希和目录统计只针对保留的条目
+		if filterByTime || nameRegex != nil {
+			total := len(index.Paths)
+			kept := index.Paths[:0]
+			for _, entry := range index.Paths {
+				if nameRegex != nil && !nameRegex.MatchString(entry.Name) {
+					continue
+				}
+				modified := time.UnixMilli(entry.Mtime)
+				if !modifiedAfter.IsZero() && !modified.After(modifiedAfter) {
+					continue
+				}
+				if !modifiedBefore.IsZero() && !modified.Before(modifiedBefore) {
+					continue
+				}
+				kept = append(kept, entry)
+			}
+			index.Paths = kept
+			filtered := len(kept)
+			filteredCount, totalCount = &filtered, &total
+		}
+		if len(index.Paths) < minEntries {
+			return nil, &rpcError{
+				Code:    errCodeTooFewEntries,
+				Message: fmt.Sprintf("directory contains %d entries, expected at least %d", len(index.Paths), minEntries),
+			}
+		}
+		if rank {
+			rankEntries(index.Paths, query)
+		}
+		if withHashes {
+			if err := s.fillEntryHashes(ctx, path, index.Paths); err != nil {
+				return nil, err
+			}
+		}
+		if annotateTotals {
+			if err := s.fillDirTotals(ctx, path, index.Paths, totalsMaxDepth); err != nil {
+				return nil, err
+			}
+		}
+		// 目录的 size 不是字节数，只转换文件的 size 和目录统计出的 total_size
+		if humanReadable {
+			for i := range index.Paths {
+				entry := &index.Paths[i]
+				if !entry.isDir() {
+					entry.SizeHuman = humanSize(entry.Size)
+				}
+				if entry.TotalSize != nil {
+					entry.TotalSizeHuman = humanSize(*entry.TotalSize)
+				}
+			}
+		}
+
+		if namesOnly {
+			names := make([]string, 0, len(index.Paths))
+			for _, entry := range index.Paths {
+				names = append(names, entry.Name)
+			}
+			result = names
+		} else if groupKey != nil {
+			// 分组内保持 dufs 返回的顺序，因此 sort_by 对分组结果同样有效
+			groups := make(map[string][]dufsEntry)
+			for _, entry := range index.Paths {
+				key := groupKey(entry)
+				groups[key] = append(groups[key], entry)
+			}
+			result = groups
+		} else {
+			// 保留 dufs 返回的其他字段，只替换 paths
+			var listing map[string]interface{}
+			if err := json.Unmarshal(body, &listing); err != nil {
+				return nil, fmt.Errorf("failed to parse JSON: %v", err)
+			}
+			listing["paths"] = index.Paths
+			result = listing
+		}
+	} else if format == "json" {
+		if err := json.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON: %v", err)
+		}
+	} else {
+		result = string(body)
+	}
+
+	return ListResult{
+		Success:           true,
+		Data:              result,
+		Status:            resp.StatusCode,
+		FilteredCount:     filteredCount,
+		TotalCount:        totalCount,
+		RegexCompileError: regexCompileError,
+	}, nil
+}
+
+func (s *MCPServer) handleCreateDir(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	path, ok := args["path"].(string)
+	if !ok {
+		return nil, fmt.Errorf("path is required")
+	}
+
+	if parents, _ := args["parents"].(bool); parents {
+		created, existed, err := s.createRemoteDirs(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		return CreateDirResult{
+			Success:        true,
+			AlreadyExisted: len(created) == 0,
+			Message:        fmt.Sprintf("Created %d directories, %d already existed", len(created), len(existed)),
+			Status:         http.StatusOK,
+			Created:        created,
+			Existed:        existed,
+		}, nil
+	}
+
+	// 不创建上级目录：先确认上级目录存在，给出明确的错误而不是依赖服务器的行为
+	if parent := parentRemoteDir(path); parent != "/" {
+		exists, err := s.remoteExists(ctx, parent)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("parent directory %s does not exist, use parents=true to create it", parent)
+		}
+	}
+
+	created, status, err := s.mkcolRemote(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !created {
+		// 目录已存在，对调用方来说可以视为成功
+		return CreateDirResult{
+			Success:        true,
+			AlreadyExisted: true,
+			Message:        fmt.Sprintf("Directory %s already exists", path),
+			Status:         status,
+		}, nil
+	}
+
+	return CreateDirResult{
+		Success:        true,
+		AlreadyExisted: false,
+		Message:        fmt.Sprintf("Directory %s created successfully", path),
+		Status:         status,
+	}, nil
+}
+
+func (s *MCPServer) handleMove(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	source, ok := args["source"].(string)
+	if !ok {
+		return nil, fmt.Errorf("source is required")
+	}
+	destination, ok := args["destination"].(string)
+	if !ok {
+		return nil, fmt.Errorf("destination is required")
+	}
+
+	// 先确认源路径存在，避免把 MOVE 返回的 404 直接交给调用方
+	exists, err := s.remoteExists(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, &rpcError{
+			Code:    errCodeNotFound,
+			Message: fmt.Sprintf("source path not found: %s", source),
+		}
+	}
+
+	lockToken, _ := args["lock_token"].(string)
+	statusCode, err := s.moveRemoteWithHeaders(ctx, source, destination, lockTokenHeaders(lockToken))
+	if err != nil {
+		return nil, err
+	}
+
+	return MoveResult{
+		Success: true,
+		Message: fmt.Sprintf("Moved %s to %s successfully", source, destination),
+		Status:  statusCode,
+	}, nil
+}
+
+// moveRemote 通过 WebDAV MOVE 移动远程文件或目录，返回 HTTP 状态码
+func (s *MCPServer) moveRemote(ctx context.Context, source, destination string) (int, error) {
+	return s.moveRemoteWithHeaders(ctx, source, destination, nil)
+}
+
+// moveRemoteWithHeaders 与 moveRemote 相同，额外附加 extra 中的请求头（如 Overwrite）
+func (s *MCPServer) moveRemoteWithHeaders(ctx context.Context, source, destination string, extra map[string]string) (int, error) {
+	headers := map[string]string{
+		"Destination": s.client(ctx).remoteURL(destination, ""),
+	}
+	for k, v := range extra {
+		headers[k] = v
+	}
+
+	resp, err := s.client(ctx).makeRequest(ctx, "MOVE", source, nil, headers)
+	if err != nil {
+		return 0, fmt.Errorf("move failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if !isSuccessStatus(resp.StatusCode) {
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("move failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return resp.StatusCode, nil
+}
+
+// defaultLockTimeoutSeconds dufs_lock 默认的锁超时时间
+const defaultLockTimeoutSeconds = 600
+
+// lockRequestBody LOCK 请求体：排他写锁
+const lockRequestBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype><D:owner>%s</D:owner></D:lockinfo>`
+
+// lockTokenHeaders 把锁令牌转换为 WebDAV If 请求头，令牌为空时返回 nil。
+// 令牌可以带或不带尖括号
+func lockTokenHeaders(token string) map[string]string {
+	token = strings.Trim(strings.TrimSpace(token), "<>")
+	if token == "" {
+		return nil
+	}
+	return map[string]string{"If": "(<" + token + ">)"}
+}
+
+// errLockUnsupported 服务器不支持 LOCK/UNLOCK（dufs 未开启上传权限或其他 WebDAV 实现未实现锁）
+func errLockUnsupported(method string, status int) error {
+	return fmt.Errorf("server does not support WebDAV %s (status %d)", method, status)
+}
+
+func (s *MCPServer) handleLock(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	path, ok := args["path"].(string)
+	if !ok || path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	timeoutSeconds := defaultLockTimeoutSeconds
+	if v, ok := args["timeout_seconds"].(float64); ok {
+		if v < 1 {
+			return nil, fmt.Errorf("timeout_seconds must be at least 1")
+		}
+		timeoutSeconds = int(v)
+	}
+	owner, _ := args["owner"].(string)
+	if owner == "" {
+		owner = "dufs-mcp-server"
+	}
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(owner))
+
+	headers := map[string]string{
+		"Content-Type": "application/xml; charset=utf-8",
+		"Timeout":      fmt.Sprintf("Second-%d", timeoutSeconds),
+		"Depth":        "0",
+	}
+	resp, err := s.client(ctx).makeRequest(ctx, "LOCK", path, strings.NewReader(fmt.Sprintf(lockRequestBody, escaped.String())), headers)
+	if err != nil {
+		return nil, fmt.Errorf("lock failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented:
+		return nil, errLockUnsupported("LOCK", resp.StatusCode)
+	case resp.StatusCode == http.StatusLocked:
+		return nil, fmt.Errorf("%s is already locked", path)
+	case !isSuccessStatus(resp.StatusCode):
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("lock failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	token := strings.Trim(strings.TrimSpace(resp.Header.Get("Lock-Token")), "<>")
+	if token == "" {
+		return nil, fmt.Errorf("lock response has no Lock-Token header")
+	}
+
+	return LockResult{
+		Success:        true,
+		Path:           path,
+		Token:          token,
+		TimeoutSeconds: timeoutSeconds,
+		Status:         resp.StatusCode,
+	}, nil
+}
+
+func (s *MCPServer) handleUnlock(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	path, ok := args["path"].(string)
+	if !ok || path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	token, _ := args["lock_token"].(string)
+	token = strings.Trim(strings.TrimSpace(token), "<>")
+	if token == "" {
+		return nil, fmt.Errorf("lock_token is required")
+	}
+
+	resp, err := s.client(ctx).makeRequest(ctx, "UNLOCK", path, nil, map[string]string{"Lock-Token": "<" + token + ">"})
+	if err != nil {
+		return nil, fmt.Errorf("unlock failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		return nil, errLockUnsupported("UNLOCK", resp.StatusCode)
+	}
+	if !isSuccessStatus(resp.StatusCode) {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unlock failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return UnlockResult{
+		Success: true,
+		Message: fmt.Sprintf("Unlocked %s", path),
+		Status:  resp.StatusCode,
+	}, nil
+}
+
+func (s *MCPServer) handleMoveTree(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	sourceDir, ok := args["source_dir"].(string)
+	if !ok || sourceDir == "" {
+		return nil, fmt.Errorf("source_dir is required")
+	}
+	destinationDir, ok := args["destination_dir"].(string)
+	if !ok || destinationDir == "" {
+		return nil, fmt.Errorf("destination_dir is required")
+	}
+	dryRun, _ := args["dry_run"].(bool)
+
+	sourceDir = path.Clean("/" + sourceDir)
+	destinationDir = path.Clean("/" + destinationDir)
+	if destinationDir == sourceDir || strings.HasPrefix(destinationDir, strings.TrimSuffix(sourceDir, "/")+"/") {
+		return nil, fmt.Errorf("destination_dir %s must not be inside source_dir %s", destinationDir, sourceDir)
+	}
+
+	files, err := s.walkRemoteFiles(ctx, sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	relPaths := make([]string, 0, len(files))
+	for rel := range files {
+		relPaths = append(relPaths, rel)
+	}
+	sort.Strings(relPaths)
+
+	result := MoveTreeResult{
+		Success: true,
+		DryRun:  dryRun,
+		Results: make([]MoveTreeItem, 0, len(relPaths)),
+		Count:   len(relPaths),
+	}
+
+	// 同一目录下的多个文件只需创建一次父目录
+	createdDirs := make(map[string]bool)
+	for _, rel := range relPaths {
+		item := MoveTreeItem{
+			Source:      path.Join(sourceDir, rel),
+			Destination: path.Join(destinationDir, rel),
+			Success:     true,
+		}
+		if !dryRun {
+			err := func() error {
+				parent := path.Dir(item.Destination)
+				if !createdDirs[parent] {
+					if err := s.ensureRemoteDirectories(ctx, item.Destination); err != nil {
+						return err
+					}
+					createdDirs[parent] = true
+				}
+				_, err := s.moveRemote(ctx, item.Source, item.Destination)
+				return err
+			}()
+			if err != nil {
+				item.Success = false
+				item.Error = err.Error()
+				result.Success = false
+				result.FailedCount++
+			}
+		}
+		result.Results = append(result.Results, item)
+	}
+
+	return result, nil
+}
+
+// defaultMoveBatchConcurrency dufs_move_batch 默认的并发数
+const defaultMoveBatchConcurrency = 4
+
+func (s *MCPServer) handleMoveBatch(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	rawMoves, ok := args["moves"].([]interface{})
+	if !ok || len(rawMoves) == 0 {
+		return nil, fmt.Errorf("moves is required")
+	}
+	results := make([]MoveBatchItem, len(rawMoves))
+	for i, raw := range rawMoves {
+		move, _ := raw.(map[string]interface{})
+		source, _ := move["source"].(string)
+		destination, _ := move["destination"].(string)
+		if source == "" || destination == "" {
+			return nil, fmt.Errorf("moves[%d]: source and destination are required", i)
+		}
+		results[i] = MoveBatchItem{Source: source, Destination: destination}
+	}
+
+	continueOnError := true
+	if v, ok := args["continue_on_error"].(bool); ok {
+		continueOnError = v
+	}
+	concurrency := defaultMoveBatchConcurrency
+	if v, ok := args["concurrency"].(float64); ok {
+		if v < 1 {
+			return nil, fmt.Errorf("concurrency must be at least 1")
+		}
+		concurrency = int(v)
+	}
+
+	// 先按顺序创建所有目标的上级目录，避免并发的移动重复创建同一目录；创建失败的目录只影响以它为目标的移动
+	parentErrors := make(map[string]error)
+	if createParent, _ := args["create_parent"].(bool); createParent {
+		for _, item := range results {
+			parent := parentRemoteDir(item.Destination)
+			if _, done := parentErrors[parent]; done || parent == "/" {
+				continue
+			}
+			_, _, parentErrors[parent] = s.createRemoteDirs(ctx, parent)
+		}
+	}
+
+	// continue_on_error=false 时第一个失败取消其余尚未开始的移动，已在进行中的移动不会中断
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i := range results {
+		if !continueOnError && failed.Load() {
+			results[i].Skipped = true
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(item *MoveBatchItem) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if !continueOnError && failed.Load() {
+				item.Skipped = true
+				return
+			}
+			err := parentErrors[parentRemoteDir(item.Destination)]
+			if err == nil {
+				item.HTTPStatus, err = s.moveRemote(ctx, item.Source, item.Destination)
+			}
+			if err != nil {
+				item.Error = err.Error()
+				failed.Store(true)
+				return
+			}
+			item.Success = true
+		}(&results[i])
+	}
+	wg.Wait()
+
+	result := MoveBatchResult{Results: results}
+	for _, item := range results {
+		switch {
+		case item.Success:
+			result.Succeeded++
+		case item.Skipped:
+			result.Skipped++
+		default:
+			result.Failed++
+		}
+	}
+	result.Success = result.Failed == 0 && result.Skipped == 0
+	return result, nil
+}
+
+// planStepTypes dufs_exec_plan 支持的步骤类型
+var planStepTypes = []string{"mkdir", "upload", "move", "delete"}
+
+// runPlanStep 把 dufs_exec_plan 的一个步骤交给对应工具的处理函数执行
+func (s *MCPServer) runPlanStep(ctx context.Context, stepType string, args map[string]interface{}) (interface{}, error) {
+	switch stepType {
+	case "mkdir":
+		return s.handleCreateDir(ctx, args)
+	case "upload":
+		return s.handleUpload(ctx, args)
+	case "move":
+		return s.handleMove(ctx, args)
+	case "delete":
+		return s.handleDelete(ctx, args)
+	default:
+		return nil, fmt.Errorf("unknown step type: %s", stepType)
+	}
+}
+
+// planTaskPath 从步骤参数中取出用于任务状态展示的远程路径
+func planTaskPath(args map[string]interface{}) string {
+	for _, name := range []string{"path", "remote_path", "source"} {
+		if v, _ := args[name].(string); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (s *MCPServer) handleExecPlan(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	rawSteps, ok := args["steps"].([]interface{})
+	if !ok || len(rawSteps) == 0 {
+		return nil, fmt.Errorf("steps is required")
+	}
+	// 执行前先校验所有步骤的结构，参数内容由各工具在执行时校验
+	types := make([]string, len(rawSteps))
+	stepArgs := make([]map[string]interface{}, len(rawSteps))
+	for i, raw := range rawSteps {
+		step, _ := raw.(map[string]interface{})
+		stepType, _ := step["type"].(string)
+		if !slices.Contains(planStepTypes, stepType) {
+			return nil, fmt.Errorf("steps[%d]: invalid type %q, expected one of %s", i, stepType, strings.Join(planStepTypes, ", "))
+		}
+		arguments, ok := step["arguments"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("steps[%d]: arguments is required", i)
+		}
+		if async, _ := arguments["async"].(bool); async {
+			return nil, fmt.Errorf("steps[%d]: async is not supported inside a plan", i)
+		}
+		types[i] = stepType
+		stepArgs[i] = arguments
+	}
+
+	stopOnError := true
+	if v, ok := args["stop_on_error"].(bool); ok {
+		stopOnError = v
+	}
+
+	if async, _ := args["async"].(bool); async {
+		tasks := make([]JobTask, len(rawSteps))
+		for i := range tasks {
+			localPath, _ := stepArgs[i]["local_path"].(string)
+			tasks[i] = JobTask{
+				Operation:           jobOpPlanStep,
+				StepType:            types[i],
+				StepArgs:            stepArgs[i],
+				LocalPath:           localPath,
+				RequestedRemotePath: planTaskPath(stepArgs[i]),
+				Status:              "pending",
+				ContinueOnError:     !stopOnError,
+				progress:            &transferProgress{},
+			}
+		}
+		label, _ := args["label"].(string)
+		labelCollision := s.jobLabelExists(label)
+		job, err := s.startJob(ctx, jobTypePlan, label, tasks, s.toolTimeout("dufs_exec_plan"))
+		if err != nil {
+			return nil, err
+		}
+		return JobStartedResult{
+			Success:        true,
+			JobID:          job.ID,
+			Status:         "pending",
+			TaskCount:      len(tasks),
+			Label:          label,
+			LabelCollision: labelCollision,
+		}, nil
+	}
+
+	result := ExecPlanResult{Results: make([]PlanStepResult, len(rawSteps))}
+	for i := range rawSteps {
+		step := &result.Results[i]
+		step.Index = i
+		step.Type = types[i]
+		if stopOnError && result.Failed > 0 {
+			step.Status = "skipped"
+			result.Skipped++
+			continue
+		}
+
+		stepResult, err := s.runPlanStep(ctx, types[i], stepArgs[i])
+		if err != nil {
+			step.Status = "failed"
+			step.Error = err.Error()
+			result.Failed++
+			continue
+		}
+		step.Status = "succeeded"
+		step.Result = stepResult
+		result.Succeeded++
+	}
+	result.Success = result.Failed == 0
+	return result, nil
+}
+
+// remoteExists 通过 HEAD 请求判断远程路径是否存在
+func (s *MCPServer) remoteExists(ctx context.Context, remotePath string) (bool, error) {
+	resp, err := s.client(ctx).makeRequest(ctx, "HEAD", remotePath, nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("head request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if !isSuccessStatus(resp.StatusCode) {
+		return false, fmt.Errorf("head request failed with status %d", resp.StatusCode)
+	}
+	return true, nil
+}
+
+// trashRoot 返回规范化后的回收站目录（以 / 开头、不以 / 结尾）
+func (s *MCPServer) trashRoot() string {
+	return path.Clean("/" + s.config.TrashDir)
+}
+
+// inTrash 判断路径是否位于回收站内
+func (s *MCPServer) inTrash(remotePath string) bool {
+	root := s.trashRoot()
+	cleaned := path.Clean("/" + remotePath)
+	return cleaned == root || strings.HasPrefix(cleaned, root+"/")
+}
+
+// moveToTrash 把目标移动到回收站中以删除时间命名的目录下，并保留原始路径结构，
+// 例如 /docs/a.txt 会移动到 /.trash/20240101-150405/docs/a.txt，便于 dufs_restore 还原。
+// 同一秒内的目标已存在时在时间目录后追加 -1、-2 等后缀
+func (s *MCPServer) moveToTrash(ctx context.Context, remotePath string, extra map[string]string) (string, int, error) {
+	cleaned := path.Clean("/" + remotePath)
+	stamp := time.Now().Format("20060102-150405")
+
+	trashPath := path.Join(s.trashRoot(), stamp, cleaned)
+	for suffix := 1; ; suffix++ {
+		exists, err := s.remoteExists(ctx, trashPath)
+		if err != nil {
+			return "", 0, err
+		}
+		if !exists {
+			break
+		}
+		trashPath = path.Join(s.trashRoot(), fmt.Sprintf("%s-%d", stamp, suffix), cleaned)
+	}
+
+	if err := s.ensureRemoteDirectories(ctx, trashPath); err != nil {
+		return "", 0, err
+	}
+	statusCode, err := s.moveRemoteWithHeaders(ctx, cleaned, trashPath, extra)
+	if err != nil {
+		return "", statusCode, err
+	}
+	return trashPath, statusCode, nil
+}
+
+func (s *MCPServer) handleRestore(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	trashPath, ok := args["trash_path"].(string)
+	if !ok || trashPath == "" {
+		return nil, fmt.Errorf("trash_path is required")
+	}
+	if s.config.TrashDir == "" {
+		return nil, fmt.Errorf("trash is not enabled, set DUFS_TRASH_DIR")
+	}
+
+	// 回收站路径的结构为 <trash>/<时间目录>/<原始路径>
+	cleaned := path.Clean("/" + trashPath)
+	rel := strings.TrimPrefix(cleaned, s.trashRoot()+"/")
+	if !s.inTrash(cleaned) || rel == cleaned {
+		return nil, fmt.Errorf("%s is not inside the trash directory %s", trashPath, s.trashRoot())
+	}
+	parts := strings.SplitN(rel, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("%s is a trash folder, not a deleted item", trashPath)
+	}
+
+	destination := "/" + parts[1]
+	if target, _ := args["remote_path"].(string); target != "" {
+		destination = target
+	}
+
+	exists, err := s.remoteExists(ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("%s already exists, pass remote_path to restore elsewhere", destination)
+	}
+
+	if err := s.ensureRemoteDirectories(ctx, destination); err != nil {
+		return nil, err
+	}
+	statusCode, err := s.moveRemote(ctx, cleaned, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	return RestoreResult{
+		Success:      true,
+		Message:      fmt.Sprintf("Restored %s to %s successfully", trashPath, destination),
+		RestoredPath: destination,
+		Status:       statusCode,
+	}, nil
+}
+
+func (s *MCPServer) handleGetHash(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	path, ok := args["path"].(string)
+	if !ok {
+		return nil, fmt.Errorf("path is required")
+	}
+
+	hash, err := s.fetchRemoteHash(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return HashResult{
+		Success: true,
+		Hash:    hash,
+		Path:    path,
+	}, nil
+}
+
+func (s *MCPServer) handleGetMultipleHashes(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	pathsParam, ok := args["paths"].([]interface{})
+	if !ok || len(pathsParam) == 0 {
+		return nil, fmt.Errorf("paths is required and must contain at least one entry")
+	}
+	paths := make([]string, 0, len(pathsParam))
+	for _, item := range pathsParam {
+		p, ok := item.(string)
+		if !ok || p == "" {
+			return nil, fmt.Errorf("invalid path entry: %+v", item)
+		}
+		paths = append(paths, p)
+	}
+
+	expected := make(map[string]string)
+	if expectedParam, ok := args["expected"].(map[string]interface{}); ok {
+		for p, v := range expectedParam {
+			hash, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid expected hash for %s: %+v", p, v)
+			}
+			expected[p] = hash
+		}
+	}
+
+	concurrency := s.config.UploadConcurrency
+	if v, ok := args["concurrency"].(float64); ok {
+		if v < 1 {
+			return nil, fmt.Errorf("concurrency must be at least 1")
+		}
+		concurrency = int(v)
+	}
+
+	// 单个路径失败（例如 404）只记录在该路径的结果中，不影响其他路径
+	results := make([]PathHashResult, len(paths))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i, p := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, p string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result := PathHashResult{Path: p}
+			hash, err := s.fetchRemoteHash(ctx, p)
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Hash = hash
+				if want, ok := expected[p]; ok {
+					match := strings.EqualFold(hash, want)
+					result.Match = &match
+				}
+			}
+			results[i] = result
+		}(i, p)
+	}
+	wg.Wait()
+
+	failed, mismatched := 0, 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		} else if result.Match != nil && !*result.Match {
+			mismatched++
+		}
+	}
+
+	return MultipleHashesResult{
+		Success:         failed == 0 && mismatched == 0,
+		Results:         results,
+		Count:           len(results),
+		FailedCount:     failed,
+		MismatchedCount: mismatched,
+	}, nil
+}
+
+// defaultPreviewBytes dufs_preview 默认预览的字节数
+const defaultPreviewBytes = 4 << 10
+
+func (s *MCPServer) handlePreview(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	path, ok := args["path"].(string)
+	if !ok || path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+
+	maxSize := s.config.MaxReadSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxReadSize
+	}
+	limit := int64(defaultPreviewBytes)
+	if v, ok := args["bytes"].(float64); ok {
+		if v < 1 {
+			return nil, fmt.Errorf("bytes must be positive")
+		}
+		limit = min(int64(v), maxSize)
+	}
+
+	resp, err := s.client(ctx).makeRequest(ctx, "GET", path, nil, map[string]string{
+		"Range": fmt.Sprintf("bytes=0-%d", limit-1),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("preview failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// 416 表示文件为空
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable && !isSuccessStatus(resp.StatusCode) {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("preview failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	// 服务器忽略 Range 时返回 200 和完整内容，只读取需要的部分
+	var data []byte
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		data, err = io.ReadAll(io.LimitReader(resp.Body, limit))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %v", err)
+		}
+	}
+
+	totalSize := int64(-1)
+	switch resp.StatusCode {
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		totalSize = contentRangeTotal(resp.Header.Get("Content-Range"))
+	default:
+		totalSize = resp.ContentLength
+	}
+
+	result := PreviewResult{
+		Success:      true,
+		Path:         path,
+		ContentType:  resp.Header.Get("Content-Type"),
+		PreviewBytes: len(data),
+		TotalSize:    totalSize,
+		Status:       resp.StatusCode,
+	}
+	if result.ContentType == "" {
+		result.ContentType = http.DetectContentType(data)
+	}
+	if totalSize >= 0 {
+		result.Truncated = int64(len(data)) < totalSize
+	} else {
+		result.Truncated = int64(len(data)) == limit
+	}
+
+	if text, ok := textPreview(data, result.Truncated); ok {
+		result.IsText = true
+		result.Encoding = "text"
+		result.Preview = text
+	} else {
+		result.Encoding = "base64"
+		result.Preview = base64.StdEncoding.EncodeToString(data)
+	}
+
+	return result, nil
+}
+
+// contentRangeTotal 从 "bytes 0-4095/12345" 或 "bytes */12345" 中取出总大小，未知时返回 -1
+func contentRangeTotal(contentRange string) int64 {
+	_, total, ok := strings.Cut(contentRange, "/")
+	if !ok {
+		return -1
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// textPreview 内容不含 NUL 且是合法的 UTF-8 时视为文本并返回对应的字符串。
+// 截断的内容末尾可能是不完整的多字节字符，会被去掉
+func textPreview(data []byte, truncated bool) (string, bool) {
+	if bytes.IndexByte(data, 0) >= 0 {
+		return "", false
+	}
+	if truncated {
+		for i := 0; i < utf8.UTFMax-1 && len(data) > 0; i++ {
+			if r, _ := utf8.DecodeLastRune(data); r != utf8.RuneError {
+				break
+			}
+			data = data[:len(data)-1]
+		}
+	}
+	if !utf8.Valid(data) {
+		return "", false
+	}
+	return string(data), true
+}
+
+// fetchRemoteHash 通过 dufs 的 ?hash 接口获取远程文件的 SHA256
+func (s *MCPServer) fetchRemoteHash(ctx context.Context, path string) (string, error) {
+	resp, err := s.client(ctx).makeRequestQuery(ctx, "GET", path, "hash", nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("get hash failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if !isSuccessStatus(resp.StatusCode) {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("get hash failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	hash, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read hash: %v", err)
+	}
+
+	return strings.TrimSpace(string(hash)), nil
+}
+
+// dufsEntry dufs 目录列表（?json）中的一项
+type dufsEntry struct {
+	PathType string `json:"path_type"`
+	Name     string `json:"name"`
+	Mtime    int64  `json:"mtime"`
+	Size     int64  `json:"size"`
+	// SHA256 仅在 dufs_list 指定 with_hashes 时由本服务填充
+	SHA256 string `json:"sha256,omitempty"`
+	// 以下字段仅在 dufs_list 指定 annotate_totals 时为目录填充：递归统计的文件总大小和文件数，
+	// TotalsTruncated 表示达到深度上限，更深层的内容没有计入
+	TotalSize       *int64 `json:"total_size,omitempty"`
+	FileCount       *int   `json:"file_count,omitempty"`
+	TotalsTruncated bool   `json:"totals_truncated,omitempty"`
+	// SizeHuman 和 TotalSizeHuman 仅在 dufs_list 指定 human_readable 时填充：Size（仅文件）和 TotalSize 的可读形式
+	SizeHuman      string `json:"size_human,omitempty"`
+	TotalSizeHuman string `json:"total_size_human,omitempty"`
+	// Score 和 MatchSpan 仅在 dufs_list 指定 rank 时填充：匹配程度（3 名称完全一致，2 名称前缀，1 名称包含，0 仅路径包含或不匹配）
+	// 以及查询在 Name 中匹配到的字节区间 [start, end)
+	Score     *int  `json:"score,omitempty"`
+	MatchSpan []int `json:"match_span,omitempty"`
+}
+
+// isDir path_type 为 Dir 或 SymlinkDir 时表示目录
+func (e dufsEntry) isDir() bool {
+	return strings.HasSuffix(e.PathType, "Dir")
+}
+
+// listRemoteDir 获取远程目录下的直接子项
+func (s *MCPServer) listRemoteDir(ctx context.Context, dir string) ([]dufsEntry, error) {
+	resp, err := s.client(ctx).makeRequestQuery(ctx, "GET", strings.TrimSuffix(dir, "/")+"/", "json", nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("list failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if !isSuccessStatus(resp.StatusCode) {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("list %s failed with status %d: %s", dir, resp.StatusCode, string(body))
+	}
+
+	var index struct {
+		Paths []dufsEntry `json:"paths"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to parse listing of %s: %v", dir, err)
+	}
+	return index.Paths, nil
+}
+
+// isRemoteDir 通过父目录的列表判断远程路径是否为目录，路径不存在时返回错误
+func (s *MCPServer) isRemoteDir(ctx context.Context, remotePath string) (bool, error) {
+	cleaned := path.Clean("/" + remotePath)
+	if cleaned == "/" {
+		return true, nil
+	}
+
+	entries, err := s.listRemoteDir(ctx, path.Dir(cleaned))
+	if err != nil {
+		return false, err
+	}
+	name := path.Base(cleaned)
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry.isDir(), nil
+		}
+	}
+	return false, fmt.Errorf("remote path %s not found", remotePath)
+}
+
+// walkRemoteFiles 递归列出远程目录下的所有文件，返回相对路径到大小的映射
+func (s *MCPServer) walkRemoteFiles(ctx context.Context, root string) (map[string]int64, error) {
+	files := make(map[string]int64)
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		entries, err := s.listRemoteDir(ctx, path.Join(root, rel))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			child := path.Join(rel, entry.Name)
+			if entry.isDir() {
+				if err := walk(child); err != nil {
+					return err
+				}
+				continue
+			}
+			files[child] = entry.Size
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// listingSnapshot 保存在本地的目录列表快照
+type listingSnapshot struct {
+	Server    string                   `json:"server"`
+	Path      string                   `json:"path"`
+	Recursive bool                     `json:"recursive"`
+	TakenAt   time.Time                `json:"taken_at"`
+	Entries   map[string]SnapshotEntry `json:"entries"`
+}
+
+func (s *MCPServer) handleDiffSnapshot(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	dir, ok := args["path"].(string)
+	if !ok || dir == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	dir = path.Clean("/" + dir)
+	recursive, _ := args["recursive"].(bool)
+	update, ok := args["update"].(bool)
+	if !ok {
+		update = true
+	}
+
+	current := listingSnapshot{
+		Server:    redactURL(s.client(ctx).BaseURL),
+		Path:      dir,
+		Recursive: recursive,
+		TakenAt:   time.Now(),
+		Entries:   make(map[string]SnapshotEntry),
+	}
+	if recursive {
+		files, _, err := s.walkRemoteFilesFiltered(ctx, dir, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			current.Entries[file.Rel] = SnapshotEntry{Path: file.Rel, Size: file.Size, Mtime: file.Mtime}
+		}
+	} else {
+		entries, err := s.listRemoteDir(ctx, dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			current.Entries[entry.Name] = SnapshotEntry{Path: entry.Name, IsDir: entry.isDir(), Size: entry.Size, Mtime: entry.Mtime}
+		}
+	}
+
+	// 快照文件名由服务器、路径和是否递归共同决定，不同组合互不影响
+	key := sha256.Sum256([]byte(current.Server + "\n" + dir + "\n" + strconv.FormatBool(recursive)))
+	snapshotFile := filepath.Join(s.config.SnapshotDir, hex.EncodeToString(key[:16])+".json")
+
+	result := SnapshotDiffResult{
+		Success:      true,
+		Path:         dir,
+		Recursive:    recursive,
+		Added:        []SnapshotEntry{},
+		Removed:      []SnapshotEntry{},
+		Modified:     []SnapshotDelta{},
+		Count:        len(current.Entries),
+		SnapshotFile: snapshotFile,
+	}
+
+	previous, err := readListingSnapshot(snapshotFile)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		result.Baseline = true
+	case err != nil:
+		// 快照损坏（例如写入中途被中断）时重新建立基准，而不是让调用一直失败
+		log.Printf("Ignoring corrupt snapshot %s: %v", snapshotFile, err)
+		result.Baseline = true
+		result.SnapshotCorrupt = true
+	default:
+		result.PreviousAt = &previous.TakenAt
+		for name, entry := range current.Entries {
+			old, ok := previous.Entries[name]
+			switch {
+			case !ok:
+				result.Added = append(result.Added, entry)
+			case old.Size != entry.Size || old.Mtime != entry.Mtime:
+				result.Modified = append(result.Modified, SnapshotDelta{
+					Path:     name,
+					OldSize:  old.Size,
+					NewSize:  entry.Size,
+					OldMtime: old.Mtime,
+					NewMtime: entry.Mtime,
+				})
+			default:
+				result.UnchangedCount++
+			}
+		}
+		for name, entry := range previous.Entries {
+			if _, ok := current.Entries[name]; !ok {
+				result.Removed = append(result.Removed, entry)
+			}
+		}
+		sort.Slice(result.Added, func(i, j int) bool { return result.Added[i].Path < result.Added[j].Path })
+		sort.Slice(result.Removed, func(i, j int) bool { return result.Removed[i].Path < result.Removed[j].Path })
+		sort.Slice(result.Modified, func(i, j int) bool { return result.Modified[i].Path < result.Modified[j].Path })
+	}
+
+	if update || result.Baseline {
+		if err := writeListingSnapshot(snapshotFile, current); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// readListingSnapshot 读取快照文件，文件不存在时返回的错误满足 errors.Is(err, fs.ErrNotExist)
+func readListingSnapshot(file string) (listingSnapshot, error) {
+	var snapshot listingSnapshot
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return snapshot, err
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("invalid snapshot: %v", err)
+	}
+	if snapshot.Entries == nil {
+		return snapshot, fmt.Errorf("invalid snapshot: missing entries")
+	}
+	return snapshot, nil
+}
+
+// writeListingSnapshot 先写临时文件再重命名，避免中断时留下不完整的快照
+func writeListingSnapshot(file string, snapshot listingSnapshot) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %v", err)
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".snapshot-*")
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	return nil
+}
+
+func (s *MCPServer) handleListDiff(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	pathA, ok := args["path_a"].(string)
+	if !ok || pathA == "" {
+		return nil, fmt.Errorf("path_a is required")
+	}
+	pathB, ok := args["path_b"].(string)
+	if !ok || pathB == "" {
+		return nil, fmt.Errorf("path_b is required")
+	}
+	compareHashes, _ := args["compare_hashes"].(bool)
+
+	filesA, err := s.walkRemoteFiles(ctx, pathA)
+	if err != nil {
+		return nil, err
+	}
+	filesB, err := s.walkRemoteFiles(ctx, pathB)
+	if err != nil {
+		return nil, err
+	}
+
+	result := ListDiffResult{
+		Success: true,
+		OnlyInA: []string{},
+		OnlyInB: []string{},
+		InBoth:  []string{},
+	}
+	for rel := range filesA {
+		if _, exists := filesB[rel]; exists {
+			result.InBoth = append(result.InBoth, rel)
+		} else {
+			result.OnlyInA = append(result.OnlyInA, rel)
+		}
+	}
+	for rel := range filesB {
+		if _, exists := filesA[rel]; !exists {
+			result.OnlyInB = append(result.OnlyInB, rel)
+		}
+	}
+	sort.Strings(result.OnlyInA)
+	sort.Strings(result.OnlyInB)
+	sort.Strings(result.InBoth)
+
+	if !compareHashes {
+		return result, nil
+	}
+
+	// 并发获取两边的哈希，并发数受 DUFS_UPLOAD_CONCURRENCY 限制，出错时返回第一个错误
+	hashesA := make([]string, len(result.InBoth))
+	hashesB := make([]string, len(result.InBoth))
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, s.config.UploadConcurrency)
+	fetch := func(remotePath string, dst *string) {
+		defer wg.Done()
+		defer func() { <-sem }()
+
+		hash, err := s.fetchRemoteHash(ctx, remotePath)
+		if err != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to hash %s: %v", remotePath, err)
+			}
+			mu.Unlock()
+			return
+		}
+		*dst = hash
+	}
+	for i, rel := range result.InBoth {
+		wg.Add(2)
+		sem <- struct{}{}
+		go fetch(path.Join(pathA, rel), &hashesA[i])
+		sem <- struct{}{}
+		go fetch(path.Join(pathB, rel), &hashesB[i])
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	hashes := &ListDiffHashes{
+		Identical: []IdenticalFile{},
+		Different: []DifferentFile{},
+	}
+	for i, rel := range result.InBoth {
+		if strings.EqualFold(hashesA[i], hashesB[i]) {
+			hashes.Identical = append(hashes.Identical, IdenticalFile{Path: rel, SHA256: hashesA[i]})
+		} else {
+			hashes.Different = append(hashes.Different, DifferentFile{Path: rel, HashA: hashesA[i], HashB: hashesB[i]})
+		}
+	}
+	result.Hashes = hashes
+
+	return result, nil
+}
+
+// walkLocalFiles 递归列出本地目录下的所有普通文件，返回以 / 分隔的相对路径到大小的映射
+func walkLocalFiles(root string) (map[string]int64, error) {
+	files := make(map[string]int64)
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// hashLocalFile 计算本地文件的 SHA256
+func hashLocalFile(localPath string) (string, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// diffHashWorkers 比较文件内容时并发计算哈希的数量
+const diffHashWorkers = 4
+
+func (s *MCPServer) handleDiff(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	localDir, ok := args["local_dir"].(string)
+	if !ok || localDir == "" {
+		return nil, fmt.Errorf("local_dir is required")
+	}
+	remoteDir, ok := args["remote_dir"].(string)
+	if !ok || remoteDir == "" {
+		return nil, fmt.Errorf("remote_dir is required")
+	}
+
+	localFiles, err := walkLocalFiles(localDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk local directory: %v", err)
+	}
+	remoteFiles, err := s.walkRemoteFiles(ctx, remoteDir)
+	if err != nil {
+		return nil, err
+	}
+
+	onlyLocal := []string{}
+	onlyRemote := []string{}
+	different := []string{}
+	var onlyLocalBytes, onlyRemoteBytes, differentBytes int64
+	// 两边都存在且大小相同的文件需要比较哈希
+	var candidates []string
+
+	for rel, size := range localFiles {
+		remoteSize, exists := remoteFiles[rel]
+		switch {
+		case !exists:
+			onlyLocal = append(onlyLocal, rel)
+			onlyLocalBytes += size
+		case remoteSize != size:
+			different = append(different, rel)
+			differentBytes += size
+		default:
+			candidates = append(candidates, rel)
+		}
+	}
+	for rel, size := range remoteFiles {
+		if _, exists := localFiles[rel]; !exists {
+			onlyRemote = append(onlyRemote, rel)
+			onlyRemoteBytes += size
+		}
+	}
+
+	// 并发比较哈希，出错时记录第一个错误
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		firstErr  error
+		identical int
+	)
+	work := make(chan string)
+	for i := 0; i < diffHashWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range work {
+				localHash, err := hashLocalFile(filepath.Join(localDir, filepath.FromSlash(rel)))
+				if err != nil {
+					err = fmt.Errorf("failed to hash %s: %v", rel, err)
+				}
+				var remoteHash string
+				if err == nil {
+					remoteHash, err = s.fetchRemoteHash(ctx, path.Join(remoteDir, rel))
+				}
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else if !strings.EqualFold(localHash, remoteHash) {
+					different = append(different, rel)
+					differentBytes += localFiles[rel]
+				} else {
+					identical++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, rel := range candidates {
+		work <- rel
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	sort.Strings(onlyLocal)
+	sort.Strings(onlyRemote)
+	sort.Strings(different)
+
+	return DiffResult{
+		Success:         true,
+		OnlyLocal:       onlyLocal,
+		OnlyRemote:      onlyRemote,
+		Different:       different,
+		OnlyLocalBytes:  onlyLocalBytes,
+		OnlyRemoteBytes: onlyRemoteBytes,
+		DifferentBytes:  differentBytes,
+		IdenticalCount:  identical,
+	}, nil
+}
+
+func (s *MCPServer) handleDownloadFolder(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	remotePath, ok := args["remote_path"].(string)
+	if !ok {
+		return nil, fmt.Errorf("remote_path is required")
+	}
+
+	localPath, _ := args["local_path"].(string)
+	showProgress, _ := args["show_progress"].(bool)
+
+	include, err := patternListArg(args, "include")
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := patternListArg(args, "exclude")
+	if err != nil {
+		return nil, err
+	}
+	if clientZip, _ := args["client_zip"].(bool); clientZip {
+		if showProgress {
+			return nil, fmt.Errorf("client_zip cannot be combined with show_progress")
+		}
+		level := flate.DefaultCompression
+		if v, ok := args["compression_level"].(float64); ok {
+			if v < -1 || v > 9 {
+				return nil, fmt.Errorf("compression_level must be between -1 and 9")
+			}
+			level = int(v)
+		}
+		return s.downloadFolderClientZip(ctx, remotePath, localPath, include, exclude, level)
+	}
+	if len(include) > 0 || len(exclude) > 0 {
+		return s.downloadFolderFiltered(ctx, remotePath, localPath, include, exclude, showProgress)
+	}
+
+	// show_progress=true 时转为后台任务，通过 dufs_download_status 查询字节级进度
+	if showProgress {
+		progress := &transferProgress{}
+		progress.total.Store(s.remoteZipSize(ctx, remotePath))
+
+		job, err := s.startJob(ctx, jobTypeDownload, "", []JobTask{
+			{
+				Operation:           jobOpDownloadFolder,
+				LocalPath:           localPath,
+				RequestedRemotePath: remotePath,
+				Status:              "pending",
+				progress:            progress,
+			},
+		}, s.toolTimeout("dufs_download_folder"))
+		if err != nil {
+			return nil, err
+		}
+
+		return FolderDownloadStartedResult{
+			JobStartedResult: JobStartedResult{
+				Success: true,
+				JobID:   job.ID,
+				Status:  "pending",
+				Message: "Folder download started, use dufs_download_status to track progress",
+			},
+			TotalBytes: progress.total.Load(),
+		}, nil
+	}
+
+	outcome, err := s.performDownloadFolder(ctx, remotePath, localPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return DownloadResult{
+		Success:    true,
+		Message:    fmt.Sprintf("Folder downloaded successfully to %s", outcome.LocalPath),
+		RemotePath: remotePath,
+		LocalPath:  outcome.LocalPath,
+		SizeBytes:  outcome.SizeBytes,
+		Status:     outcome.StatusCode,
+	}, nil
+}
+
+// patternListArg 解析可选的 glob 模式数组参数，并校验每个模式的语法
+func patternListArg(args map[string]interface{}, name string) ([]string, error) {
+	raw, ok := args[name].([]interface{})
+	if !ok {
+		return nil, nil
+	}
+	patterns := make([]string, 0, len(raw))
+	for _, item := range raw {
+		pattern, ok := item.(string)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid %s entry: %+v", name, item)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %v", name, pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// matchesAnyPattern 相对路径本身或其最后一段匹配任一模式时返回 true
+func matchesAnyPattern(patterns []string, rel string) bool {
+	base := path.Base(rel)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteFile 远程目录下的一个文件，Rel 为相对于遍历起点的路径，Mtime 为毫秒时间戳
+type remoteFile struct {
+	Rel   string
+	Size  int64
+	Mtime int64
+}
+
+// walkRemoteFilesFiltered 递归列出远程目录下的文件：匹配 exclude 的目录不再展开，
+// 文件需要不匹配 exclude 且（指定了 include 时）匹配 include。返回按路径排序的文件和被排除的条目数
+func (s *MCPServer) walkRemoteFilesFiltered(ctx context.Context, root string, include, exclude []string) ([]remoteFile, int, error) {
+	var files []remoteFile
+	excluded := 0
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		entries, err := s.listRemoteDir(ctx, path.Join(root, rel))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			child := path.Join(rel, entry.Name)
+			if matchesAnyPattern(exclude, child) {
+				excluded++
+				continue
+			}
+			if entry.isDir() {
+				if err := walk(child); err != nil {
+					return err
+				}
+				continue
+			}
+			if len(include) > 0 && !matchesAnyPattern(include, child) {
+				excluded++
+				continue
+			}
+			files = append(files, remoteFile{Rel: child, Size: entry.Size, Mtime: entry.Mtime})
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Rel < files[j].Rel
+	})
+	return files, excluded, nil
+}
+
+// downloadFolderFiltered 按 include/exclude 选出文件夹中的文件，保持目录结构逐个下载到 localPath 目录。
+// dufs 的 ?zip 无法过滤，因此不使用 zip 下载；show_progress=true 时作为后台下载任务执行
+func (s *MCPServer) downloadFolderFiltered(ctx context.Context, remotePath, localPath string, include, exclude []string, showProgress bool) (interface{}, error) {
+	if localPath == "" {
+		localPath = defaultLocalPath(strings.TrimSuffix(remotePath, "/"))
+		if localPath == "" {
+			localPath = "root"
+		}
+	}
+
+	files, excluded, err := s.walkRemoteFilesFiltered(ctx, remotePath, include, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	// 预先创建本地目录结构，后台任务中的下载可以直接写入文件
+	tasks := make([]JobTask, 0, len(files))
+	var totalBytes int64
+	for _, file := range files {
+		local := filepath.Join(localPath, filepath.FromSlash(file.Rel))
+		if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create local directory: %v", err)
+		}
+		tasks = append(tasks, JobTask{
+			Operation:           jobTypeDownload,
+			LocalPath:           local,
+			RequestedRemotePath: path.Join("/", remotePath, file.Rel),
+			Status:              "pending",
+			DownloadOptions:     downloadOptions{PostProcess: "none"},
+			progress:            &transferProgress{},
+		})
+		totalBytes += file.Size
+	}
+
+	if showProgress {
+		names := make([]string, 0, len(files))
+		for _, file := range files {
+			names = append(names, file.Rel)
+		}
+		job, err := s.startJob(ctx, jobTypeDownload, "", tasks, s.toolTimeout("dufs_download_folder"))
+		if err != nil {
+			return nil, err
+		}
+		return FolderDownloadStartedResult{
+			JobStartedResult: JobStartedResult{
+				Success:   true,
+				JobID:     job.ID,
+				Status:    "pending",
+				TaskCount: len(tasks),
+				Message:   "Folder download started, use dufs_download_status to track progress",
+			},
+			TotalBytes:    totalBytes,
+			Files:         names,
+			ExcludedCount: excluded,
+		}, nil
+	}
+
+	result := FilteredFolderDownloadResult{
+		Success:       true,
+		LocalPath:     localPath,
+		Results:       make([]DownloadFileResult, 0, len(tasks)),
+		Count:         len(tasks),
+		ExcludedCount: excluded,
+	}
+	for _, task := range tasks {
+		outcome, err := s.performDownload(ctx, task.RequestedRemotePath, task.LocalPath, task.DownloadOptions)
+		if err != nil {
+			result.Success = false
+			result.Results = append(result.Results, DownloadFileResult{
+				RemotePath: task.RequestedRemotePath,
+				LocalPath:  task.LocalPath,
+				Success:    false,
+				Error:      err.Error(),
+				Status:     outcome.StatusCode,
+			})
+			continue
+		}
+		result.SizeBytes += outcome.SizeBytes
+		result.Results = append(result.Results, DownloadFileResult{
+			RemotePath: task.RequestedRemotePath,
+			LocalPath:  outcome.LocalPath,
+			Success:    true,
+			SizeBytes:  outcome.SizeBytes,
+			SHA256:     outcome.SHA256,
+			Status:     outcome.StatusCode,
+		})
+	}
+
+	return result, nil
+}
+
+// downloadFolderClientZip 递归列出文件夹，把（经过 include/exclude 过滤的）文件逐个下载并以流的方式写入本地 zip，
+// 内存占用与文件大小无关。任一文件失败时删除未完成的 zip 并返回错误
+func (s *MCPServer) downloadFolderClientZip(ctx context.Context, remotePath, localPath string, include, exclude []string, level int) (interface{}, error) {
+	if localPath == "" {
+		folderName := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSuffix(remotePath, "/"), "/"), "./")
+		if folderName == "" {
+			folderName = "root"
+		}
+		localPath = strings.ReplaceAll(folderName, "/", "_") + ".zip"
+	}
+
+	files, excluded, err := s.walkRemoteFilesFiltered(ctx, remotePath, include, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := createLocalFile(localPath)
+	if err != nil {
+		return nil, err
+	}
+	result := ClientZipResult{
+		Success:       true,
+		LocalPath:     localPath,
+		Files:         make([]string, 0, len(files)),
+		ExcludedCount: excluded,
+	}
+	err = func() error {
+		zw := zip.NewWriter(out)
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		})
+		for _, file := range files {
+			written, err := s.writeZipEntry(ctx, zw, path.Join("/", remotePath, file.Rel), file, level)
+			if err != nil {
+				return err
+			}
+			result.Files = append(result.Files, file.Rel)
+			result.UncompressedBytes += written
+		}
+		return zw.Close()
+	}()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(localPath)
+		return nil, err
+	}
+
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat zip file: %v", err)
+	}
+	result.Count = len(result.Files)
+	result.SizeBytes = info.Size()
+	result.Message = fmt.Sprintf("Folder zipped locally to %s (%d files)", localPath, result.Count)
+	return result, nil
+}
+
+// writeZipEntry 下载一个远程文件并直接写入 zip 条目
+func (s *MCPServer) writeZipEntry(ctx context.Context, zw *zip.Writer, remotePath string, file remoteFile, level int) (int64, error) {
+	resp, err := s.client(ctx).makeRequest(ctx, "GET", remotePath, nil, nil)
+	if err != nil {
+		return 0, fmt.Errorf("download %s failed: %v", remotePath, err)
+	}
+	defer resp.Body.Close()
+
+	if !isSuccessStatus(resp.StatusCode) {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("download %s failed with status %d: %s", remotePath, resp.StatusCode, string(body))
+	}
+
+	header := &zip.FileHeader{
+		Name:     file.Rel,
+		Method:   zip.Deflate,
+		Modified: time.UnixMilli(file.Mtime),
+	}
+	if level == flate.NoCompression {
+		header.Method = zip.Store
+	}
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add %s to zip: %v", file.Rel, err)
+	}
+	written, err := s.copyBuffered(entry, resp.Body)
+	if err != nil {
+		return written, fmt.Errorf("failed to write %s to zip: %v", file.Rel, err)
+	}
+	return written, nil
+}
+
+// remoteZipSize 通过 HEAD 请求估算文件夹 zip 的大小，服务器未返回 Content-Length 时为 -1
+func (s *MCPServer) remoteZipSize(ctx context.Context, remotePath string) int64 {
+	resp, err := s.client(ctx).makeRequestQuery(ctx, "HEAD", remotePath, "zip", nil, nil)
+	if err != nil {
+		return -1
+	}
+	defer resp.Body.Close()
+
+	if !isSuccessStatus(resp.StatusCode) {
+		return -1
+	}
+	return resp.ContentLength
+}
+
+// performDownloadFolder 以 zip 形式下载整个文件夹
+func (s *MCPServer) performDownloadFolder(ctx context.Context, remotePath, localPath string, progress *transferProgress) (downloadOutcome, error) {
+	if localPath == "" {
+		folderName := strings.TrimPrefix(strings.TrimPrefix(remotePath, "/"), "./")
+		folderName = strings.ReplaceAll(folderName, "/", "_")
+		localPath = folderName + ".zip"
+	}
+	outcome := downloadOutcome{LocalPath: localPath}
+
+	resp, err := s.client(ctx).makeRequestQuery(ctx, "GET", remotePath, "zip", nil, nil)
+	if err != nil {
+		return outcome, fmt.Errorf("download folder failed: %v", err)
+	}
+	defer resp.Body.Close()
+	outcome.StatusCode = resp.StatusCode
+
+	if !isSuccessStatus(resp.StatusCode) {
+		body, _ := io.ReadAll(resp.Body)
+		return outcome, fmt.Errorf("download folder failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	if progress != nil && resp.ContentLength > 0 {
+		progress.total.Store(resp.ContentLength)
+	}
+
+	file, err := createLocalFile(localPath)
+	if err != nil {
+		return outcome, err
+	}
+	defer file.Close()
+
+	written, err := s.copyBuffered(file, trackProgress(resp.Body, progress))
+	if err != nil {
+		return outcome, fmt.Errorf("failed to write file: %v", err)
+	}
+	outcome.SizeBytes = written
+
+	return outcome, nil
+}
+
+func (s *MCPServer) handleDownloadStatus(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	jobID, ok := args["job_id"].(string)
+	if !ok || jobID == "" {
+		return nil, fmt.Errorf("job_id is required")
+	}
+
+	s.jobsMutex.RLock()
+	job, exists := s.jobs[jobID]
+	if !exists {
+		s.jobsMutex.RUnlock()
+		return nil, fmt.Errorf("job %s not found", jobID)
+	}
+	jobCopy := copyJob(job)
+	s.jobsMutex.RUnlock()
+
+	if jobCopy.Type != jobTypeDownload {
+		return nil, fmt.Errorf("job %s is a %s job, use dufs_upload_status instead", jobID, jobCopy.Type)
+	}
+
+	// 汇总所有任务项的进度，总大小未知（-1）时不计算百分比
+	var transferred, total int64
+	totalKnown := true
+	for _, task := range jobCopy.Tasks {
+		transferred += task.BytesTransferred
+		if task.TotalBytes < 0 {
+			totalKnown = false
+		}
+		total += task.TotalBytes
 	}
+
+	result := DownloadStatusResult{
+		Success:          true,
+		Job:              jobCopy,
+		BytesTransferred: transferred,
+	}
+	if totalKnown && total > 0 {
+		result.TotalBytes = total
+		result.ProgressPercent = math.Round(float64(transferred)/float64(total)*10000) / 100
+	}
+
+	return result, nil
 }
 
-func (s *MCPServer) handleInitialize(params json.RawMessage) (interface{}, error) {
-	return map[string]interface{}{
-		"protocolVersion": "2024-11-05",
-		"capabilities": map[string]interface{}{
-			"tools": map[string]interface{}{},
-		},
-		"serverInfo": map[string]interface{}{
-			"name":    "dufs-mcp-server",
-			"version": "1.0.0",
-		},
+func (s *MCPServer) handleSetContentType(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	path, ok := args["path"].(string)
+	if !ok || path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	contentType, ok := args["content_type"].(string)
+	if !ok || contentType == "" {
+		return nil, fmt.Errorf("content_type is required")
+	}
+
+	resp, err := s.client(ctx).makeRequest(ctx, "GET", path, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("download failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if !isSuccessStatus(resp.StatusCode) {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("download failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	// dufs 不支持 PATCH，只能把文件读回内存后带新的 Content-Type 重新上传
+	maxSize := s.config.MaxReadSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxReadSize
+	}
+	if resp.ContentLength > maxSize {
+		return nil, fmt.Errorf("file %s is %d bytes, larger than the %d byte limit; please re-upload it manually with the desired content type", path, resp.ContentLength, maxSize)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("file %s is larger than the %d byte limit; please re-upload it manually with the desired content type", path, maxSize)
+	}
+	oldContentType := resp.Header.Get("Content-Type")
+
+	putResp, err := s.client(ctx).makeRequest(ctx, "PUT", path, bytes.NewReader(data), map[string]string{
+		"Content-Type": contentType,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("upload failed: %v", err)
+	}
+	defer putResp.Body.Close()
+
+	if !isSuccessStatus(putResp.StatusCode) {
+		body, _ := io.ReadAll(putResp.Body)
+		return nil, fmt.Errorf("upload failed with status %d: %s", putResp.StatusCode, string(body))
+	}
+
+	return SetContentTypeResult{
+		Success:        true,
+		Message:        fmt.Sprintf("Content type of %s changed to %s", path, contentType),
+		Path:           path,
+		OldContentType: oldContentType,
+		NewContentType: contentType,
+		SizeBytes:      len(data),
+		Status:         putResp.StatusCode,
 	}, nil
 }
 
-func (s *MCPServer) handleToolsList(params json.RawMessage) (interface{}, error) {
-	return map[string]interface{}{
-		"tools": s.tools,
+func (s *MCPServer) handleHealth(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	status, protocol, err := s.checkHealth(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return HealthResult{
+		Success:  status == 200,
+		Status:   status,
+		Healthy:  status == 200,
+		Protocol: protocol,
 	}, nil
 }
 
-func (s *MCPServer) handleToolsCall(params json.RawMessage) (interface{}, error) {
-	var callParams struct {
-		Name      string                 `json:"name"`
-		Arguments map[string]interface{} `json:"arguments"`
+// checkHealth 请求 dufs 的健康检查接口，返回 HTTP 状态码和使用的协议
+func (s *MCPServer) checkHealth(ctx context.Context) (int, string, error) {
+	resp, err := s.client(ctx).makeRequest(ctx, "GET", "/__dufs__/health", nil, nil)
+	if err != nil {
+		return 0, "", fmt.Errorf("health check failed: %v", err)
 	}
-	if err := json.Unmarshal(params, &callParams); err != nil {
-		return nil, fmt.Errorf("invalid parameters: %v", err)
+	defer resp.Body.Close()
+	return resp.StatusCode, resp.Proto, nil
+}
+
+// 健康监控的默认参数
+const (
+	defaultMonitorInterval    = 30
+	defaultMonitorMaxFailures = 3
+)
+
+// healthMonitor 后台健康监控的配置和状态，除 cancel 外的字段由 MCPServer.monitorMutex 保护
+type healthMonitor struct {
+	interval    time.Duration
+	maxFailures int
+	callbackURL string
+	dufsURL     string
+	cancel      context.CancelFunc
+
+	startedAt           time.Time
+	checks              int
+	consecutiveFailures int
+	lastCheckAt         time.Time
+	lastStatus          int
+	lastError           string
+	// alerted 已发送 unhealthy 告警且尚未恢复
+	alerted        bool
+	alertsSent     int
+	lastAlertError string
+}
+
+// status 返回监控的当前状态，调用方需持有 monitorMutex
+func (m *healthMonitor) status(running bool) MonitoringStatusResult {
+	result := MonitoringStatusResult{
+		Success:             true,
+		Running:             running,
+		IntervalSeconds:     int(m.interval / time.Second),
+		MaxFailures:         m.maxFailures,
+		CallbackURL:         redactURL(m.callbackURL),
+		Healthy:             m.checks > 0 && m.consecutiveFailures == 0,
+		Checks:              m.checks,
+		ConsecutiveFailures: m.consecutiveFailures,
+		StartedAt:           &m.startedAt,
+		LastStatus:          m.lastStatus,
+		LastError:           m.lastError,
+		AlertsSent:          m.alertsSent,
+		LastAlertError:      m.lastAlertError,
 	}
+	if m.checks > 0 {
+		lastCheckAt := m.lastCheckAt
+		result.LastCheckAt = &lastCheckAt
+	}
+	return result
+}
 
-	var result interface{}
-	var err error
+func (s *MCPServer) handleStartMonitoring(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	interval := defaultMonitorInterval
+	if v, ok := args["interval_seconds"].(float64); ok {
+		if v < 1 {
+			return nil, fmt.Errorf("interval_seconds must be at least 1")
+		}
+		interval = int(v)
+	}
+	maxFailures := defaultMonitorMaxFailures
+	if v, ok := args["max_failures"].(float64); ok {
+		if v < 1 {
+			return nil, fmt.Errorf("max_failures must be at least 1")
+		}
+		maxFailures = int(v)
+	}
+	callbackURL, _ := args["callback_url"].(string)
+	if callbackURL != "" {
+		parsed, err := url.Parse(callbackURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid callback_url: %s", callbackURL)
+		}
+	}
 
-	switch callParams.Name {
-	case "dufs_upload":
-		result, err = s.handleUpload(callParams.Arguments)
-	case "dufs_upload_batch":
-		result, err = s.handleUploadBatch(callParams.Arguments)
-	case "dufs_upload_status":
-		result, err = s.handleUploadStatus(callParams.Arguments)
-	case "dufs_download":
-		result, err = s.handleDownload(callParams.Arguments)
-	case "dufs_delete":
-		result, err = s.handleDelete(callParams.Arguments)
-	case "dufs_list":
-		result, err = s.handleList(callParams.Arguments)
-	case "dufs_create_dir":
-		result, err = s.handleCreateDir(callParams.Arguments)
-	case "dufs_move":
-		result, err = s.handleMove(callParams.Arguments)
-	case "dufs_get_hash":
-		result, err = s.handleGetHash(callParams.Arguments)
-	case "dufs_download_folder":
-		result, err = s.handleDownloadFolder(callParams.Arguments)
-	case "dufs_health":
-		result, err = s.handleHealth(callParams.Arguments)
-	default:
-		return nil, fmt.Errorf("unknown tool: %s", callParams.Name)
+	s.monitorMutex.Lock()
+	defer s.monitorMutex.Unlock()
+	if s.monitor != nil {
+		return nil, fmt.Errorf("monitoring is already running, stop it with dufs_stop_monitoring first")
+	}
+
+	// 监控在后台持续运行，不受本次工具调用超时的影响，但沿用 server 参数选择的服务器
+	monitorCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	monitor := &healthMonitor{
+		interval:    time.Duration(interval) * time.Second,
+		maxFailures: maxFailures,
+		callbackURL: callbackURL,
+		dufsURL:     redactURL(s.client(ctx).BaseURL),
+		cancel:      cancel,
+		startedAt:   time.Now(),
+	}
+	s.monitor = monitor
+	go s.runMonitor(monitorCtx, monitor)
+
+	result := monitor.status(true)
+	result.Message = fmt.Sprintf("Monitoring %s every %ds", monitor.dufsURL, interval)
+	return result, nil
+}
+
+func (s *MCPServer) handleStopMonitoring(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	s.monitorMutex.Lock()
+	defer s.monitorMutex.Unlock()
+	if s.monitor == nil {
+		return nil, fmt.Errorf("monitoring is not running")
+	}
+
+	s.monitor.cancel()
+	result := s.monitor.status(false)
+	result.Message = "Monitoring stopped"
+	s.monitor = nil
+	return result, nil
+}
+
+func (s *MCPServer) handleMonitoringStatus(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	s.monitorMutex.Lock()
+	defer s.monitorMutex.Unlock()
+	if s.monitor == nil {
+		return MonitoringStatusResult{Success: true, Running: false}, nil
+	}
+	return s.monitor.status(true), nil
+}
+
+// runMonitor 立即执行一次健康检查，之后按间隔检查直到监控被停止
+func (s *MCPServer) runMonitor(ctx context.Context, monitor *healthMonitor) {
+	ticker := time.NewTicker(monitor.interval)
+	defer ticker.Stop()
+
+	for {
+		s.monitorCheck(ctx, monitor)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// monitorCheck 执行一次健康检查并更新连续失败次数，状态变化时发送告警
+func (s *MCPServer) monitorCheck(ctx context.Context, monitor *healthMonitor) {
+	checkCtx, cancel := context.WithTimeout(ctx, s.toolTimeout("dufs_health"))
+	status, _, err := s.checkHealth(checkCtx)
+	cancel()
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("health check returned status %d", status)
 	}
 
+	s.monitorMutex.Lock()
+	monitor.checks++
+	monitor.lastCheckAt = time.Now()
+	monitor.lastStatus = status
+	var alert *HealthAlert
 	if err != nil {
-		return nil, err
+		monitor.consecutiveFailures++
+		monitor.lastError = err.Error()
+		if monitor.consecutiveFailures >= monitor.maxFailures && !monitor.alerted {
+			monitor.alerted = true
+			alert = &HealthAlert{Event: "unhealthy"}
+		}
+	} else {
+		if monitor.alerted {
+			monitor.alerted = false
+			alert = &HealthAlert{Event: "recovered"}
+		}
+		monitor.consecutiveFailures = 0
+		monitor.lastError = ""
 	}
+	if alert != nil {
+		alert.DufsURL = monitor.dufsURL
+		alert.ConsecutiveFailures = monitor.consecutiveFailures
+		alert.LastStatus = monitor.lastStatus
+		alert.LastError = monitor.lastError
+		alert.Time = monitor.lastCheckAt
+		log.Printf("Health monitor: %s is %s after %d consecutive failure(s)", monitor.dufsURL, alert.Event, alert.ConsecutiveFailures)
+	}
+	s.monitorMutex.Unlock()
 
-	// 根据 MCP 协议，tools/call 的返回格式应该是包含 content 数组的对象
-	resultJSON, err := json.Marshal(result)
+	if alert == nil || monitor.callbackURL == "" {
+		return
+	}
+	alertErr := postHealthAlert(ctx, monitor.callbackURL, *alert)
+	s.monitorMutex.Lock()
+	if alertErr != nil {
+		log.Printf("Health monitor: failed to send alert: %v", alertErr)
+		monitor.lastAlertError = alertErr.Error()
+	} else {
+		monitor.alertsSent++
+		monitor.lastAlertError = ""
+	}
+	s.monitorMutex.Unlock()
+}
+
+// postHealthAlert 把告警以 JSON POST 到 callback_url，非 2xx 响应视为失败
+func postHealthAlert(ctx context.Context, callbackURL string, alert HealthAlert) error {
+	body, err := json.Marshal(alert)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal result: %v", err)
+		return err
 	}
 
-	return map[string]interface{}{
-		"content": []map[string]interface{}{
-			{
-				"type": "text",
-				"text": string(resultJSON),
-			},
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("alert request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("alert request failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *MCPServer) handleTestProxy(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	result := ProxyTestResult{Configured: "environment"}
+	switch s.config.ProxyURL {
+	case "":
+	case "direct":
+		result.Configured = "direct"
+	default:
+		result.Configured = redactURL(s.config.ProxyURL)
+	}
+
+	// 按 transport 的代理选择逻辑判断访问 DUFS_URL 时是否经过代理（包括 NO_PROXY 的排除规则）
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(s.client(ctx).BaseURL, "/")+"/__dufs__/health", nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DUFS_URL: %v", err)
+	}
+	if transport, ok := s.client(ctx).Client.Transport.(*http.Transport); ok && transport.Proxy != nil {
+		proxy, err := transport.Proxy(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve proxy: %v", err)
+		}
+		if proxy != nil {
+			result.UsingProxy = true
+			result.ProxyURL = redactURL(proxy.String())
+		}
+	}
+
+	// 实际发起一次请求，记录连接的远端地址，确认请求确实经过（或没有经过）代理
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			result.RemoteAddr = info.Conn.RemoteAddr().String()
 		},
-		"isError": false,
-	}, nil
+	}
+	resp, err := s.client(ctx).makeRequest(httptrace.WithClientTrace(ctx, trace), "GET", "/__dufs__/health", nil, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	defer resp.Body.Close()
+
+	result.Status = resp.StatusCode
+	result.Reachable = true
+	result.Success = true
+	return result, nil
 }
 
-func (s *MCPServer) resolveRemotePath(localPath, remotePath string) string {
-	if remotePath != "" {
-		return strings.TrimPrefix(remotePath, "/")
+func (s *MCPServer) handleSetUploadDir(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	dir, hasDir := args["upload_dir"].(string)
+	reset, _ := args["reset"].(bool)
+	if hasDir && reset {
+		return nil, fmt.Errorf("upload_dir cannot be combined with reset")
 	}
 
-	fileName := filepath.Base(localPath)
-	now := time.Now()
-	dateDir := now.Format("20060102")
+	configured := strings.Trim(s.config.UploadDir, "/")
+	result := UploadDirResult{
+		Success:    true,
+		Configured: configured,
+		Root:       s.config.UploadDirRoot,
+	}
 
-	baseDir := strings.TrimPrefix(s.config.UploadDir, "/")
-	if baseDir == "" {
-		baseDir = "uploads"
+	next := configured
+	if hasDir {
+		normalized, err := normalizeUploadDir(dir, s.config.UploadDirRoot)
+		if err != nil {
+			return nil, err
+		}
+		next = normalized
+	} else if !reset {
+		result.UploadDir = s.currentUploadDir()
+		return result, nil
 	}
 
-	return fmt.Sprintf("%s/%s/%s", baseDir, dateDir, fileName)
+	s.uploadDirMutex.Lock()
+	previous := s.uploadDir
+	s.uploadDir = next
+	s.uploadDirMutex.Unlock()
+
+	if previous != next {
+		log.Printf("Default upload directory changed from %q to %q", previous, next)
+	}
+	result.UploadDir = next
+	result.Previous = previous
+	result.Changed = previous != next
+	return result, nil
 }
 
-func (s *MCPServer) ensureRemoteDirectories(remotePath string) error {
-	remoteDir := remotePath
-	if idx := strings.LastIndex(remotePath, "/"); idx >= 0 {
-		remoteDir = remotePath[:idx]
+func (s *MCPServer) handleInfo(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+	config := s.config
+	result := InfoResult{
+		Success:          true,
+		DufsURL:          redactURL(config.DufsURL),
+		AuthConfigured:   config.Username != "",
+		Username:         config.Username,
+		PasswordSet:      config.Password != "",
+		UploadDir:        s.currentUploadDir(),
+		AllowInsecure:    config.AllowInsecure,
+		ClientCertSet:    config.ClientCertFile != "",
+		CACertSet:        config.CACertFile != "",
+		Proxy:            "environment",
+		HTTP2:            "auto",
+		HTTPAuthTokenSet: config.HTTPAuthToken != "",
+		HTTPTLS:          config.HTTPTLSConfig != nil,
+		HTTPMTLS:         config.HTTPTLSClientCAFile != "",
+		MaxReadSize:      config.MaxReadSize,
+		MaxUploadBytes:   config.MaxUploadBytes,
+		MaxRetries:       config.MaxRetries,
+		DNSRetries:       config.DNSRetries,
+		ConnectionTimeouts: map[string]string{
+			"dial":            config.DialTimeout.String(),
+			"tls_handshake":   config.TLSHandshakeTimeout.String(),
+			"response_header": config.ResponseHeaderTimeout.String(),
+			"idle_conn":       config.IdleConnTimeout.String(),
+		},
+		ToolTimeouts: make(map[string]string),
+	}
+	if config.ProxyURL != "" {
+		result.Proxy = redactURL(config.ProxyURL)
+	}
+	if config.HTTP2 != "" {
+		result.HTTP2 = config.HTTP2
 	}
 
-	if remoteDir == "" {
-		return nil
+	for _, tool := range s.tools {
+		result.Tools = append(result.Tools, tool.Name)
+		result.ToolTimeouts[strings.TrimPrefix(tool.Name, "dufs_")] = s.toolTimeout(tool.Name).String()
 	}
 
-	parts := strings.Split(strings.TrimPrefix(remoteDir, "/"), "/")
-	current := ""
-	for _, part := range parts {
-		if part == "" {
-			continue
+	names := make([]string, 0, len(config.Servers))
+	for name := range config.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		server := config.Servers[name]
+		result.Servers = append(result.Servers, InfoServer{
+			Name:           name,
+			URL:            redactURL(server.URL),
+			AuthConfigured: server.Username != "",
+		})
+	}
+
+	return result, nil
+}
+
+// redactURL 隐藏 URL 中的密码
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return parsed.Redacted()
+}
+
+func (s *MCPServer) handleMessage(msg MCPMessage) (response MCPMessage) {
+	response = MCPMessage{
+		JSONRPC: "2.0",
+		ID:      msg.ID,
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic while handling %s: %v\n%s", msg.Method, r, debug.Stack())
+			response = MCPMessage{
+				JSONRPC: "2.0",
+				ID:      msg.ID,
+				Error: &MCPError{
+					Code:    errCodeInternal,
+					Message: "Internal error",
+				},
+			}
 		}
-		if current == "" {
-			current = part
-		} else {
-			current = current + "/" + part
+	}()
+
+	// 如果没有 method，可能是通知消息或无效消息
+	if msg.Method == "" {
+		response.Error = &MCPError{
+			Code:    errCodeInvalidRequest,
+			Message: "Invalid Request: method is required",
 		}
+		return response
+	}
 
-		resp, err := s.dufsClient.makeRequest("MKCOL", current, nil, nil)
-		if err != nil {
-			return fmt.Errorf("failed to create remote directory %s: %w", current, err)
+	var result interface{}
+	var err error
+
+	switch msg.Method {
+	case "initialize":
+		result, err = s.handleInitialize(msg.Params)
+	case "tools/list":
+		result, err = s.handleToolsList(msg.Params)
+	case "tools/call":
+		result, err = s.handleToolsCall(msg.Params)
+	case "resources/list":
+		result = map[string]interface{}{"resources": []interface{}{}}
+	case "resources/templates/list":
+		result = map[string]interface{}{"resourceTemplates": resourceTemplates}
+	case "resources/read":
+		result, err = s.handleResourcesRead(msg.Params)
+	default:
+		err = fmt.Errorf("unknown method: %s", msg.Method)
+	}
+
+	if err != nil {
+		code := errCodeServer
+		var coded *rpcError
+		if errors.As(err, &coded) {
+			code = coded.Code
 		}
-		func() {
-			defer resp.Body.Close()
-			if resp.StatusCode >= 400 && resp.StatusCode != http.StatusMethodNotAllowed {
-				body, _ := io.ReadAll(resp.Body)
-				err = fmt.Errorf("create directory failed with status %d: %s", resp.StatusCode, string(body))
-			}
-		}()
-		if err != nil {
-			return err
+		response.Error = &MCPError{
+			Code:    code,
+			Message: err.Error(),
 		}
+	} else {
+		response.Result = result
 	}
 
-	return nil
+	return response
 }
 
-func (s *MCPServer) performUpload(localPath, remotePath string) (string, int, error) {
-	if localPath == "" {
-		return "", 0, fmt.Errorf("local_path is required")
+// handleBatch 处理 JSON-RPC 批量请求，返回需要回复的响应（通知消息不产生响应）
+func (s *MCPServer) handleBatch(data []byte) []MCPMessage {
+	var rawMessages []json.RawMessage
+	if err := json.Unmarshal(data, &rawMessages); err != nil {
+		log.Printf("Failed to parse batch message: %v", err)
+		return []MCPMessage{{
+			JSONRPC: "2.0",
+			Error: &MCPError{
+				Code:    errCodeParse,
+				Message: fmt.Sprintf("Parse error: %v", err),
+			},
+		}}
+	}
+
+	if len(rawMessages) == 0 {
+		return []MCPMessage{{
+			JSONRPC: "2.0",
+			Error: &MCPError{
+				Code:    errCodeInvalidRequest,
+				Message: "Invalid Request: empty batch",
+			},
+		}}
+	}
+
+	responses := make([]MCPMessage, 0, len(rawMessages))
+	for _, raw := range rawMessages {
+		var msg MCPMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			responses = append(responses, MCPMessage{
+				JSONRPC: "2.0",
+				Error: &MCPError{
+					Code:    errCodeInvalidRequest,
+					Message: fmt.Sprintf("Invalid Request: %v", err),
+				},
+			})
+			continue
+		}
+
+		response := s.handleMessage(msg)
+		if msg.ID != nil {
+			responses = append(responses, response)
+		}
+	}
+
+	return responses
+}
+
+func loadConfig() (Config, error) {
+	config := Config{
+		DufsURL:               os.Getenv("DUFS_URL"),
+		Username:              os.Getenv("DUFS_USERNAME"),
+		Password:              os.Getenv("DUFS_PASSWORD"),
+		UploadDir:             os.Getenv("DUFS_UPLOAD_DIR"),
+		AllowInsecure:         os.Getenv("DUFS_ALLOW_INSECURE") == "true",
+		MaxReadSize:           defaultMaxReadSize,
+		MaxRetries:            3,
+		DNSRetries:            3,
+		UploadConcurrency:     4,
+		CopyBufferSize:        defaultCopyBufferSize,
+		MaxMessageBytes:       defaultMaxMessageBytes,
+		DialTimeout:           10 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		SSEHeartbeatInterval:  15 * time.Second,
+		HTTPAuthToken:         os.Getenv("DUFS_HTTP_AUTH_TOKEN"),
+		TrashDir:              strings.Trim(os.Getenv("DUFS_TRASH_DIR"), "/"),
+		DebugHTTPLogRequests:  os.Getenv("DEBUG_HTTP_LOG_REQUESTS") == "true",
+		Debug:                 os.Getenv("DUFS_DEBUG") == "true",
+		HTTPDisableGzip:       os.Getenv("DUFS_HTTP_DISABLE_GZIP") == "true",
+		AllowSourceCommand:    os.Getenv("DUFS_ALLOW_SOURCE_COMMAND") == "true",
+		NotifyJobCompletion:   os.Getenv("DUFS_NOTIFY_JOB_COMPLETION") == "true",
+		AcceptLanguage:        os.Getenv("DUFS_ACCEPT_LANGUAGE"),
+		SnapshotDir:           os.Getenv("DUFS_SNAPSHOT_DIR"),
+	}
+
+	config.CORS = loadCORSConfig()
+
+	if config.SnapshotDir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			cacheDir = os.TempDir()
+		}
+		config.SnapshotDir = filepath.Join(cacheDir, "dufs-mcp-server", "snapshots")
 	}
 
-	finalRemotePath := s.resolveRemotePath(localPath, remotePath)
+	if config.DufsURL == "" {
+		return config, fmt.Errorf("DUFS_URL environment variable is required")
+	}
 
-	if err := s.ensureRemoteDirectories(finalRemotePath); err != nil {
-		return "", 0, err
+	// DUFS_SERVERS 为 JSON 对象：{"名称": {"url": "...", "username": "...", "password": "..."}}
+	if v := os.Getenv("DUFS_SERVERS"); v != "" {
+		if err := json.Unmarshal([]byte(v), &config.Servers); err != nil {
+			return config, fmt.Errorf("invalid DUFS_SERVERS: %v", err)
+		}
+		for name, server := range config.Servers {
+			if name == "" || name == defaultServerName {
+				return config, fmt.Errorf("invalid DUFS_SERVERS: server name %q is reserved", name)
+			}
+			if server.URL == "" {
+				return config, fmt.Errorf("invalid DUFS_SERVERS: server %s has no url", name)
+			}
+		}
 	}
 
-	file, err := os.Open(localPath)
+	config.ClientCertFile = os.Getenv("DUFS_CLIENT_CERT")
+	config.ClientKeyFile = os.Getenv("DUFS_CLIENT_KEY")
+	config.CACertFile = os.Getenv("DUFS_CA_CERT")
+	tlsConfig, err := buildTLSConfig(config)
 	if err != nil {
-		return "", 0, fmt.Errorf("failed to open file: %v", err)
+		return config, err
 	}
-	defer file.Close()
+	config.TLSConfig = tlsConfig
 
-	resp, err := s.dufsClient.makeRequest("PUT", finalRemotePath, file, nil)
+	config.HTTPTLSCertFile = os.Getenv("DUFS_TLS_CERT_FILE")
+	config.HTTPTLSKeyFile = os.Getenv("DUFS_TLS_KEY_FILE")
+	config.HTTPTLSClientCAFile = os.Getenv("DUFS_TLS_CLIENT_CA_FILE")
+	httpTLSConfig, err := buildHTTPServerTLSConfig(config)
 	if err != nil {
-		return "", 0, fmt.Errorf("upload failed: %v", err)
+		return config, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(resp.Body)
-		return "", resp.StatusCode, fmt.Errorf("upload failed with status %d: %s", resp.StatusCode, string(body))
+	config.HTTPTLSConfig = httpTLSConfig
+
+	// DUFS_PROXY 是 DUFS_PROXY_URL 的旧名称，仍然支持
+	proxyEnv := "DUFS_PROXY_URL"
+	config.ProxyURL = os.Getenv(proxyEnv)
+	if config.ProxyURL == "" {
+		proxyEnv = "DUFS_PROXY"
+		config.ProxyURL = os.Getenv(proxyEnv)
 	}
-
-	return finalRemotePath, resp.StatusCode, nil
-}
-
-func (s *MCPServer) handleUpload(args map[string]interface{}) (interface{}, error) {
-	localPath, ok := args["local_path"].(string)
-	if !ok || localPath == "" {
-		return nil, fmt.Errorf("local_path is required")
+	if config.ProxyURL != "" && config.ProxyURL != "direct" {
+		parsed, err := url.Parse(config.ProxyURL)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return config, fmt.Errorf("invalid %s: %s", proxyEnv, config.ProxyURL)
+		}
 	}
 
-	remotePath, _ := args["remote_path"].(string)
-	async, _ := args["async"].(bool)
+	for _, ext := range splitList(os.Getenv("DUFS_ALLOWED_EXTENSIONS")) {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		config.AllowedExtensions = append(config.AllowedExtensions, ext)
+	}
 
-	// 如果 async=true，使用异步上传
-	if async {
-		// 创建单个文件的任务
-		tasks := []UploadTaskResult{
-			{
-				LocalPath:           localPath,
-				RequestedRemotePath: remotePath,
-				Status:              "pending",
-			},
+	if v := os.Getenv("DUFS_TOOL_TIMEOUTS"); v != "" {
+		timeouts, err := parseToolTimeouts(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid DUFS_TOOL_TIMEOUTS: %v", err)
 		}
+		config.ToolTimeouts = timeouts
+	}
 
-		jobID := fmt.Sprintf("job-%d", time.Now().UnixNano())
-		job := &UploadJob{
-			ID:        jobID,
-			Status:    "pending",
-			CreatedAt: time.Now(),
-			Tasks:     tasks,
+	if v := os.Getenv("DUFS_MAX_RETRIES"); v != "" {
+		retries, err := strconv.Atoi(v)
+		if err != nil || retries < 0 {
+			return config, fmt.Errorf("invalid DUFS_MAX_RETRIES: %s", v)
 		}
+		config.MaxRetries = retries
+	}
 
-		s.jobsMutex.Lock()
-		s.jobs[jobID] = job
-		s.jobsMutex.Unlock()
+	if v := os.Getenv("DUFS_DNS_RETRIES"); v != "" {
+		retries, err := strconv.Atoi(v)
+		if err != nil || retries < 0 {
+			return config, fmt.Errorf("invalid DUFS_DNS_RETRIES: %s", v)
+		}
+		config.DNSRetries = retries
+	}
 
-		go s.runUploadJob(job)
+	config.UploadDirRoot = strings.Trim(os.Getenv("DUFS_UPLOAD_DIR_ROOT"), "/")
+	if config.UploadDirRoot != "" {
+		if config.UploadDir == "" {
+			config.UploadDir = config.UploadDirRoot
+		}
+		if _, err := normalizeUploadDir(config.UploadDir, config.UploadDirRoot); err != nil {
+			return config, fmt.Errorf("invalid DUFS_UPLOAD_DIR: %v", err)
+		}
+	}
 
-		return map[string]interface{}{
-			"success":    true,
-			"job_id":     jobID,
-			"status":     "pending",
-			"task_count": 1,
-		}, nil
+	config.HTTP2 = os.Getenv("DUFS_HTTP2")
+	if config.HTTP2 != "" && config.HTTP2 != "force" && config.HTTP2 != "off" {
+		return config, fmt.Errorf("unknown DUFS_HTTP2: %s (supported: force, off)", config.HTTP2)
 	}
 
-	// 同步上传
-	resolvedPath, statusCode, err := s.performUpload(localPath, remotePath)
-	if err != nil {
-		return nil, err
+	config.JobIDFormat = os.Getenv("DUFS_JOB_ID_FORMAT")
+	if !jobIDFormats[config.JobIDFormat] {
+		return config, fmt.Errorf("unknown DUFS_JOB_ID_FORMAT: %s (supported: nano, uuid, sequential, label-nano)", config.JobIDFormat)
 	}
 
-	return map[string]interface{}{
-		"success":     true,
-		"message":     fmt.Sprintf("File uploaded successfully to %s", resolvedPath),
-		"remote_path": resolvedPath,
-		"status":      statusCode,
-	}, nil
-}
+	if v := os.Getenv("DUFS_MAX_JOBS"); v != "" {
+		maxJobs, err := strconv.Atoi(v)
+		if err != nil || maxJobs < 0 {
+			return config, fmt.Errorf("invalid DUFS_MAX_JOBS: %s", v)
+		}
+		config.MaxJobs = maxJobs
+	}
 
-func (s *MCPServer) handleUploadBatch(args map[string]interface{}) (interface{}, error) {
-	filesParam, ok := args["files"].([]interface{})
-	if !ok || len(filesParam) == 0 {
-		return nil, fmt.Errorf("files is required and must contain at least one entry")
+	if v := os.Getenv("DUFS_MAX_UPLOAD_BYTES"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			return config, fmt.Errorf("invalid DUFS_MAX_UPLOAD_BYTES: %s", v)
+		}
+		config.MaxUploadBytes = size
 	}
 
-	async, ok := args["async"].(bool)
-	if !ok {
-		async = true // 默认异步
+	if v := os.Getenv("DUFS_UPLOAD_CONCURRENCY"); v != "" {
+		concurrency, err := strconv.Atoi(v)
+		if err != nil || concurrency < 1 {
+			return config, fmt.Errorf("invalid DUFS_UPLOAD_CONCURRENCY: %s", v)
+		}
+		config.UploadConcurrency = concurrency
 	}
 
-	tasks := make([]UploadTaskResult, 0, len(filesParam))
-	for _, item := range filesParam {
-		fileArgs, ok := item.(map[string]interface{})
-		if !ok {
-			return nil, fmt.Errorf("invalid file entry: %+v", item)
+	if v := os.Getenv("DUFS_COPY_BUFFER"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 1 {
+			return config, fmt.Errorf("invalid DUFS_COPY_BUFFER: %s", v)
 		}
-		localPath, ok := fileArgs["local_path"].(string)
-		if !ok || localPath == "" {
-			return nil, fmt.Errorf("local_path is required for each file")
+		config.CopyBufferSize = size
+	}
+
+	if v := os.Getenv("DUFS_MAX_MESSAGE_BYTES"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size <= 0 {
+			return config, fmt.Errorf("invalid DUFS_MAX_MESSAGE_BYTES: %s", v)
 		}
-		remotePath, _ := fileArgs["remote_path"].(string)
+		config.MaxMessageBytes = size
+	}
 
-		tasks = append(tasks, UploadTaskResult{
-			LocalPath:           localPath,
-			RequestedRemotePath: remotePath,
-			Status:              "pending",
-		})
+	if v := os.Getenv("DUFS_MAX_READ_SIZE"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size <= 0 {
+			return config, fmt.Errorf("invalid DUFS_MAX_READ_SIZE: %s", v)
+		}
+		config.MaxReadSize = size
 	}
 
-	// 如果 async=false，同步上传所有文件
-	if !async {
-		results := make([]map[string]interface{}, 0, len(tasks))
-		for _, task := range tasks {
-			resolvedPath, statusCode, err := s.performUpload(task.LocalPath, task.RequestedRemotePath)
+	durations := []struct {
+		env    string
+		target *time.Duration
+	}{
+		{"DUFS_DIAL_TIMEOUT", &config.DialTimeout},
+		{"DUFS_TLS_HANDSHAKE_TIMEOUT", &config.TLSHandshakeTimeout},
+		{"DUFS_RESPONSE_HEADER_TIMEOUT", &config.ResponseHeaderTimeout},
+		{"DUFS_IDLE_CONN_TIMEOUT", &config.IdleConnTimeout},
+		{"DUFS_SSE_HEARTBEAT_INTERVAL", &config.SSEHeartbeatInterval},
+		{"MCP_RECONNECT_DELAY", &config.ReconnectDelay},
+	}
+	for _, d := range durations {
+		if v := os.Getenv(d.env); v != "" {
+			value, err := parseDurationEnv(v)
 			if err != nil {
-				results = append(results, map[string]interface{}{
-					"local_path":  task.LocalPath,
-					"remote_path": task.RequestedRemotePath,
-					"success":     false,
-					"error":       err.Error(),
-					"status":      statusCode,
-				})
-			} else {
-				results = append(results, map[string]interface{}{
-					"local_path":  task.LocalPath,
-					"remote_path": resolvedPath,
-					"success":     true,
-					"status":      statusCode,
-				})
+				return config, fmt.Errorf("invalid %s: %v", d.env, err)
 			}
+			*d.target = value
 		}
+	}
 
-		// 检查是否有失败的任务
-		allSuccess := true
-		for _, result := range results {
-			if !result["success"].(bool) {
-				allSuccess = false
-				break
-			}
-		}
+	return config, nil
+}
 
-		return map[string]interface{}{
-			"success": allSuccess,
-			"results": results,
-			"count":   len(results),
-		}, nil
+// splitList 解析逗号分隔的环境变量值，忽略空白项
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
+}
 
-	// 异步上传
-	jobID := fmt.Sprintf("job-%d", time.Now().UnixNano())
-	job := &UploadJob{
-		ID:        jobID,
-		Status:    "pending",
-		CreatedAt: time.Now(),
-		Tasks:     tasks,
+// parseDurationEnv 解析时长类型的环境变量，支持 "30s" 这样的格式，纯数字按秒处理
+func parseDurationEnv(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("duration must not be negative: %s", value)
+		}
+		return time.Duration(seconds) * time.Second, nil
 	}
 
-	s.jobsMutex.Lock()
-	s.jobs[jobID] = job
-	s.jobsMutex.Unlock()
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration must not be negative: %s", value)
+	}
+	return d, nil
+}
 
-	go s.runUploadJob(job)
+// lockedWriter 串行化并发写入。json.Encoder 每条消息只调用一次 Write，因此消息之间不会交错
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
 
-	return map[string]interface{}{
-		"success":    true,
-		"job_id":     jobID,
-		"status":     "pending",
-		"task_count": len(tasks),
-	}, nil
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
 }
 
-func (s *MCPServer) handleUploadStatus(args map[string]interface{}) (interface{}, error) {
-	jobID, ok := args["job_id"].(string)
-	if !ok || jobID == "" {
-		return nil, fmt.Errorf("job_id is required")
-	}
+// runStdioMode 运行 stdio 模式（标准 MCP 协议）
+func runStdioMode(server *MCPServer) {
+	// 使用 stderr 输出日志，stdout 用于 JSON-RPC 通信
+	log.SetOutput(os.Stderr)
 
-	s.jobsMutex.RLock()
-	job, exists := s.jobs[jobID]
-	if !exists {
-		s.jobsMutex.RUnlock()
-		return nil, fmt.Errorf("job %s not found", jobID)
-	}
+	// 后台任务的通知与请求的响应会并发写入 stdout，需要加锁保证每条消息完整
+	stdout := &lockedWriter{w: os.Stdout}
+	encoder := json.NewEncoder(stdout)
+	encoder.SetEscapeHTML(false)
 
-	jobCopy := copyJob(job)
-	s.jobsMutex.RUnlock()
+	notifyEncoder := json.NewEncoder(stdout)
+	notifyEncoder.SetEscapeHTML(false)
+	server.notifier = func(msg MCPMessage) {
+		if err := notifyEncoder.Encode(msg); err != nil {
+			log.Printf("Failed to encode notification: %v", err)
+		}
+	}
 
-	return map[string]interface{}{
-		"success": true,
-		"job":     jobCopy,
-	}, nil
+	if err := serveStdioReconnecting(server, os.Stdin, encoder, server.config.ReconnectDelay, reopenStdin); err != nil {
+		log.Fatalf("Stdio mode stopped: %v", err)
+	}
 }
 
-func copyJob(job *UploadJob) UploadJob {
-	jobCopy := *job
-	jobCopy.Tasks = make([]UploadTaskResult, len(job.Tasks))
-	copy(jobCopy.Tasks, job.Tasks)
-	return jobCopy
+// maxStdinReopenAttempts stdin 关闭后连续重新打开失败的最大次数，超过后退出
+const maxStdinReopenAttempts = 10
+
+// reopenStdin 重新打开 /dev/stdin。Linux 上它指向 /proc/self/fd/0，因此 fd 0 必须保持打开
+func reopenStdin() (io.ReadCloser, error) {
+	return os.Open("/dev/stdin")
 }
 
-func (s *MCPServer) runUploadJob(job *UploadJob) {
-	s.jobsMutex.Lock()
-	job.Status = "running"
-	s.jobsMutex.Unlock()
+// serveStdioReconnecting 处理 input 上的消息。到达 EOF 后，delay 不大于 0 时直接返回，
+// 否则等待 delay 后调用 reopen 重新连接；连续 maxStdinReopenAttempts 次无法打开时返回错误。
+// 调用方传入的 input 不会被关闭，只关闭之前由 reopen 打开的输入
+func serveStdioReconnecting(server *MCPServer, input io.Reader, encoder *json.Encoder, delay time.Duration, reopen func() (io.ReadCloser, error)) error {
+	var reopened io.ReadCloser
+	defer func() {
+		if reopened != nil {
+			reopened.Close()
+		}
+	}()
 
-	for i := range job.Tasks {
-		s.jobsMutex.Lock()
-		job.Tasks[i].Status = "running"
-		job.Tasks[i].StartedAt = time.Now()
-		localPath := job.Tasks[i].LocalPath
-		requestedRemote := job.Tasks[i].RequestedRemotePath
-		s.jobsMutex.Unlock()
+	for {
+		if err := serveStdio(server, bufio.NewReader(input), encoder); err != nil {
+			return fmt.Errorf("failed to read stdin: %v", err)
+		}
+		if delay <= 0 {
+			return nil
+		}
 
-		resolvedPath, statusCode, err := s.performUpload(localPath, requestedRemote)
+		var next io.ReadCloser
+		for attempt := 1; next == nil; attempt++ {
+			log.Printf("stdin closed, reopening /dev/stdin in %s", delay)
+			time.Sleep(delay)
 
-		s.jobsMutex.Lock()
-		if err != nil {
-			job.Tasks[i].Status = "failed"
-			job.Tasks[i].Error = err.Error()
-			job.Tasks[i].HTTPStatus = statusCode
-			job.Tasks[i].CompletedAt = time.Now()
-			job.Status = "failed"
-			job.Error = err.Error()
-			job.CompletedAt = time.Now()
-			s.jobsMutex.Unlock()
-			return
+			f, err := reopen()
+			if err != nil {
+				if attempt >= maxStdinReopenAttempts {
+					return fmt.Errorf("failed to reopen stdin after %d attempts: %v", attempt, err)
+				}
+				log.Printf("Failed to reopen stdin (attempt %d/%d): %v", attempt, maxStdinReopenAttempts, err)
+				continue
+			}
+			next = f
 		}
 
-		job.Tasks[i].Status = "succeeded"
-		job.Tasks[i].ResolvedRemotePath = resolvedPath
-		job.Tasks[i].Message = fmt.Sprintf("uploaded to %s", resolvedPath)
-		job.Tasks[i].HTTPStatus = statusCode
-		job.Tasks[i].CompletedAt = time.Now()
-		s.jobsMutex.Unlock()
+		// 新的输入打开后才关闭上一次重新打开的输入
+		if reopened != nil {
+			reopened.Close()
+		}
+		reopened = next
+		input = next
+		log.Printf("Reconnected to stdin")
 	}
-
-	s.jobsMutex.Lock()
-	job.Status = "completed"
-	job.CompletedAt = time.Now()
-	s.jobsMutex.Unlock()
 }
 
-func (s *MCPServer) handleDownload(args map[string]interface{}) (interface{}, error) {
-	remotePath, ok := args["remote_path"].(string)
-	if !ok {
-		return nil, fmt.Errorf("remote_path is required")
+// errMessageTooLarge 单条消息超过 DUFS_MAX_MESSAGE_BYTES
+var errMessageTooLarge = errors.New("message too large")
+
+// readMessageLine 读取一行消息。超过 maxBytes 的行不会继续缓存，而是丢弃到行尾后返回 errMessageTooLarge，
+// 之后的消息仍可正常读取
+func readMessageLine(reader *bufio.Reader, maxBytes int64) ([]byte, error) {
+	var line []byte
+	tooLarge := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLarge {
+			if int64(len(line)+len(chunk)) > maxBytes+1 {
+				tooLarge = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLarge {
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			return nil, errMessageTooLarge
+		}
+		if err == io.EOF && len(line) > 0 {
+			return line, nil
+		}
+		return line, err
 	}
+}
 
-	localPath, _ := args["local_path"].(string)
-	if localPath == "" {
-		localPath = strings.TrimPrefix(strings.TrimPrefix(remotePath, "/"), "./")
-		localPath = strings.ReplaceAll(localPath, "/", "_")
+// messageTooLargeResponse 消息超过大小上限时返回的 JSON-RPC 错误，此时无法得知请求 ID
+func messageTooLargeResponse(maxBytes int64) MCPMessage {
+	return MCPMessage{
+		JSONRPC: "2.0",
+		Error: &MCPError{
+			Code:    errCodeInvalidRequest,
+			Message: fmt.Sprintf("Invalid Request: message exceeds %d bytes (DUFS_MAX_MESSAGE_BYTES)", maxBytes),
+		},
 	}
+}
 
-	resp, err := s.dufsClient.makeRequest("GET", remotePath, nil, nil)
-	if err != nil {
-		return nil, fmt.Errorf("download failed: %v", err)
+// serveStdio 逐行读取并处理 JSON-RPC 消息，直到输入结束
+func serveStdio(server *MCPServer, reader *bufio.Reader, encoder *json.Encoder) error {
+	maxBytes := server.config.MaxMessageBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxMessageBytes
 	}
-	defer resp.Body.Close()
+	for {
+		raw, err := readMessageLine(reader, maxBytes)
+		if err == errMessageTooLarge {
+			log.Printf("Rejected stdin message larger than %d bytes", maxBytes)
+			if encodeErr := encoder.Encode(messageTooLargeResponse(maxBytes)); encodeErr != nil {
+				log.Printf("Failed to encode error response: %v", encodeErr)
+			}
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("download failed with status %d: %s", resp.StatusCode, string(body))
-	}
+		line := strings.TrimSpace(string(raw))
+		if line == "" {
+			continue
+		}
 
-	file, err := os.Create(localPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create local file: %v", err)
-	}
-	defer file.Close()
+		// JSON-RPC 批量请求：一行包含多个请求对象组成的数组
+		if strings.HasPrefix(line, "[") {
+			if responses := server.handleBatch([]byte(line)); len(responses) > 0 {
+				if err := encoder.Encode(responses); err != nil {
+					log.Printf("Failed to encode batch response: %v", err)
+				}
+			}
+			continue
+		}
 
-	written, err := io.Copy(file, resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write file: %v", err)
-	}
+		var msg MCPMessage
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			log.Printf("Failed to parse message: %v", err)
+			// 发送解析错误响应
+			errorResponse := MCPMessage{
+				JSONRPC: "2.0",
+				ID:      nil, // 如果无法解析，ID 可能也是无效的
+				Error: &MCPError{
+					Code:    errCodeParse,
+					Message: fmt.Sprintf("Parse error: %v", err),
+				},
+			}
+			// 尝试从原始消息中提取 ID
+			var rawMsg map[string]interface{}
+			if json.Unmarshal([]byte(line), &rawMsg) == nil {
+				if id, ok := rawMsg["id"]; ok {
+					errorResponse.ID = id
+				}
+			}
+			if encodeErr := encoder.Encode(errorResponse); encodeErr != nil {
+				log.Printf("Failed to encode error response: %v", encodeErr)
+			}
+			continue
+		}
 
-	return map[string]interface{}{
-		"success":    true,
-		"message":    fmt.Sprintf("File downloaded successfully to %s", localPath),
-		"local_path": localPath,
-		"size_bytes": written,
-		"status":     resp.StatusCode,
-	}, nil
-}
+		// 确保消息有 ID（对于通知消息，ID 可能为 nil）
+		response := server.handleMessage(msg)
 
-func (s *MCPServer) handleDelete(args map[string]interface{}) (interface{}, error) {
-	path, ok := args["path"].(string)
-	if !ok {
-		return nil, fmt.Errorf("path is required")
+		// 只有请求消息（有 ID）才需要响应
+		if msg.ID != nil {
+			if err := encoder.Encode(response); err != nil {
+				log.Printf("Failed to encode response: %v", err)
+			}
+		}
 	}
+}
 
-	resp, err := s.dufsClient.makeRequest("DELETE", path, nil, nil)
-	if err != nil {
-		return nil, fmt.Errorf("delete failed: %v", err)
-	}
-	defer resp.Body.Close()
+// sseRetryHintMillis 通过 SSE retry 字段下发给客户端的重连间隔
+const sseRetryHintMillis = 3000
 
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("delete failed with status %d: %s", resp.StatusCode, string(body))
-	}
+// sseEvent 一条待推送的 SSE 事件
+type sseEvent struct {
+	Event string
+	Data  []byte
+}
 
-	return map[string]interface{}{
-		"success": true,
-		"message": fmt.Sprintf("Deleted %s successfully", path),
-		"status":  resp.StatusCode,
-	}, nil
+// sseSession 表示一个已建立的 SSE 连接
+type sseSession struct {
+	id     string
+	events chan sseEvent
 }
 
-func (s *MCPServer) handleList(args map[string]interface{}) (interface{}, error) {
-	path := "/"
-	if p, ok := args["path"].(string); ok && p != "" {
-		path = p
+// sseBroker 管理所有 SSE 连接，负责把服务端消息推送给客户端
+type sseBroker struct {
+	mu       sync.RWMutex
+	sessions map[string]*sseSession
+	// sendTimeout 会话的事件队列已满时等待的最长时间，超时后丢弃事件
+	sendTimeout time.Duration
+}
+
+func newSSEBroker() *sseBroker {
+	return &sseBroker{
+		sessions:    make(map[string]*sseSession),
+		sendTimeout: 5 * time.Second,
+	}
+}
+
+func (b *sseBroker) subscribe() *sseSession {
+	session := &sseSession{
+		id:     newRandomID(),
+		events: make(chan sseEvent, 64),
 	}
 
-	query, _ := args["query"].(string)
-	format, _ := args["format"].(string)
+	b.mu.Lock()
+	b.sessions[session.id] = session
+	b.mu.Unlock()
 
-	url := path
-	if query != "" {
-		url += "?q=" + query
-	} else if format != "" {
-		url += "?" + format
-	}
+	return session
+}
+
+func (b *sseBroker) unsubscribe(id string) {
+	b.mu.Lock()
+	delete(b.sessions, id)
+	b.mu.Unlock()
+}
 
-	resp, err := s.dufsClient.makeRequest("GET", url, nil, nil)
+// send 向指定会话推送一条事件，会话不存在或事件因超时被丢弃时返回 false
+func (b *sseBroker) send(sessionID, event string, payload interface{}) bool {
+	data, err := json.Marshal(payload)
 	if err != nil {
-		return nil, fmt.Errorf("list failed: %v", err)
+		log.Printf("Failed to marshal SSE event: %v", err)
+		return false
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("list failed with status %d: %s", resp.StatusCode, string(body))
+	b.mu.RLock()
+	session, ok := b.sessions[sessionID]
+	b.mu.RUnlock()
+	if !ok {
+		return false
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	select {
+	case session.events <- sseEvent{Event: event, Data: data}:
+	case <-time.After(b.sendTimeout):
+		log.Printf("SSE session %s is not keeping up, dropping response", sessionID)
+		return false
+	}
+	return true
+}
+
+func (b *sseBroker) exists(sessionID string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.sessions[sessionID]
+	return ok
+}
+
+// broadcast 向所有连接推送一条事件，慢客户端的事件会被丢弃而不是阻塞服务端
+func (b *sseBroker) broadcast(event string, payload interface{}) {
+	data, err := json.Marshal(payload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %v", err)
+		log.Printf("Failed to marshal SSE event: %v", err)
+		return
 	}
 
-	var result interface{}
-	if format == "json" {
-		if err := json.Unmarshal(body, &result); err != nil {
-			return nil, fmt.Errorf("failed to parse JSON: %v", err)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, session := range b.sessions {
+		select {
+		case session.events <- sseEvent{Event: event, Data: data}:
+		default:
+			log.Printf("SSE session %s is not keeping up, dropping event", session.id)
 		}
-	} else {
-		result = string(body)
 	}
-
-	return map[string]interface{}{
-		"success": true,
-		"data":    result,
-		"status":  resp.StatusCode,
-	}, nil
 }
 
-func (s *MCPServer) handleCreateDir(args map[string]interface{}) (interface{}, error) {
-	path, ok := args["path"].(string)
-	if !ok {
-		return nil, fmt.Errorf("path is required")
+// serveSSE 持续向客户端写入推送事件和心跳，直到连接关闭
+func serveSSE(ctx context.Context, w io.Writer, flusher http.Flusher, session *sseSession, heartbeat time.Duration) {
+	var ticks <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		ticks = ticker.C
 	}
 
-	resp, err := s.dufsClient.makeRequest("MKCOL", path, nil, nil)
-	if err != nil {
-		return nil, fmt.Errorf("create directory failed: %v", err)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-session.events:
+			if ev.Event != "" {
+				fmt.Fprintf(w, "event: %s\n", ev.Event)
+			}
+			fmt.Fprintf(w, "data: %s\n\n", ev.Data)
+			flusher.Flush()
+		case now := <-ticks:
+			fmt.Fprintf(w, "event: heartbeat\ndata: {\"type\":\"heartbeat\",\"time\":%q}\n\n", now.UTC().Format(time.RFC3339))
+			flusher.Flush()
+		}
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode == http.StatusMethodNotAllowed {
-		// 405 表示目录已存在，对调用方来说可以视为成功
-		return map[string]interface{}{
-			"success": true,
-			"message": fmt.Sprintf("Directory %s already exists", path),
-			"status":  resp.StatusCode,
-		}, nil
+// newUUID 生成随机的 UUID（版本 4）
+func newUUID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return newRandomID()
 	}
+	buf[6] = buf[6]&0x0f | 0x40
+	buf[8] = buf[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:16])
+}
 
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("create directory failed with status %d: %s", resp.StatusCode, string(body))
+// newRandomID 生成 16 字节的随机十六进制 ID
+func newRandomID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
 	}
-
-	return map[string]interface{}{
-		"success": true,
-		"message": fmt.Sprintf("Directory %s created successfully", path),
-		"status":  resp.StatusCode,
-	}, nil
+	return hex.EncodeToString(buf)
 }
 
-func (s *MCPServer) handleMove(args map[string]interface{}) (interface{}, error) {
-	source, ok := args["source"].(string)
-	if !ok {
-		return nil, fmt.Errorf("source is required")
+// loadCORSConfig 从环境变量读取 HTTP 模式的跨域配置，未设置的项使用默认值
+func loadCORSConfig() CORSConfig {
+	origins := os.Getenv("DUFS_CORS_ORIGINS")
+	if origins == "" {
+		origins = os.Getenv("DUFS_CORS_ORIGIN")
 	}
-	destination, ok := args["destination"].(string)
-	if !ok {
-		return nil, fmt.Errorf("destination is required")
+	cors := CORSConfig{
+		Origins: splitList(origins),
+		Methods: os.Getenv("DUFS_CORS_METHODS"),
+		Headers: os.Getenv("DUFS_CORS_HEADERS"),
 	}
-
-	destURL := strings.TrimSuffix(s.dufsClient.BaseURL, "/") + "/" + strings.TrimPrefix(destination, "/")
-	headers := map[string]string{
-		"Destination": destURL,
+	if len(cors.Origins) == 0 {
+		cors.Origins = []string{"*"}
 	}
-
-	resp, err := s.dufsClient.makeRequest("MOVE", source, nil, headers)
-	if err != nil {
-		return nil, fmt.Errorf("move failed: %v", err)
+	if cors.Methods == "" {
+		cors.Methods = "POST, OPTIONS"
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("move failed with status %d: %s", resp.StatusCode, string(body))
+	if cors.Headers == "" {
+		cors.Headers = "Content-Type"
 	}
-
-	return map[string]interface{}{
-		"success": true,
-		"message": fmt.Sprintf("Moved %s to %s successfully", source, destination),
-		"status":  resp.StatusCode,
-	}, nil
+	return cors
 }
 
-func (s *MCPServer) handleGetHash(args map[string]interface{}) (interface{}, error) {
-	path, ok := args["path"].(string)
-	if !ok {
-		return nil, fmt.Errorf("path is required")
+// setCORSHeaders 设置 HTTP 模式下的跨域响应头。请求来源不在允许列表中时写入 403 并返回 false
+func setCORSHeaders(w http.ResponseWriter, r *http.Request, config Config) bool {
+	origin := r.Header.Get("Origin")
+	allowAny := false
+	allowed := false
+	// 逐项精确比较来源，避免子串匹配放行形如 https://a.example.com.evil 的来源
+	for _, o := range config.CORS.Origins {
+		if o == "*" {
+			allowAny = true
+		}
+		if origin != "" && o == origin {
+			allowed = true
+		}
 	}
 
-	resp, err := s.dufsClient.makeRequest("GET", path+"?hash", nil, nil)
-	if err != nil {
-		return nil, fmt.Errorf("get hash failed: %v", err)
+	if !allowAny {
+		// 回显具体来源时响应随 Origin 变化，需要告知缓存
+		w.Header().Add("Vary", "Origin")
+		if origin != "" && !allowed {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return false
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("get hash failed with status %d: %s", resp.StatusCode, string(body))
+	switch {
+	case allowAny:
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	case allowed:
+		w.Header().Set("Access-Control-Allow-Origin", origin)
 	}
 
-	hash, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read hash: %v", err)
+	headers := config.CORS.Headers
+	if config.HTTPAuthToken != "" && !strings.Contains(strings.ToLower(headers), "authorization") {
+		headers += ", Authorization"
 	}
-
-	return map[string]interface{}{
-		"success": true,
-		"hash":    strings.TrimSpace(string(hash)),
-		"path":    path,
-	}, nil
+	w.Header().Set("Access-Control-Allow-Methods", config.CORS.Methods)
+	w.Header().Set("Access-Control-Allow-Headers", headers)
+	return true
 }
 
-func (s *MCPServer) handleDownloadFolder(args map[string]interface{}) (interface{}, error) {
-	remotePath, ok := args["remote_path"].(string)
-	if !ok {
-		return nil, fmt.Errorf("remote_path is required")
+// authorizeHTTPRequest 校验 Authorization: Bearer <token>，失败时写入 401 并返回 false
+func authorizeHTTPRequest(w http.ResponseWriter, r *http.Request, token string) bool {
+	if token == "" {
+		return true
 	}
 
-	localPath, _ := args["local_path"].(string)
-	if localPath == "" {
-		folderName := strings.TrimPrefix(strings.TrimPrefix(remotePath, "/"), "./")
-		folderName = strings.ReplaceAll(folderName, "/", "_")
-		localPath = folderName + ".zip"
+	provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(provided)), []byte(token)) == 1 {
+		return true
 	}
 
-	resp, err := s.dufsClient.makeRequest("GET", remotePath+"?zip", nil, nil)
-	if err != nil {
-		return nil, fmt.Errorf("download folder failed: %v", err)
-	}
-	defer resp.Body.Close()
+	w.Header().Set("WWW-Authenticate", `Bearer realm="dufs-mcp-server"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
 
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("download folder failed with status %d: %s", resp.StatusCode, string(body))
-	}
+// decodeHTTPMessage 按 Content-Type 解析 /message 请求体。
+// 除 JSON 外还支持 application/x-www-form-urlencoded（例如 curl -d 'message={...}'），消息放在 message 字段中
+func decodeHTTPMessage(r *http.Request) (MCPMessage, int, error) {
+	var msg MCPMessage
 
-	file, err := os.Create(localPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create local file: %v", err)
+	mediaType := "application/json"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		parsed, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return msg, http.StatusUnsupportedMediaType, fmt.Errorf("Unsupported Media Type: %s", contentType)
+		}
+		mediaType = parsed
 	}
-	defer file.Close()
 
-	written, err := io.Copy(file, resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to write file: %v", err)
+	switch mediaType {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			return msg, http.StatusBadRequest, fmt.Errorf("Invalid JSON: %w", err)
+		}
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return msg, http.StatusBadRequest, fmt.Errorf("Invalid form body: %w", err)
+		}
+		message := r.PostForm.Get("message")
+		if message == "" {
+			return msg, http.StatusBadRequest, fmt.Errorf("form field message is required")
+		}
+		if err := json.Unmarshal([]byte(message), &msg); err != nil {
+			return msg, http.StatusBadRequest, fmt.Errorf("Invalid JSON in message field: %v", err)
+		}
+	default:
+		return msg, http.StatusUnsupportedMediaType, fmt.Errorf("Unsupported Media Type: %s, use application/json or application/x-www-form-urlencoded", mediaType)
 	}
 
-	return map[string]interface{}{
-		"success":    true,
-		"message":    fmt.Sprintf("Folder downloaded successfully to %s", localPath),
-		"local_path": localPath,
-		"size_bytes": written,
-		"status":     resp.StatusCode,
-	}, nil
+	return msg, http.StatusOK, nil
 }
 
-func (s *MCPServer) handleHealth(args map[string]interface{}) (interface{}, error) {
-	resp, err := s.dufsClient.makeRequest("GET", "/__dufs__/health", nil, nil)
-	if err != nil {
-		return nil, fmt.Errorf("health check failed: %v", err)
+// httpLogBodyLimit 调试日志中请求体/响应体保留的最大字节数
+const httpLogBodyLimit = 2 << 10
+
+// credentialFieldPattern 匹配 JSON 中疑似凭据的字段，写日志前替换其值。
+// 工具结果以转义后的 JSON 字符串返回，因此引号前允许有反斜杠
+var credentialFieldPattern = regexp.MustCompile(`(?i)(\\?"[\w-]*(?:password|passwd|secret|token|authorization|api_?key|credential)[\w-]*\\?"\s*:\s*)(\\?")(?:[^"\\]|\\[^"])*\\?"`)
+
+// credentialURLPattern 匹配 URL 中的 user:password@ 部分
+var credentialURLPattern = regexp.MustCompile(`(://[^/\s:@"]+):[^/\s@"]+@`)
+
+// redactCredentials 去掉日志内容中的凭据
+func redactCredentials(body []byte) string {
+	redacted := credentialFieldPattern.ReplaceAll(body, []byte(`$1${2}[REDACTED]$2`))
+	redacted = credentialURLPattern.ReplaceAll(redacted, []byte(`$1:[REDACTED]@`))
+	return string(redacted)
+}
+
+// truncateForLog 截断过长的日志内容
+func truncateForLog(body []byte) []byte {
+	if len(body) > httpLogBodyLimit {
+		return body[:httpLogBodyLimit]
 	}
-	defer resp.Body.Close()
+	return body
+}
 
-	return map[string]interface{}{
-		"success": resp.StatusCode == 200,
-		"status":  resp.StatusCode,
-		"healthy": resp.StatusCode == 200,
-	}, nil
+// loggingResponseWriter 记录响应状态码和响应体的前 httpLogBodyLimit 字节
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
 }
 
-func (s *MCPServer) handleMessage(msg MCPMessage) MCPMessage {
-	response := MCPMessage{
-		JSONRPC: "2.0",
-		ID:      msg.ID,
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(data []byte) (int, error) {
+	if remaining := httpLogBodyLimit - w.body.Len(); remaining > 0 {
+		w.body.Write(data[:min(len(data), remaining)])
 	}
+	return w.ResponseWriter.Write(data)
+}
 
-	// 如果没有 method，可能是通知消息或无效消息
-	if msg.Method == "" {
-		response.Error = &MCPError{
-			Code:    -32600,
-			Message: "Invalid Request: method is required",
+// logHTTPRequests 调试用中间件（DEBUG_HTTP_LOG_REQUESTS=true 时启用），记录请求 ID、
+// 来源地址、耗时以及截断并脱敏后的请求体和响应体
+func logHTTPRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = newRandomID()
 		}
-		return response
+		w.Header().Set("X-Request-ID", requestID)
+
+		// 只读取日志需要的前 httpLogBodyLimit 字节，其余部分留给后续处理，避免超大请求体被整个读入内存
+		var requestBody []byte
+		if r.Body != nil {
+			requestBody, _ = io.ReadAll(io.LimitReader(r.Body, httpLogBodyLimit))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(requestBody), r.Body), r.Body}
+		}
+
+		recorder := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		log.Printf("[debug] http request_id=%s remote=%s method=%s path=%s status=%d duration=%s request=%q response=%q",
+			requestID, r.RemoteAddr, r.Method, r.URL.Path, recorder.status, time.Since(start),
+			redactCredentials(truncateForLog(requestBody)), redactCredentials(recorder.body.Bytes()))
 	}
+}
 
-	var result interface{}
-	var err error
+// gzipWriterPool 复用 gzip.Writer，避免每个响应都分配新的压缩器
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(io.Discard)
+	},
+}
 
-	switch msg.Method {
-	case "initialize":
-		result, err = s.handleInitialize(msg.Params)
-	case "tools/list":
-		result, err = s.handleToolsList(msg.Params)
-	case "tools/call":
-		result, err = s.handleToolsCall(msg.Params)
-	default:
-		err = fmt.Errorf("unknown method: %s", msg.Method)
+// gzipResponses 客户端的 Accept-Encoding 包含 gzip 时压缩响应体
+func gzipResponses(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next(gw, r)
 	}
+}
 
-	if err != nil {
-		response.Error = &MCPError{
-			Code:    -32000,
-			Message: err.Error(),
+// acceptsGzip 判断 Accept-Encoding 是否接受 gzip，q=0 表示明确拒绝
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
 		}
-	} else {
-		response.Result = result
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+		return true
 	}
+	return false
+}
 
-	return response
+// gzipResponseWriter 在第一次写入响应体时才开始压缩：没有响应体的响应（如 202、OPTIONS）保持原样，
+// 不带 Content-Encoding
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz     *gzip.Writer
+	status int
 }
 
-func loadConfig() (Config, error) {
-	config := Config{
-		DufsURL:       os.Getenv("DUFS_URL"),
-		Username:      os.Getenv("DUFS_USERNAME"),
-		Password:      os.Getenv("DUFS_PASSWORD"),
-		UploadDir:     os.Getenv("DUFS_UPLOAD_DIR"),
-		AllowInsecure: os.Getenv("DUFS_ALLOW_INSECURE") == "true",
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
 	}
+}
 
-	if config.DufsURL == "" {
-		return config, fmt.Errorf("DUFS_URL environment variable is required")
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.gz == nil {
+		header := g.ResponseWriter.Header()
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		if g.status == 0 {
+			g.status = http.StatusOK
+		}
+		g.ResponseWriter.WriteHeader(g.status)
+		g.gz = gzipWriterPool.Get().(*gzip.Writer)
+		g.gz.Reset(g.ResponseWriter)
 	}
+	return g.gz.Write(p)
+}
 
-	return config, nil
+// close 结束压缩流并把压缩器放回池中；没有写入响应体时补发状态码
+func (g *gzipResponseWriter) close() {
+	if g.gz == nil {
+		if g.status != 0 {
+			g.ResponseWriter.WriteHeader(g.status)
+		}
+		return
+	}
+	if err := g.gz.Close(); err != nil {
+		log.Printf("Failed to finish gzip response: %v", err)
+	}
+	gzipWriterPool.Put(g.gz)
 }
 
-// runStdioMode 运行 stdio 模式（标准 MCP 协议）
-func runStdioMode(server *MCPServer) {
-	// 使用 stderr 输出日志，stdout 用于 JSON-RPC 通信
-	log.SetOutput(os.Stderr)
+// rejectOversizedMessage 请求体超过 DUFS_MAX_MESSAGE_BYTES 时返回 413 和 JSON-RPC 错误
+func rejectOversizedMessage(w http.ResponseWriter, r *http.Request, maxBytes int64) {
+	log.Printf("Rejected HTTP message from %s larger than %d bytes", r.RemoteAddr, maxBytes)
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(messageTooLargeResponse(maxBytes))
+}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	encoder := json.NewEncoder(os.Stdout)
-	encoder.SetEscapeHTML(false)
+// newHTTPHandler 创建 HTTP/SSE 模式的路由：/sse 推送服务端消息，/message 接收客户端消息
+func newHTTPHandler(server *MCPServer) http.Handler {
+	mux := http.NewServeMux()
+	broker := newSSEBroker()
+	server.notifier = func(msg MCPMessage) {
+		broker.broadcast("message", msg)
+	}
 
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
+	// SSE 端点：用于接收服务器推送的消息
+	mux.HandleFunc("/sse", func(w http.ResponseWriter, r *http.Request) {
+		if !setCORSHeaders(w, r, server.config) {
+			return
 		}
 
-		var msg MCPMessage
-		if err := json.Unmarshal([]byte(line), &msg); err != nil {
-			log.Printf("Failed to parse message: %v", err)
-			// 发送解析错误响应
-			errorResponse := MCPMessage{
-				JSONRPC: "2.0",
-				ID:      nil, // 如果无法解析，ID 可能也是无效的
-				Error: &MCPError{
-					Code:    -32700,
-					Message: fmt.Sprintf("Parse error: %v", err),
-				},
-			}
-			// 尝试从原始消息中提取 ID
-			var rawMsg map[string]interface{}
-			if json.Unmarshal([]byte(line), &rawMsg) == nil {
-				if id, ok := rawMsg["id"]; ok {
-					errorResponse.ID = id
-				}
-			}
-			if encodeErr := encoder.Encode(errorResponse); encodeErr != nil {
-				log.Printf("Failed to encode error response: %v", encodeErr)
-			}
-			continue
+		// 浏览器的 CORS 预检请求只返回 CORS 头，不建立事件流
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
-
-		// 确保消息有 ID（对于通知消息，ID 可能为 nil）
-		response := server.handleMessage(msg)
-
-		// 只有请求消息（有 ID）才需要响应
-		if msg.ID != nil {
-			if err := encoder.Encode(response); err != nil {
-				log.Printf("Failed to encode response: %v", err)
-			}
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET, OPTIONS")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
-	}
 
-	if err := scanner.Err(); err != nil {
-		log.Fatalf("Scanner error: %v", err)
-	}
-}
+		if !authorizeHTTPRequest(w, r, server.config.HTTPAuthToken) {
+			return
+		}
 
-// runHTTPMode 运行 HTTP/SSE 模式
-func runHTTPMode(server *MCPServer, port string) {
-	// SSE 端点：用于接收服务器推送的消息
-	http.HandleFunc("/sse", func(w http.ResponseWriter, r *http.Request) {
 		// 设置 SSE headers
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Connection", "keep-alive")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
 		flusher, ok := w.(http.Flusher)
 		if !ok {
@@ -1109,43 +9205,125 @@ func runHTTPMode(server *MCPServer, port string) {
 			return
 		}
 
+		session := broker.subscribe()
+		defer broker.unsubscribe(session.id)
+
+		// 建议客户端断线后的重连间隔（毫秒），客户端应在此基础上做指数退避
+		fmt.Fprintf(w, "retry: %d\n", sseRetryHintMillis)
 		// 发送初始连接消息
 		fmt.Fprintf(w, "data: %s\n\n", `{"type":"connection","status":"connected"}`)
+		// 按 MCP HTTP+SSE 约定告知客户端携带会话 ID 的消息端点
+		fmt.Fprintf(w, "event: endpoint\ndata: /message?sessionId=%s\n\n", session.id)
 		flusher.Flush()
 
-		// 保持连接打开，等待客户端关闭
-		<-r.Context().Done()
+		serveSSE(r.Context(), w, flusher, session, server.config.SSEHeartbeatInterval)
 	})
 
 	// 接收客户端消息的端点
-	http.HandleFunc("/message", func(w http.ResponseWriter, r *http.Request) {
+	messageHandler := func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		if !setCORSHeaders(w, r, server.config) {
+			return
+		}
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
+		if !authorizeHTTPRequest(w, r, server.config.HTTPAuthToken) {
+			return
+		}
+
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var msg MCPMessage
-		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
-			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		maxBytes := server.config.MaxMessageBytes
+		if maxBytes <= 0 {
+			maxBytes = defaultMaxMessageBytes
+		}
+		if r.ContentLength > maxBytes {
+			rejectOversizedMessage(w, r, maxBytes)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+		msg, status, err := decodeHTTPMessage(r)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			rejectOversizedMessage(w, r, maxBytes)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		// 带 sessionId 时响应通过对应的 SSE 连接下发，POST 只返回 202
+		sessionID := r.URL.Query().Get("sessionId")
+		if sessionID != "" {
+			if !broker.exists(sessionID) {
+				http.Error(w, "Unknown session", http.StatusNotFound)
+				return
+			}
+
+			// 工具调用可能持续很久，POST 立即返回 202，处理完成后再通过 SSE 下发响应
+			w.WriteHeader(http.StatusAccepted)
+			go func() {
+				response := server.handleMessage(msg)
+				if msg.ID != nil && !broker.send(sessionID, "message", response) {
+					log.Printf("Response to message %v was not delivered to SSE session %s", msg.ID, sessionID)
+				}
+			}()
 			return
 		}
 
 		response := server.handleMessage(msg)
 		json.NewEncoder(w).Encode(response)
-	})
+	}
+	if server.config.DebugHTTPLogRequests {
+		messageHandler = logHTTPRequests(messageHandler)
+	}
+	// 压缩在调试日志之外进行，日志中记录的是未压缩的响应
+	if !server.config.HTTPDisableGzip {
+		messageHandler = gzipResponses(messageHandler)
+	}
+	mux.HandleFunc("/message", messageHandler)
+
+	return mux
+}
+
+// runHTTPMode 运行 HTTP/SSE 模式
+func runHTTPMode(server *MCPServer, port string) {
+	handler := newHTTPHandler(server)
 
+	// 配置了证书时使用 HTTPS，证书已在 loadConfig 中加载到 TLSConfig
+	if tlsConfig := server.config.HTTPTLSConfig; tlsConfig != nil {
+		httpServer := &http.Server{Addr: ":" + port, Handler: handler, TLSConfig: tlsConfig}
+		if tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+			log.Printf("MCP Server (HTTPS mode, client certificates required) starting on port %s", port)
+		} else {
+			log.Printf("MCP Server (HTTPS mode) starting on port %s", port)
+		}
+		log.Fatal(httpServer.ListenAndServeTLS("", ""))
+	}
 	log.Printf("MCP Server (HTTP mode) starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Fatal(http.ListenAndServe(":"+port, handler))
+}
+
+// logDufsServers 记录主服务器地址以及配置的命名服务器
+func logDufsServers(config Config) {
+	log.Printf("Dufs URL: %s", config.DufsURL)
+	names := make([]string, 0, len(config.Servers))
+	for name := range config.Servers {
+		names = append(names, name)
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		log.Printf("Named dufs servers: %s", strings.Join(names, ", "))
+	}
 }
 
 func main() {
@@ -1172,7 +9350,7 @@ func main() {
 		// stdio 模式：标准 MCP 协议，通过 stdin/stdout 通信
 		log.SetOutput(os.Stderr)
 		log.Printf("MCP Server (stdio mode) starting")
-		log.Printf("Dufs URL: %s", config.DufsURL)
+		logDufsServers(config)
 		runStdioMode(server)
 	case "http", "sse":
 		// HTTP/SSE 模式：通过 HTTP 端点通信
@@ -1180,7 +9358,7 @@ func main() {
 		if port == "" {
 			port = "7887"
 		}
-		log.Printf("Dufs URL: %s", config.DufsURL)
+		logDufsServers(config)
 		runHTTPMode(server, port)
 	default:
 		log.Fatalf("Unknown MCP_MODE: %s. Supported modes: stdio, http, sse", mode)